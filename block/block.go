@@ -7,7 +7,7 @@ import (
 )
 
 /*
-Block Encoding
+Block Encoding (version 0)
 ------------------------------------------------------------------------------------
 |             Data             |              Offset             |      Extra      |
 ------------------------------------------------------------------------------------
@@ -17,41 +17,141 @@ Block Encoding
 -----------------------------------------------------------------------------------
 |                           Entry #1                                        | ... |
 -----------------------------------------------------------------------------------
-| overlap_len(2B) | key_len (2B) | key (len) | value_len (2B) | value (len) | ... |
+| key_len (varint) | key (len) | value_len (varint) | value (len) |         | ... |
 -----------------------------------------------------------------------------------
+
+Block Encoding (version 1)
+---------------------------------------------------------------------------------------------------------------------
+|      Data      |           Restarts            |                           Extra                                   |
+---------------------------------------------------------------------------------------------------------------------
+| Entry #1 | ... | Restart #1 | ... | Restart #R | interval (2B) | entries (2B) | R (2B) | version (1B) | 0xFFFF (2B) |
+---------------------------------------------------------------------------------------------------------------------
+
+---------------------------------------------------------------------------------------------------------
+|                                       Entry #1                                                  | ... |
+---------------------------------------------------------------------------------------------------------
+| shared (varint) | unshared (varint) | value_len (varint) | key[shared:] (unshared) | value (len) | ... |
+---------------------------------------------------------------------------------------------------------
+Entries share a prefix with the key before them, except every interval-th one,
+a restart point holding its whole key. Restart points are found by binary
+search and the entries after them decoded in order. A version 0 block has
+at most a few thousand entries, so never ends with the 0xFFFF marker.
+
+Block Encoding (version 2)
+-------------------------------------------------------------------------------------------------------------------
+|      Data      |           Restarts (4B)       |                           Extra                                 |
+-------------------------------------------------------------------------------------------------------------------
+| Entry #1 | ... | Restart #1 | ... | Restart #R | interval (2B) | entries (4B) | R (4B) | version (1B) | 0xFFFF (2B) |
+-------------------------------------------------------------------------------------------------------------------
+Version 1 with 32-bit restarts and counts, for blocks past 64KB or 65535
+entries, which large values and block sizes make.
+
+Hash Index (versions 1 and 2)
+-------------------------------------------------------------------------------
+| Data | Restarts | Bucket #1 (1B) | ... | Bucket #B (1B) | B (2B) | Extra |
+-------------------------------------------------------------------------------
+A block built with a hash index has the top bit of its version set. Each
+key hashes to a bucket holding the restart point before its first version,
+see hashindex.go.
 */
 
 type Block struct{
 	data []byte
-	offsets []uint16
+	// the offset of every entry in version 0, of every restart point after
+	offsets []uint32
+	version uint8
+	// versions 1 and 2 only
+	restartInterval int
+	numEntries int
+	// nil without a hash index
+	hashBuckets []byte
+	// nil for bytes.Compare
+	compare func(a []byte, b []byte) int
 }
 
 const OFFSET_SIZE = 2
 
+const (
+	BlockVersionFull uint8 = iota
+	BlockVersionPrefixCompressed
+	BlockVersionLarge
+)
+
+const (
+	blockVersionMarker = 0xFFFF
+	// interval, entries, restart count, version and marker
+	blockV1TrailerSize = 3*OFFSET_SIZE + 1 + 2
+	largeOffsetSize = 4
+	blockV2TrailerSize = OFFSET_SIZE + 2*largeOffsetSize + 1 + 2
+	// the largest offset or count of a version 1 block
+	maxSmallOffset = 1<<16 - 1
+)
+
+// offsetSize returns the bytes of each restart point of a block of version.
+func offsetSize(version uint8) int{
+	if version == BlockVersionLarge{
+		return largeOffsetSize
+	}
+	return OFFSET_SIZE
+}
+
+func appendOffset(buf []byte, v int, size int) []byte{
+	if size == largeOffsetSize{
+		return binary.BigEndian.AppendUint32(buf,uint32(v))
+	}
+	return binary.BigEndian.AppendUint16(buf,uint16(v))
+}
+
+func readOffset(buf []byte, size int) int{
+	if size == largeOffsetSize{
+		return int(binary.BigEndian.Uint32(buf))
+	}
+	return int(binary.BigEndian.Uint16(buf))
+}
+
 func (b *Block) Encode() []byte{
-	offlen := len(b.offsets)
-	buf := make([]byte, len(b.data))
+	size := offsetSize(b.version)
+	buf := make([]byte, len(b.data), len(b.data)+len(b.offsets)*size+len(b.hashBuckets)+OFFSET_SIZE+blockV2TrailerSize)
 	copy(buf, b.data)
 	for _,offset := range b.offsets{
-		offsetBytes := make([]byte,OFFSET_SIZE)
-		binary.BigEndian.PutUint16(offsetBytes, offset)
-		buf = append(buf, offsetBytes...)
+		buf = appendOffset(buf,int(offset),size)
 	}
-
-	offlenBytes := make([]byte,OFFSET_SIZE)
-	binary.BigEndian.PutUint16(offlenBytes,uint16(offlen))
-	buf = append(buf, offlenBytes...)
-	return buf
+	if b.version == BlockVersionFull{
+		return binary.BigEndian.AppendUint16(buf,uint16(len(b.offsets)))
+	}
+	version := b.version
+	if b.hashBuckets!=nil{
+		buf = append(buf, b.hashBuckets...)
+		buf = binary.BigEndian.AppendUint16(buf,uint16(len(b.hashBuckets)))
+		version |= blockHashIndexFlag
+	}
+	buf = binary.BigEndian.AppendUint16(buf,uint16(b.restartInterval))
+	buf = appendOffset(buf,b.numEntries,size)
+	buf = appendOffset(buf,len(b.offsets),size)
+	buf = append(buf, version)
+	return binary.BigEndian.AppendUint16(buf,blockVersionMarker)
 }
 
 func Decode(data []byte) (*Block,error){
-	offsetCount := binary.BigEndian.Uint16(data[len(data) - OFFSET_SIZE:])
-	offsetStart := len(data) - int(OFFSET_SIZE + (OFFSET_SIZE*offsetCount))
+	if len(data) < OFFSET_SIZE{
+		return nil, fmt.Errorf("block too small")
+	}
+	if binary.BigEndian.Uint16(data[len(data)-OFFSET_SIZE:]) == blockVersionMarker{
+		return decodeRestarts(data)
+	}
+	offsetCount := int(binary.BigEndian.Uint16(data[len(data) - OFFSET_SIZE:]))
+	offsetStart := len(data) - OFFSET_SIZE - OFFSET_SIZE*offsetCount
+	if offsetStart < 0{
+		return nil, fmt.Errorf("block of %d bytes too small for %d offsets",len(data),offsetCount)
+	}
 	offsetData := data[offsetStart:len(data)-OFFSET_SIZE]
-	var offsets []uint16
+	var offsets []uint32
 	for i:=0;i<len(offsetData);i+=OFFSET_SIZE{
 		offset := binary.BigEndian.Uint16(offsetData[i:i+OFFSET_SIZE])
-		offsets = append(offsets, offset)
+		if int(offset) >= offsetStart{
+			return nil, fmt.Errorf("entry %d past the block data",i/OFFSET_SIZE)
+		}
+		offsets = append(offsets, uint32(offset))
 	}
 
 	blockData := data[:offsetStart]
@@ -61,20 +161,143 @@ func Decode(data []byte) (*Block,error){
 	},nil
 } 
 
-func (b *Block) getFirstKey() ([]byte,error){
+// decodeRestarts decodes a block with restart points, of version 1 or 2.
+func decodeRestarts(data []byte) (*Block,error){
+	if len(data) < blockV1TrailerSize{
+		return nil, fmt.Errorf("block too small for its trailer")
+	}
+	version := data[len(data)-3] &^ blockHashIndexFlag
+	hashIndex := data[len(data)-3]&blockHashIndexFlag != 0
+	trailerSize := blockV1TrailerSize
+	switch version{
+	case BlockVersionPrefixCompressed:
+	case BlockVersionLarge:
+		trailerSize = blockV2TrailerSize
+		if len(data) < trailerSize{
+			return nil, fmt.Errorf("block too small for its trailer")
+		}
+	default:
+		return nil, fmt.Errorf("unknown block version %d",version)
+	}
+	size := offsetSize(version)
+	trailer := data[len(data)-trailerSize:]
+	b := &Block{
+		version: version,
+		restartInterval: int(binary.BigEndian.Uint16(trailer)),
+		numEntries: readOffset(trailer[OFFSET_SIZE:],size),
+	}
+	numRestarts := readOffset(trailer[OFFSET_SIZE+size:],size)
+	restartsEnd := len(data) - trailerSize
+	if hashIndex{
+		if restartsEnd < OFFSET_SIZE{
+			return nil, fmt.Errorf("block too small for its hash index")
+		}
+		numBuckets := int(binary.BigEndian.Uint16(data[restartsEnd-OFFSET_SIZE:]))
+		restartsEnd -= OFFSET_SIZE+numBuckets
+		if restartsEnd < 0 || numBuckets == 0{
+			return nil, fmt.Errorf("invalid block hash index")
+		}
+		b.hashBuckets = data[restartsEnd:restartsEnd+numBuckets]
+	}
+	offsetStart := restartsEnd - numRestarts*size
+	if offsetStart < 0 || b.restartInterval == 0 || (b.numEntries+b.restartInterval-1)/b.restartInterval != numRestarts{
+		return nil, fmt.Errorf("invalid block trailer")
+	}
+	b.offsets = make([]uint32,0,numRestarts)
+	for i := 0; i < numRestarts; i++{
+		offset := readOffset(data[offsetStart+i*size:],size)
+		if offset >= offsetStart{
+			return nil, fmt.Errorf("restart point %d past the block data",i)
+		}
+		b.offsets = append(b.offsets, uint32(offset))
+	}
+	b.data = data[:offsetStart]
+	return b,nil
+}
+
+// SetCompare sets the order keys were added in, nil being bytes.Compare.
+func (b *Block) SetCompare(compare func(a []byte, b []byte) int){
+	b.compare = compare
+}
+
+func (b *Block) cmp(x []byte, y []byte) int{
+	if b.compare==nil{
+		return bytes.Compare(x,y)
+	}
+	return b.compare(x,y)
+}
 
-	keyLen, n := decodeVarint(b.data)
-	if n == 0 {
-        return nil, fmt.Errorf("failed to decode key length")
-    }
-	buf := bytes.NewReader(b.data[n:])
-	key := make([]byte, keyLen)
-    _, err := buf.Read(key)
-    if err != nil {
-        return nil, fmt.Errorf("failed to read key: %w", err)
-    }
+// entryCount returns the number of entries in the block.
+func (b *Block) entryCount() int{
+	if b.version == BlockVersionFull{
+		return len(b.offsets)
+	}
+	return b.numEntries
+}
 
-    return key, nil
+// interval returns the number of entries between restart points.
+func (b *Block) interval() int{
+	if b.version == BlockVersionFull{
+		// every entry holds its whole key
+		return 1
+	}
+	return b.restartInterval
+}
+
+// decodeEntry decodes the entry at offset, prev being the key before it.
+// It returns the key, where the value is and where the next entry starts,
+// with a nil key if the entry is invalid.
+func (b *Block) decodeEntry(offset int, prev []byte) ([]byte,[2]int,int){
+	if offset < 0 || offset >= len(b.data){
+		return nil,[2]int{},0
+	}
+	var shared, unshared, valueLen uint64
+	if b.version == BlockVersionFull{
+		var n int
+		if unshared, n = binary.Uvarint(b.data[offset:]); n <= 0{
+			return nil,[2]int{},0
+		}
+		offset += n
+		if uint64(len(b.data)-offset) < unshared{
+			return nil,[2]int{},0
+		}
+		keyEnd := offset+int(unshared)
+		if valueLen, n = binary.Uvarint(b.data[keyEnd:]); n <= 0{
+			return nil,[2]int{},0
+		}
+		key := append([]byte{},b.data[offset:keyEnd]...)
+		valueStart := keyEnd+n
+		if uint64(len(b.data)-valueStart) < valueLen{
+			return nil,[2]int{},0
+		}
+		return key,[2]int{valueStart,valueStart+int(valueLen)},valueStart+int(valueLen)
+	}
+	for _, v := range []*uint64{&shared,&unshared,&valueLen}{
+		var n int
+		if *v, n = binary.Uvarint(b.data[offset:]); n <= 0{
+			return nil,[2]int{},0
+		}
+		offset += n
+	}
+	if shared > uint64(len(prev)) || uint64(len(b.data)-offset) < unshared+valueLen{
+		return nil,[2]int{},0
+	}
+	key := make([]byte,int(shared+unshared))
+	copy(key,prev[:shared])
+	copy(key[shared:],b.data[offset:offset+int(unshared)])
+	valueStart := offset+int(unshared)
+	return key,[2]int{valueStart,valueStart+int(valueLen)},valueStart+int(valueLen)
+}
+
+func (b *Block) getFirstKey() ([]byte,error){
+	if len(b.offsets) == 0{
+		return nil, fmt.Errorf("empty block")
+	}
+	key,_,_ := b.decodeEntry(int(b.offsets[0]),nil)
+	if key == nil{
+		return nil, fmt.Errorf("failed to decode first key")
+	}
+	return key, nil
 }
 
 type BlockIterator struct{
@@ -82,6 +305,8 @@ type BlockIterator struct{
 	key []byte
 	valueRange [2]int
 	idx int
+	// where the entry after the current one starts
+	next int
 	firstKey []byte
 }
 
@@ -90,6 +315,11 @@ func NewBlockIterator(block *Block) *BlockIterator{
 		block: block,
 		idx: 0,
 	}
+	if block == nil{
+		// an iterator over a missing block is never valid
+		iter.block = &Block{}
+		return iter
+	}
 	iter.firstKey,_ = block.getFirstKey()
 	return iter
 }
@@ -100,6 +330,12 @@ func CreateBlockIterAndSeekToFirst(block *Block) *BlockIterator {
     return iter
 }
 
+func CreateBlockIterAndSeekToLast(block *Block) *BlockIterator {
+    iter := NewBlockIterator(block)
+    iter.SeekToLast()
+    return iter
+}
+
 func CreateBlockIterAndSeekToKey(block *Block, key []byte) *BlockIterator {
     iter := NewBlockIterator(block)
     iter.SeekToKey(key)
@@ -107,75 +343,143 @@ func CreateBlockIterAndSeekToKey(block *Block, key []byte) *BlockIterator {
 }
 
 func (bi *BlockIterator) Next() error{
+	if !bi.IsValid(){
+		bi.idx++
+		bi.SeekTo(bi.idx)
+		return nil
+	}
 	bi.idx++
-	bi.SeekTo(bi.idx)
+	if bi.idx >= bi.block.entryCount(){
+		bi.invalidate()
+		return nil
+	}
+	bi.decodeAt(bi.next)
 	return nil
 }
 
-func (bi *BlockIterator) SeekTo(idx int){
-	if idx >= len(bi.block.offsets){
-		bi.key = nil
-		bi.valueRange = [2]int{0,0}
-		return
+func (bi *BlockIterator) Prev() error{
+	if !bi.IsValid(){
+		return nil
 	}
-	offset := bi.block.offsets[idx]
-	bi.SeekToOffset(int(offset))
-	bi.idx = idx
+	bi.idx--
+	bi.SeekTo(bi.idx)
+	return nil
 }
 
-func (bi *BlockIterator) SeekToOffset(offset int){
-	buf := bytes.NewReader(bi.block.data[offset:])
-	keyLen, n := decodeVarint(bi.block.data[offset:])
-	if n == 0 {
-		bi.key = nil
-		bi.valueRange = [2]int{0, 0}
-		return
-	}
-	offset += n
+func (bi *BlockIterator) invalidate(){
+	bi.key = nil
+	bi.valueRange = [2]int{0,0}
+}
 
-	key := make([]byte, keyLen)
-	_, err := buf.ReadAt(key, int64(n))
-	if err != nil {
-		bi.key = nil
-		bi.valueRange = [2]int{0, 0}
+// decodeAt makes the entry at offset, following the current one, current.
+func (bi *BlockIterator) decodeAt(offset int){
+	key, valueRange, next := bi.block.decodeEntry(offset,bi.key)
+	if key == nil{
+		bi.invalidate()
 		return
 	}
 	bi.key = key
-	offset += int(keyLen)
-	valueLen, n := decodeVarint(bi.block.data[offset:])
-	if n == 0 {
-		bi.key = nil
-		bi.valueRange = [2]int{0, 0}
+	bi.valueRange = valueRange
+	bi.next = next
+}
+
+// seekToRestart moves to the entry at restart point r.
+func (bi *BlockIterator) seekToRestart(r int){
+	bi.key = nil
+	bi.idx = r*bi.block.interval()
+	bi.decodeAt(int(bi.block.offsets[r]))
+}
+
+func (bi *BlockIterator) SeekTo(idx int){
+	if idx < 0 || idx >= bi.block.entryCount(){
+		bi.invalidate()
 		return
 	}
-	offset += n
-	bi.valueRange = [2]int{offset, offset + int(valueLen)}
-	offset += int(valueLen)
+	// decode forward from the restart point before idx
+	bi.seekToRestart(idx/bi.block.interval())
+	for bi.IsValid() && bi.idx < idx{
+		bi.idx++
+		bi.decodeAt(bi.next)
+	}
+	bi.idx = idx
+}
+
+func (bi *BlockIterator) SeekToOffset(offset int){
+	bi.key = nil
+	bi.decodeAt(offset)
 }
 
 func (bi *BlockIterator) SeekToFirst() {
     bi.SeekTo(0)
 }
 
+func (bi *BlockIterator) SeekToLast() {
+    bi.SeekTo(bi.block.entryCount()-1)
+}
+
 func (bi *BlockIterator) IsValid() bool{
 	return len(bi.key)!=0
 }
 
-func (bi *BlockIterator) SeekToKey(key []byte){
-	low, high:= 0, len(bi.block.offsets)-1
+// restartKey returns the key at restart point r.
+func (bi *BlockIterator) restartKey(r int) []byte{
+	key,_,_ := bi.block.decodeEntry(int(bi.block.offsets[r]),nil)
+	return key
+}
+
+// searchRestarts returns the number of restart points whose key is less
+// than key, or at most key if orEqual.
+func (bi *BlockIterator) searchRestarts(key []byte, orEqual bool) int{
+	low, high := 0, len(bi.block.offsets)
 	for low < high{
 		mid := (low + (high-low)/2)
-		bi.SeekTo(mid)
-		cmp := bytes.Compare(bi.Key(), key)
-		if cmp < 0 {
+		cmp := bi.block.cmp(bi.restartKey(mid), key)
+		if cmp < 0 || (orEqual && cmp == 0){
 			low = mid + 1
 		} else {
-			// if equal or greater, narrow search window leftward
 			high = mid
 		}
 	}
-	bi.SeekTo(low)
+	return low
+}
 
+func (bi *BlockIterator) SeekToKey(key []byte){
+	// point lookups of a key in the block skip the binary search
+	if bi.seekHashed(key){
+		return
+	}
+	// versions of key can start before the first restart point at key
+	r := bi.searchRestarts(key,false) - 1
+	if r < 0{
+		r = 0
+	}
+	if len(bi.block.offsets) == 0{
+		bi.invalidate()
+		return
+	}
+	bi.seekToRestart(r)
+	// every key is smaller, leave the iterator past the end
+	for bi.IsValid() && bi.block.cmp(bi.Key(), key) < 0{
+		bi.Next()
+	}
+}
+
+// SeekForPrev moves to the last key at or before key. With duplicate keys
+// that is the last of them.
+func (bi *BlockIterator) SeekForPrev(key []byte){
+	r := bi.searchRestarts(key,true) - 1
+	if r < 0{
+		bi.idx = -1
+		bi.invalidate()
+		return
+	}
+	bi.seekToRestart(r)
+	last := bi.idx
+	for bi.IsValid() && bi.block.cmp(bi.Key(), key) <= 0{
+		last = bi.idx
+		bi.Next()
+	}
+	bi.SeekTo(last)
 }
 
 func (bi *BlockIterator) Value() []byte{
@@ -1,7 +1,9 @@
 package block
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -11,7 +13,7 @@ import (
 func TestBlockEncodeDecode(t *testing.T) {
 	originalBlock := &Block{
         data:    []byte("some key-value data"),
-        offsets: []uint16{0, 5, 10},
+        offsets: []uint32{0, 5, 10},
     }
 
 	encoded := originalBlock.Encode()
@@ -24,7 +26,7 @@ func TestBlockEncodeDecode(t *testing.T) {
 func TestBlockEncodeEmptyBlock(t *testing.T) {
     emptyBlock := &Block{
         data:    []byte{},
-        offsets: []uint16{},
+        offsets: []uint32{},
     }
 
     encoded := emptyBlock.Encode()
@@ -99,12 +101,13 @@ func encodeTestData() []byte {
 
 func TestBlockIterator(t *testing.T){
     bb := NewBlockBuilder(50)
-    valid := bb.Add([]byte("apple"),[]byte("value1"))
-    require.True(t,true,valid)
-    valid = bb.Add([]byte("application"),[]byte{13,14,255})
-    valid = bb.Add([]byte("apricot"),[]byte("val2"))
-    valid = bb.Add([]byte("banana"),[]byte("value3"))
-    
+    require.True(t,bb.Add([]byte("apple"),[]byte("value1")))
+    require.True(t,bb.Add([]byte("application"),[]byte{13,14,255}))
+    // the shared prefix with "application" is left out, so "apricot" just
+    // fills the 50 bytes and "banana" doesn't fit
+    require.True(t,bb.Add([]byte("apricot"),[]byte("val2")))
+    require.False(t,bb.Add([]byte("banana"),[]byte("value3")))
+
     block := bb.Build()
     encoded:= block.Encode()
     resBlock,err := Decode(encoded)
@@ -118,6 +121,235 @@ func TestBlockIterator(t *testing.T){
     require.Equal(t,[]byte("application"),iter.Key())
     require.Equal(t,[]byte{13,14,255},iter.Value())
     iter.Next()
+    require.True(t,iter.IsValid())
+    require.Equal(t,[]byte("apricot"),iter.Key())
+    require.Equal(t,[]byte("val2"),iter.Value())
+    iter.Next()
+    require.False(t,iter.IsValid())
+
+}
+func TestBlockIteratorReverse(t *testing.T){
+    bb := NewBlockBuilder(4096)
+    keys := []string{"apple","banana","banana","cherry"}
+    for i,k := range keys{
+        require.True(t,bb.Add([]byte(k),[]byte{byte(i)}))
+    }
+    built := bb.Build()
+    block,err := Decode(built.Encode())
+    require.NoError(t,err)
+
+    iter := CreateBlockIterAndSeekToLast(block)
+    for i:=len(keys)-1;i>=0;i--{
+        require.True(t,iter.IsValid())
+        require.Equal(t,[]byte{byte(i)},iter.Value())
+        iter.Prev()
+    }
+    require.False(t,iter.IsValid())
+
+    iter.SeekForPrev([]byte("banana"))
+    require.Equal(t,[]byte{2},iter.Value())
+    iter.SeekForPrev([]byte("b"))
+    require.Equal(t,[]byte("apple"),iter.Key())
+    iter.SeekForPrev([]byte("a"))
     require.False(t,iter.IsValid())
+    iter.SeekForPrev([]byte("zebra"))
+    require.Equal(t,[]byte("cherry"),iter.Key())
+}
+
+// encodeV0Block encodes entries the way blocks were written before restart
+// points, every key whole.
+func encodeV0Block(keys []string) []byte{
+    block := &Block{}
+    for i, k := range keys{
+        block.offsets = append(block.offsets, uint32(len(block.data)))
+        block.data = binary.AppendUvarint(block.data, uint64(len(k)))
+        block.data = append(block.data, k...)
+        block.data = binary.AppendUvarint(block.data, 1)
+        block.data = append(block.data, byte(i))
+    }
+    return block.Encode()
+}
+
+func TestBlockPrefixCompression(t *testing.T){
+    var keys []string
+    for i := 0; i < 100; i++{
+        // versions of a key are adjacent and may straddle restart points
+        keys = append(keys, fmt.Sprintf("tenant-0001/orders/%04d", i/3))
+    }
+    build := func(interval int) []byte{
+        bb := NewBlockBuilder(1 << 16)
+        bb.SetRestartInterval(interval)
+        for i, k := range keys{
+            require.True(t, bb.Add([]byte(k), []byte{byte(i)}))
+        }
+        built := bb.Build()
+        return built.Encode()
+    }
+    whole := build(1)
+    compressed := build(16)
+    require.Less(t, len(compressed)*2, len(whole))
+
+    for _, encoded := range [][]byte{whole, compressed, build(7), encodeV0Block(keys)}{
+        block, err := Decode(encoded)
+        require.NoError(t, err)
+        iter := CreateBlockIterAndSeekToFirst(block)
+        for i, k := range keys{
+            require.True(t, iter.IsValid())
+            require.Equal(t, k, string(iter.Key()))
+            require.Equal(t, []byte{byte(i)}, iter.Value())
+            iter.Next()
+        }
+        require.False(t, iter.IsValid())
+
+        iter.SeekToLast()
+        for i := len(keys)-1; i >= 0; i--{
+            require.Equal(t, []byte{byte(i)}, iter.Value())
+            iter.Prev()
+        }
+        require.False(t, iter.IsValid())
 
-}
\ No newline at end of file
+        for i := 0; i < 34; i++{
+            key := []byte(fmt.Sprintf("tenant-0001/orders/%04d", i))
+            // the first and last version of each key
+            iter.SeekToKey(key)
+            require.Equal(t, []byte{byte(i*3)}, iter.Value())
+            iter.SeekForPrev(key)
+            require.Equal(t, []byte{byte(min(i*3+2, 99))}, iter.Value())
+        }
+        iter.SeekToKey([]byte("tenant-0001/orders/0005a"))
+        require.Equal(t, "tenant-0001/orders/0006", string(iter.Key()))
+        iter.SeekForPrev([]byte("tenant-0001/orders/0005a"))
+        require.Equal(t, []byte{17}, iter.Value())
+        iter.SeekToKey([]byte("tenant-0002"))
+        require.False(t, iter.IsValid())
+        iter.SeekForPrev([]byte("tenant-0000"))
+        require.False(t, iter.IsValid())
+    }
+}
+
+func TestBlockDecodeUnknownVersion(t *testing.T){
+    bb := NewBlockBuilder(4096)
+    require.True(t, bb.Add([]byte("key"), []byte("value")))
+    built := bb.Build()
+    encoded := built.Encode()
+    encoded[len(encoded)-3] = 9
+    _, err := Decode(encoded)
+    require.Error(t, err)
+}
+
+func TestBlockLarge(t *testing.T){
+    // a value bigger than 64KB alone, and a block of many small entries past it
+    big := bytes.Repeat([]byte("v"), 100000)
+    bb := NewBlockBuilder(4096)
+    require.True(t, bb.Add([]byte("big"), big))
+    require.False(t, bb.Add([]byte("big2"), []byte("v")))
+    built := bb.Build()
+    require.Equal(t, BlockVersionLarge, built.version)
+    block, err := Decode(built.Encode())
+    require.NoError(t, err)
+    iter := CreateBlockIterAndSeekToFirst(block)
+    require.Equal(t, "big", string(iter.Key()))
+    require.Equal(t, big, iter.Value())
+
+    var keys []string
+    bb = NewBlockBuilder(4 << 20)
+    for i := 0; i < 70000; i++{
+        keys = append(keys, fmt.Sprintf("key-%06d", i))
+        require.True(t, bb.Add([]byte(keys[i]), []byte(fmt.Sprintf("value-%06d", i))))
+    }
+    built = bb.Build()
+    require.Equal(t, BlockVersionLarge, built.version)
+    encoded := built.Encode()
+    require.LessOrEqual(t, len(encoded), 4<<20)
+    block, err = Decode(encoded)
+    require.NoError(t, err)
+    iter = CreateBlockIterAndSeekToFirst(block)
+    for i, k := range keys{
+        require.Equal(t, k, string(iter.Key()))
+        require.Equal(t, fmt.Sprintf("value-%06d", i), string(iter.Value()))
+        iter.Next()
+    }
+    require.False(t, iter.IsValid())
+    for _, i := range []int{0, 65535, 65536, 69999}{
+        iter.SeekToKey([]byte(keys[i]))
+        require.Equal(t, keys[i], string(iter.Key()))
+    }
+}
+
+func TestBlockHashIndex(t *testing.T){
+    var keys []string
+    for i := 0; i < 300; i++{
+        // versions of a key are adjacent and may straddle restart points
+        keys = append(keys, fmt.Sprintf("key%04d", i/3*2))
+    }
+    build := func(hashIndex bool, interval int) *Block{
+        bb := NewBlockBuilder(1 << 16)
+        bb.SetRestartInterval(interval)
+        bb.SetHashIndex(hashIndex)
+        for i, k := range keys{
+            require.True(t, bb.Add([]byte(k), []byte{byte(i)}))
+        }
+        built := bb.Build()
+        block, err := Decode(built.Encode())
+        require.NoError(t, err)
+        return block
+    }
+    plain := build(false, 16)
+    require.Nil(t, plain.hashBuckets)
+    // every key is a restart point, more than a bucket holds
+    require.Nil(t, build(true, 1).hashBuckets)
+    for _, interval := range []int{16, 4, 1}{
+        hashed := build(true, interval)
+        if interval > 1{
+            require.NotNil(t, hashed.hashBuckets)
+        }
+        iter := NewBlockIterator(hashed)
+        plainIter := NewBlockIterator(plain)
+        for i := 0; i < 202; i++{
+            // present and missing keys land where a binary search would
+            key := []byte(fmt.Sprintf("key%04d", i))
+            iter.SeekToKey(key)
+            plainIter.SeekToKey(key)
+            require.Equal(t, plainIter.IsValid(), iter.IsValid())
+            if plainIter.IsValid(){
+                require.Equal(t, plainIter.Key(), iter.Key())
+                require.Equal(t, plainIter.Value(), iter.Value())
+            }
+            if i%2 == 0 && i < 200{
+                require.Equal(t, []byte{byte(i/2*3)}, iter.Value())
+                iter.Next()
+                require.Equal(t, []byte{byte(i/2*3+1)}, iter.Value())
+            }
+        }
+        iter.SeekToFirst()
+        for i := range keys{
+            require.Equal(t, []byte{byte(i)}, iter.Value())
+            iter.Next()
+        }
+        require.False(t, iter.IsValid())
+    }
+}
+
+func BenchmarkBlockSeekToKey(b *testing.B){
+    for _, hashIndex := range []bool{false, true}{
+        b.Run(fmt.Sprintf("hashIndex=%v", hashIndex), func(b *testing.B){
+            bb := NewBlockBuilder(4096)
+            bb.SetHashIndex(hashIndex)
+            var keys [][]byte
+            for i := 0; ; i++{
+                key := []byte(fmt.Sprintf("user%08d", i*7))
+                if !bb.Add(key, []byte("value")){
+                    break
+                }
+                keys = append(keys, key)
+            }
+            built := bb.Build()
+            block, _ := Decode(built.Encode())
+            iter := NewBlockIterator(block)
+            b.ResetTimer()
+            for i := 0; i < b.N; i++{
+                iter.SeekToKey(keys[i%len(keys)])
+            }
+        })
+    }
+}
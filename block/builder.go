@@ -1,15 +1,29 @@
 package block
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+)
 
 type BlockBuilder struct{
-	offsets []uint16
+	// offsets of the restart points
+	offsets []uint32
 	data []byte
 	blockSize int
+	restartInterval int
+	numEntries int
 	firstKey []byte
 	lastKey []byte
+	hashIndex bool
+	// hash and restart point of each distinct key, with hashIndex
+	hashes []uint32
+	hashRestarts []uint8
 }
 
+// DefaultRestartInterval is how many entries share prefixes between restart
+// points unless set otherwise. More save space, fewer make seeks cheaper.
+const DefaultRestartInterval = 16
+
 func (b *BlockBuilder) FirstKey() []byte{
 	return b.firstKey
 }
@@ -21,25 +35,62 @@ func (b *BlockBuilder) LastKey() []byte {
 
 func NewBlockBuilder(size int) *BlockBuilder{
 	return &BlockBuilder{
-		offsets: make([]uint16, 0),
+		offsets: make([]uint32, 0),
 		data: make([]byte, 0),
 		blockSize: size,
+		restartInterval: DefaultRestartInterval,
 		firstKey: make([]byte, 0),
 		lastKey: make([]byte,0),
 	}
 }
 
+// SetRestartInterval sets how many entries there are between restart
+// points, 1 storing every key whole. It must be set before adding entries.
+func (b *BlockBuilder) SetRestartInterval(n int){
+	if n > 0{
+		b.restartInterval = n
+	}
+}
+
+// blockVersion returns the format of a block of dataSize bytes and entries
+// entries, version 1 unless its offsets or counts need 32 bits.
+func blockVersion(dataSize int, entries int) uint8{
+	if dataSize > maxSmallOffset || entries > maxSmallOffset{
+		return BlockVersionLarge
+	}
+	return BlockVersionPrefixCompressed
+}
+
+// SetHashIndex gives the block a hash index of its keys, so seeking a key
+// in it is a lookup instead of a binary search. It must be set before adding
+// entries.
+func (b *BlockBuilder) SetHashIndex(enabled bool){
+	b.hashIndex = enabled
+}
 
 func (b *BlockBuilder) estimatedSize() int{
-	// size of offsets start pos u16
-	return OFFSET_SIZE +
-	// offsets for each entry
-	len(b.offsets) * OFFSET_SIZE +
-	len(b.data)
+	return b.sizeWith(len(b.data),len(b.offsets),b.numEntries,len(b.hashes))
+}
+
+// sizeWith returns the encoded size of a block of dataSize bytes, restarts
+// restart points, entries entries and hashed distinct keys.
+func (b *BlockBuilder) sizeWith(dataSize int, restarts int, entries int, hashed int) int{
+	size := dataSize
+	if b.hashIndex{
+		size += numHashBuckets(hashed) + OFFSET_SIZE
+	}
+	if blockVersion(dataSize,entries) == BlockVersionLarge{
+		return size + blockV2TrailerSize + restarts*largeOffsetSize
+	}
+	return size + blockV1TrailerSize + restarts*OFFSET_SIZE
 }
 
 func (b *BlockBuilder) isEmpty() bool{
-	return len(b.offsets)==0
+	return b.numEntries==0
+}
+
+func (b *BlockBuilder) IsEmpty() bool{
+	return b.isEmpty()
 }
 
 func computeOverlap(firstKey, key []byte) int{
@@ -50,36 +101,6 @@ func computeOverlap(firstKey, key []byte) int{
     return i
 }
 
-func appendU16(data []byte, value uint16) []byte {
-    buf := make([]byte, 2)
-    binary.BigEndian.PutUint16(buf, value)
-    return append(data, buf...)
-}
-
-
-func (b *BlockBuilder) oldAdd(key []byte,value []byte) bool{
-	if(len(key)==0){ return false}
-	if b.estimatedSize() + len(key) + len(value) + 3*OFFSET_SIZE > b.blockSize && !b.isEmpty(){
-		return false
-	}
-
-	b.offsets = append(b.offsets, uint16(len(b.data)))
-	overlap:= computeOverlap(b.firstKey,key)
-	b.data = appendU16(b.data, uint16(overlap))
-	b.data = appendU16(b.data,uint16(len(key)-overlap))
-	b.data = append(b.data,key[overlap:]...)
-	b.data = appendU16(b.data,uint16(len(value)))
-	b.data = append(b.data, value...)
-
-	if len(b.firstKey) == 0{
-		b.firstKey = make([]byte, len(key))
-		copy(b.firstKey,key)
-	}
-	b.lastKey = b.lastKey[:0] // reuse memory
-	b.lastKey = append(b.lastKey, key...) 
-	return true
-}
-
 func (b *BlockBuilder) Build() Block{
 	if b.isEmpty() {
         panic("block should not be empty")
@@ -87,51 +108,54 @@ func (b *BlockBuilder) Build() Block{
 	return Block{
 		data: b.data,
 		offsets: b.offsets,
+		version: blockVersion(len(b.data),b.numEntries),
+		restartInterval: b.restartInterval,
+		numEntries: b.numEntries,
+		hashBuckets: buildHashIndex(b.hashes,b.hashRestarts,len(b.offsets)),
 	}
 }
 
-func encodeVarint(x uint64) []byte{
-	var buf []byte
-    for x >= 0x80 {
-        buf = append(buf, byte(x|0x80))
-        x >>= 7
-    }
-    buf = append(buf, byte(x))
-    return buf
-}
-
-func decodeVarint(data []byte) (uint64, int) {
-    var x uint64
-    var shift uint
-    for i, b := range data {
-        x |= uint64(b&0x7F) << shift
-        if b&0x80 == 0 {
-            return x, i + 1
-        }
-        shift += 7
-    }
-    panic("varint decoding failed")
-}
-
 func (b *BlockBuilder) Add(key []byte,value []byte) bool{
 	if len(key)==0{
 		return false
 	}
 
-	keyLenBytes := encodeVarint(uint64(len(key)))
-	valueLenBytes := encodeVarint(uint64(len(value)))
-	estimatedSize := b.estimatedSize() + len(key) + len(keyLenBytes) + len(value) + len(valueLenBytes) + OFFSET_SIZE
+	restart := b.numEntries%b.restartInterval == 0
+	shared := 0
+	if !restart{
+		shared = computeOverlap(b.lastKey,key)
+	}
+	var header []byte
+	header = binary.AppendUvarint(header,uint64(shared))
+	header = binary.AppendUvarint(header,uint64(len(key)-shared))
+	header = binary.AppendUvarint(header,uint64(len(value)))
+	restarts := len(b.offsets)
+	if restart{
+		restarts++
+	}
+	// versions of a key share its hash, the first one is hashed
+	hashed := b.hashIndex && (b.isEmpty() || !bytes.Equal(key,b.lastKey))
+	hashedKeys := len(b.hashes)
+	if hashed{
+		hashedKeys++
+	}
+	estimatedSize := b.sizeWith(len(b.data)+len(header)+len(key)-shared+len(value),restarts,b.numEntries+1,hashedKeys)
+	// an entry bigger than the block size gets a block of its own
 	if  estimatedSize > b.blockSize && !b.isEmpty(){
 		return false
 	}
-	// max 64KB Block size for now
-	b.offsets = append(b.offsets, uint16(len(b.data)))
-	
-	b.data = append(b.data, keyLenBytes...)
-	b.data = append(b.data, key...)
-
-	b.data = append(b.data, valueLenBytes...)
+	if restart{
+		b.offsets = append(b.offsets, uint32(len(b.data)))
+	}
+	if hashed{
+		b.hashes = append(b.hashes, hashKey(key))
+		// past maxHashRestarts the block gets no index
+		b.hashRestarts = append(b.hashRestarts, uint8(min(len(b.offsets)-1,maxHashRestarts)))
+	}
+	b.data = append(b.data, header...)
+	b.data = append(b.data, key[shared:]...)
 	b.data = append(b.data, value...)
+	b.numEntries++
 
 	if len(b.firstKey) == 0 {
         b.firstKey = make([]byte, len(key))
@@ -140,4 +164,4 @@ func (b *BlockBuilder) Add(key []byte,value []byte) bool{
 	b.lastKey = b.lastKey[:0]
 	b.lastKey = append(b.lastKey, key...) 
 	return true
-}
\ No newline at end of file
+}
@@ -0,0 +1,84 @@
+package block
+
+import "bytes"
+
+// blockHashIndexFlag is set in the version byte of blocks with a hash index.
+const blockHashIndexFlag = 0x80
+
+const (
+	// a bucket no key hashed to
+	hashBucketEmpty = 255
+	// a bucket keys of different restart points hashed to
+	hashBucketCollision = 254
+	// restart points past it don't fit a bucket, such blocks get no index
+	maxHashRestarts = hashBucketCollision
+	// keys per bucket, fewer buckets take less space but collide more
+	hashUtilRatio = 0.75
+)
+
+// hashKey is 32-bit FNV-1a, cheap for the short keys of a block.
+func hashKey(key []byte) uint32{
+	h := uint32(2166136261)
+	for _,c := range key{
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return h
+}
+
+// numHashBuckets returns the buckets of an index of keys distinct keys.
+func numHashBuckets(keys int) int{
+	return int(float64(keys)/hashUtilRatio)+1
+}
+
+// buildHashIndex returns the buckets mapping each key hash to the restart
+// point of the key, nil if there are too many restart points.
+func buildHashIndex(hashes []uint32, restarts []uint8, numRestarts int) []byte{
+	if numRestarts > maxHashRestarts || len(hashes) == 0{
+		return nil
+	}
+	buckets := make([]byte,numHashBuckets(len(hashes)))
+	for i := range buckets{
+		buckets[i] = hashBucketEmpty
+	}
+	for i,h := range hashes{
+		bucket := &buckets[h%uint32(len(buckets))]
+		switch *bucket{
+		case hashBucketEmpty:
+			*bucket = restarts[i]
+		case restarts[i], hashBucketCollision:
+		default:
+			*bucket = hashBucketCollision
+		}
+	}
+	return buckets
+}
+
+// hashLookup returns the restart point before the first version of key, ok
+// false if the index doesn't tell. The key may still not be in the block.
+func (b *Block) hashLookup(key []byte) (int,bool){
+	if b.hashBuckets == nil{
+		return 0,false
+	}
+	r := int(b.hashBuckets[hashKey(key)%uint32(len(b.hashBuckets))])
+	if r >= len(b.offsets){
+		// empty, a collision or corrupt
+		return 0,false
+	}
+	return r,true
+}
+
+// seekHashed moves to the first version of key using the hash index,
+// reporting whether it found it. Otherwise SeekToKey has to search.
+func (bi *BlockIterator) seekHashed(key []byte) bool{
+	r, ok := bi.block.hashLookup(key)
+	if !ok{
+		return false
+	}
+	bi.seekToRestart(r)
+	end := (r+1)*bi.block.interval()
+	for bi.IsValid() && bi.idx < end && bi.block.cmp(bi.Key(), key) < 0{
+		bi.Next()
+	}
+	return bi.IsValid() && bytes.Equal(bi.Key(), key)
+}
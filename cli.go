@@ -58,7 +58,10 @@ var deleteCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		key := args[0]
-		db.Delete(key)
+		if err := db.Delete(key); err != nil {
+			fmt.Printf("Failed to delete key=%s: %s\n", key, err)
+			return
+		}
 		fmt.Printf("Deleted key=%s\n", key)
 	},
 }
\ No newline at end of file
@@ -2,9 +2,10 @@ package anchordb
 
 import (
 	"anchordb/table"
+	"bytes"
 	"errors"
 	"fmt"
-	"os"
+	"sync/atomic"
 	"time"
 )
 
@@ -88,30 +89,44 @@ func (s *Storage) performFullCompaction() error {
 	if _, ok := s.options.CompactionType.(NoCompaction); !ok {
 		return errors.New("full compaction cannot be performed when compaction is enabled")
 	}
-	s.storeLock.Lock()
+	s.storeLock.RLock()
 	snapshot := s.store
 	s.storeLock.RUnlock()
+	snapshot.mu.RLock()
 	l0sst := append([]int{},snapshot.l0SSTables...)
-	l1sst := append([]int{},snapshot.levels[0]...)
+	var l1sst []int
+	if len(snapshot.levels) > 0 {
+		l1sst = append([]int{},snapshot.levels[0]...)
+	}
+	snapshot.mu.RUnlock()
 	compactTask := FullCompaction{
 		L0SSTables: l0sst,
 		L1SSTables: l1sst,
 	}
 
-	sstables,_ := s.compact(compactTask)
-	s.storeLock.Lock()
-	//snapshot = *s.store
-	s.storeLock.RUnlock()
+	sstables,err := s.compact(compactTask)
+	if err!=nil{
+		return err
+	}
+	snapshot.mu.Lock()
+	var obsolete []*table.SSTable
 	for _, sst := range append(l0sst, l1sst...) {
+		if t, ok := snapshot.sstables[sst]; ok {
+			obsolete = append(obsolete, t)
+		}
 		delete(snapshot.sstables, sst)
 	}
 	var ids []int
 
 	for _,sst := range sstables{
 		ids = append(ids, sst.Id)
-		snapshot.sstables[sst.Id] = &sst
+		snapshot.sstables[sst.Id] = sst
+		snapshot.linkBlobFiles(sst)
 	}
 
+	if len(snapshot.levels) == 0 {
+		snapshot.levels = make([][]int, 1)
+	}
 	snapshot.levels[0] = ids
 	l0Set := make(map[int]bool)
 	for _,sst := range l0sst{
@@ -125,50 +140,196 @@ func (s *Storage) performFullCompaction() error {
 		}
 	}
 	snapshot.l0SSTables = newL0
+	snapshot.mu.Unlock()
 
-	s.mu.Lock()
-	s.store = snapshot
-	s.mu.Unlock()
-
-	for _, sst := range append(l0sst, l1sst...) {
-		if err := os.Remove(s.getSSTPath(sst)); err != nil {
+	// iterators may still read them, the files go when they are done
+	for _, sst := range obsolete {
+		if err := sst.Remove(); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (s *Storage) compact(compactionTask CompactionTask) ([]table.SSTable,error){
+// collectBlobGarbage runs a full compaction if a blob file is past the
+// garbage ratio, which moves its live values to a new blob file.
+func (s *Storage) collectBlobGarbage() error{
+	if len(s.store.blobFilesToRelocate()) == 0{
+		return nil
+	}
+	return s.performFullCompaction()
+}
+
+func (s *Storage) compact(compactionTask CompactionTask) ([]*table.SSTable,error){
 	s.storeLock.RLock()
 	snapshot := s.store
 	s.storeLock.RUnlock()
 	
 	switch t:= compactionTask.(type){
-	case *FullCompaction:
+	case FullCompaction:
+		snapshot.mu.RLock()
+		var rangeDels []table.RangeTombstone
 		l0Iters := make([]*table.SSTIterator,0,len(t.L0SSTables))
 		for _,id := range t.L0SSTables{
 			sst, ok:= snapshot.sstables[id]
 			if !ok{
+				snapshot.mu.RUnlock()
 				return nil, fmt.Errorf("sstable %d not found",id)
 			}
+			sst.Advise(table.AccessSequential)
 			iter := table.CreateSSTIterAndSeekToFirst(sst)
 			l0Iters = append(l0Iters, iter)
+			rangeDels = append(rangeDels, sst.RangeTombstones()...)
 		}
 		l1SSTs := make([]*table.SSTable,0,len(t.L1SSTables))
 		for _,id := range t.L1SSTables{
 			sst, ok:= snapshot.sstables[id]
 			if !ok{
+				snapshot.mu.RUnlock()
 				return nil, fmt.Errorf("sstable %d not found",id)
 			}
+			sst.Advise(table.AccessSequential)
 			l1SSTs = append(l1SSTs, sst)
+			rangeDels = append(rangeDels, sst.RangeTombstones()...)
 		}
-		_,err := table.NewTwoMergeIterator(
-			table.NewMergeIterator(l0Iters),
+		snapshot.mu.RUnlock()
+		iter,err := table.NewTwoMergeIterator(
+			table.NewMergeIterator(l0Iters,s.options.comparator()),
 			table.CreateSSTConcatIterAndSeekToFirst(l1SSTs),
+			s.options.comparator(),
 		)
 		if err!=nil{
 			return nil,err
 		}
+		// a full compaction writes the bottom level, the range tombstones end
+		// with it
+		return s.compactFromIter(table.NewRangeDelIterator(iter,rangeDels,s.options.comparator()),1)
 	}
 	return nil,nil
-}
\ No newline at end of file
+}
+
+// compactFromIter writes the versions produced by iter (newest first for each
+// key) into new SSTs of about TargetSstSize for level, keeping one version per
+// key below the full history timestamp.
+// The output is the bottom level, so tombstones are dropped and iter must
+// already hide what range tombstones cover, they aren't written out.
+// Values in blob files past the garbage ratio are moved to a new blob file.
+func (s *Storage) compactFromIter(iter table.StorageIterator, level int) ([]*table.SSTable,error){
+	var sstables []*table.SSTable
+	var builder *table.SSTBuilder
+	s.storeLock.Lock()
+	blobs := s.newBlobWriter()
+	s.storeLock.Unlock()
+	relocate := s.store.blobFilesToRelocate()
+	build := func(){
+		s.storeLock.Lock()
+		id := s.nextId
+		s.nextId++
+		s.storeLock.Unlock()
+		sstables = append(sstables, builder.Build(id,s.getSSTPath(id)))
+		builder = nil
+	}
+	// a full output is only cut once the next key is known
+	cut := false
+	historyTsLow := atomic.LoadUint64(&s.fullHistoryTsLow)
+	for iter.IsValid(){
+		key := append([]byte{},iter.Key()...)
+		// versions newer than historyTsLow are kept as they are, the one
+		// visible at historyTsLow is resolved and anything older dropped
+		var versions []*table.InternalValue
+		var ctx *table.MergeContext
+		settled := false
+		// timestamp of the newest full version so far, older versions at or
+		// after it can't be read at any timestamp
+		var shadowTs uint64
+		shadowed := false
+		for iter.IsValid() && bytes.Equal(iter.Key(),key){
+			if !settled{
+				iv,err := table.DecodeInternalValue(iter.Value())
+				if err!=nil{
+					return nil,err
+				}
+				switch{
+				case ctx!=nil:
+					settled = ctx.Add(iv)
+				case shadowed && iv.Timestamp() >= shadowTs:
+				case iv.Timestamp() > historyTsLow:
+					versions = append(versions, iv)
+					if iv.Kind() != table.KindMerge{
+						shadowTs = iv.Timestamp()
+						shadowed = true
+					}
+				default:
+					ctx = table.NewMergeContextAt(key,historyTsLow)
+					ctx.SetBlobSource(s.store)
+					settled = ctx.Add(iv)
+				}
+			}
+			if err := iter.Next();err!=nil{
+				return nil,err
+			}
+		}
+		// a block that can't be read must not drop versions
+		if err := iter.Error(); err!=nil{
+			return nil,err
+		}
+		if ctx!=nil{
+			iv,err := ctx.Resolve(s.options.MergeOperator,true)
+			if err!=nil{
+				return nil,err
+			}
+			if iv!=nil{
+				versions = append(versions, iv)
+			}
+		}
+		if len(versions)==0{
+			continue
+		}
+		if cut{
+			build()
+			cut = false
+		}
+		if builder==nil{
+			builder = s.newSSTBuilder(level,blobs)
+		}
+		for _,iv := range versions{
+			iv,err := s.relocateBlob(key,iv,relocate)
+			if err!=nil{
+				return nil,err
+			}
+			builder.Add(key,iv.Encode())
+		}
+		if builder.EstimatedSize() >= int(s.options.TargetSstSize){
+			cut = true
+		}
+	}
+	if err := iter.Error(); err!=nil{
+		return nil,err
+	}
+	if builder!=nil{
+		build()
+	}
+	if err := s.finishBlobFile(blobs); err!=nil{
+		return nil,err
+	}
+	syncDir(s.path)
+	return sstables,nil
+}
+
+// relocateBlob reads the value of a version in a blob file being relocated,
+// for the builder to write to the new one. Other versions are returned as
+// they are.
+func (s *Storage) relocateBlob(key []byte, iv *table.InternalValue, relocate map[int]bool) (*table.InternalValue,error){
+	if iv.Kind() != table.KindBlob{
+		return iv,nil
+	}
+	ref, err := table.DecodeBlobRef(iv.Value())
+	if err!=nil || !relocate[ref.File]{
+		return iv,err
+	}
+	value, err := s.store.GetBlob(ref)
+	if err!=nil{
+		return nil,err
+	}
+	return table.BuildEntryWithTimestamp(key,value,iv.Seq(),iv.Timestamp()).InternalValue(),nil
+}
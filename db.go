@@ -1,6 +1,9 @@
 package anchordb
 
-import "fmt"
+import (
+	"errors"
+	"log"
+)
 
 type AnchorDB struct{
 	storage *Storage
@@ -18,21 +21,59 @@ func Open(path string,opts *StorageOptions) (*AnchorDB,error){
 	}
 
 	
-	storage,_ := setupStorage(path,opts)
+	storage,err := setupStorage(path,opts)
+	if err!=nil{
+		return nil,err
+	}
 	return &AnchorDB{ 
 		storage: storage,  
 	},nil
 }
 
+// Close writes the memtables out and closes the files of the database. It
+// can be opened again from the same path.
+func (a *AnchorDB) Close() error{
+	return a.storage.Close()
+}
+
 func (a *AnchorDB) Put(key []byte,value []byte) error{
 	err := a.storage.Put(string(key),value)
 	if err!=nil{
-		fmt.Printf("Error: %s",err.Error())
+		log.Printf("Error: %v",err)
 		return err
 	}
 	return nil
 }
 
+// Merge records operand for key. It is folded into the current value with
+// the configured MergeOperator when the key is read or compacted.
+func (a *AnchorDB) Merge(key []byte,operand []byte) error{
+	return a.storage.Merge(string(key),operand)
+}
+
+// CompareAndSwap stores value if the current value of key equals expected,
+// and reports whether it did. A nil expected matches a missing key.
+func (a *AnchorDB) CompareAndSwap(key []byte,expected []byte,value []byte) (bool,error){
+	if value==nil{
+		return false,errors.New("value cannot be empty")
+	}
+	return a.storage.CompareAndSwap(string(key),expected,value)
+}
+
+// PutIfAbsent stores value only if key has no value, and reports whether it did.
+func (a *AnchorDB) PutIfAbsent(key []byte,value []byte) (bool,error){
+	return a.CompareAndSwap(key,nil,value)
+}
+
+// DeleteIfEquals deletes key only if its current value equals expected, and
+// reports whether it did.
+func (a *AnchorDB) DeleteIfEquals(key []byte,expected []byte) (bool,error){
+	if expected==nil{
+		return false,errors.New("expected value cannot be empty")
+	}
+	return a.storage.CompareAndSwap(string(key),expected,nil)
+}
+
 func (a *AnchorDB) Get(key []byte) ([]byte,error){
 	//fmt.Println("in",key)
 	value, err := a.storage.Get(string(key))
@@ -43,6 +84,71 @@ func (a *AnchorDB) Get(key []byte) ([]byte,error){
 	return value.Value(),nil
 }
 
-func (a *AnchorDB) Delete(key string){
-	a.storage.Delete(key)
-}
\ No newline at end of file
+// Delete writes a tombstone for key at timestamp 0. It fails with
+// ErrTimestampOutOfOrder if key has a version with a timestamp.
+func (a *AnchorDB) Delete(key string) error{
+	return a.storage.Delete(key)
+}
+
+// BlockCacheStats reports the hits, misses and size of the block cache.
+func (a *AnchorDB) BlockCacheStats() BlockCacheStats{
+	return a.storage.store.blockCache.Stats()
+}
+
+// DeleteRange deletes every key in [start, end) with a single range tombstone.
+// Range tombstones have no timestamp, so it fails with
+// ErrTimestampOutOfOrder if a key in the range has a version with one.
+func (a *AnchorDB) DeleteRange(start []byte,end []byte) error{
+	return a.storage.DeleteRange(string(start),string(end))
+}
+
+// PutAt stores value for key as a version tagged with the application
+// timestamp ts. Put writes at timestamp 0. A key's timestamps may not go
+// back, writes before its latest version fail with ErrTimestampOutOfOrder,
+// as do Put, Merge and Delete once it has one.
+func (a *AnchorDB) PutAt(key []byte,value []byte,ts uint64) error{
+	if value==nil{
+		return errors.New("value cannot be empty")
+	}
+	return a.storage.PutAt(string(key),value,ts)
+}
+
+// DeleteAt deletes key as of timestamp ts, which may not be before the
+// latest version of key.
+func (a *AnchorDB) DeleteAt(key []byte,ts uint64) error{
+	return a.storage.PutAt(string(key),nil,ts)
+}
+
+// GetAt returns the value of key as of timestamp ts, ignoring versions
+// written at later timestamps.
+func (a *AnchorDB) GetAt(key []byte,ts uint64) ([]byte,error){
+	value, err := a.storage.GetAt(string(key),ts)
+	if err!=nil{
+		return nil,err
+	}
+	return value.Value(),nil
+}
+
+// IteratorAt returns an iterator over the keys and values as of timestamp ts.
+func (a *AnchorDB) IteratorAt(ts uint64) *Iterator{
+	return a.storage.IteratorAt(ts)
+}
+
+// NewIterator returns an iterator over the live keys, positioned at the first
+// key within opts' bounds. opts may be nil.
+func (a *AnchorDB) NewIterator(opts *IteratorOptions) *Iterator{
+	return a.storage.NewIterator(opts)
+}
+
+// SetFullHistoryTsLow lets compaction discard versions that are not visible
+// at timestamp ts or later, shrinking the window GetAt can read.
+func (a *AnchorDB) SetFullHistoryTsLow(ts uint64){
+	a.storage.SetFullHistoryTsLow(ts)
+}
+
+// CollectBlobGarbage moves the live values out of the blob files past
+// StorageOptions.BlobGarbageRatio, which are deleted once no iterator reads
+// them. Garbage is only known once compaction drops the overwritten values.
+func (a *AnchorDB) CollectBlobGarbage() error{
+	return a.storage.collectBlobGarbage()
+}
@@ -1,12 +1,19 @@
 package anchordb
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/rand"
 	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"anchordb/table"
+
 	"github.com/stretchr/testify/require"
 )
 
@@ -165,4 +172,1116 @@ func TestReadWriteSST(t *testing.T) {
 		val,_ := db.Get([]byte(k))
 		fmt.Printf("Value %d is %s\n",i,string(val))
 	}
-}
\ No newline at end of file
+}
+type appendOperator struct{}
+
+func (appendOperator) Name() string { return "append" }
+
+func (appendOperator) FullMerge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	result := append([]byte{}, existing...)
+	for _, op := range operands {
+		result = append(result, op...)
+	}
+	return result, nil
+}
+
+func (appendOperator) PartialMerge(key []byte, operands [][]byte) ([]byte, bool) {
+	return bytes.Join(operands, nil), true
+}
+
+func openTestDB(t *testing.T, opts *StorageOptions) *AnchorDB {
+	dir, err := os.MkdirTemp("", tempDir)
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := Open(dir, opts)
+	require.NoError(t, err)
+	return db
+}
+
+func testOptions() *StorageOptions {
+	return &StorageOptions{
+		MaxMemTableCount:  2,
+		BlockSize:         4096,
+		TargetSstSize:     4 * 1024 * 1024,
+		EnableBloomFilter: true,
+		CompactionType:    NoCompaction{},
+	}
+}
+
+// forceFlush freezes the active memtable and flushes every immutable one to L0.
+func forceFlush(t *testing.T, db *AnchorDB) {
+	s := db.storage
+	s.storeLock.Lock()
+	id := s.nextId
+	s.nextId++
+	s.store.freezeAndReplaceMemtable(id, 0)
+	s.storeLock.Unlock()
+	require.NoError(t, s.flushAllImmutableMemTables())
+}
+
+func TestMerge(t *testing.T) {
+	opts := testOptions()
+	opts.MergeOperator = appendOperator{}
+	db := openTestDB(t, opts)
+
+	require.NoError(t, db.Put([]byte("k1"), []byte("a")))
+	require.NoError(t, db.Merge([]byte("k1"), []byte("b")))
+	require.NoError(t, db.Merge([]byte("k2"), []byte("x")))
+	val, err := db.Get([]byte("k1"))
+	require.NoError(t, err)
+	require.Equal(t, "ab", string(val))
+
+	forceFlush(t, db)
+	require.NoError(t, db.Merge([]byte("k1"), []byte("c")))
+	require.NoError(t, db.Merge([]byte("k2"), []byte("y")))
+	require.NoError(t, db.Merge([]byte("k3"), []byte("p")))
+	val, err = db.Get([]byte("k1"))
+	require.NoError(t, err)
+	require.Equal(t, "abc", string(val))
+
+	forceFlush(t, db)
+	require.NoError(t, db.Merge([]byte("k3"), []byte("q")))
+	require.NoError(t, db.Delete("k2"))
+	require.NoError(t, db.Merge([]byte("k2"), []byte("z")))
+	forceFlush(t, db)
+	require.NoError(t, db.storage.performFullCompaction())
+
+	for k, want := range map[string]string{"k1": "abc", "k2": "z", "k3": "pq"} {
+		val, err = db.Get([]byte(k))
+		require.NoError(t, err)
+		require.Equal(t, want, string(val))
+	}
+}
+
+func TestMergeWithoutOperator(t *testing.T) {
+	db := openTestDB(t, testOptions())
+	require.Error(t, db.Merge([]byte("k1"), []byte("a")))
+}
+
+func TestDeleteRange(t *testing.T) {
+	opts := testOptions()
+	opts.MergeOperator = appendOperator{}
+	db := openTestDB(t, opts)
+
+	for _, k := range []string{"a1", "a2", "a3", "a4", "b1"} {
+		require.NoError(t, db.Put([]byte(k), []byte("v-"+k)))
+	}
+	require.NoError(t, db.DeleteRange([]byte("a"), []byte("b")))
+	_, err := db.Get([]byte("a3"))
+	require.Error(t, err)
+	require.NoError(t, db.Put([]byte("a2"), []byte("new")))
+	require.NoError(t, db.Merge([]byte("a4"), []byte("x")))
+
+	forceFlush(t, db)
+	require.NoError(t, db.Put([]byte("c1"), []byte("v-c1")))
+	forceFlush(t, db)
+	require.NoError(t, db.DeleteRange([]byte("c"), []byte("d")))
+	forceFlush(t, db)
+
+	check := func() {
+		for _, k := range []string{"a1", "a3", "c1"} {
+			_, err := db.Get([]byte(k))
+			require.Error(t, err, k)
+		}
+		for k, want := range map[string]string{"a2": "new", "a4": "x", "b1": "v-b1"} {
+			val, err := db.Get([]byte(k))
+			require.NoError(t, err)
+			require.Equal(t, want, string(val))
+		}
+	}
+	check()
+	require.NoError(t, db.storage.performFullCompaction())
+	check()
+	for _, id := range db.storage.store.levels[0] {
+		require.Empty(t, db.storage.store.sstables[id].RangeTombstones())
+	}
+}
+
+func TestConditionalWrites(t *testing.T) {
+	db := openTestDB(t, testOptions())
+
+	ok, err := db.PutIfAbsent([]byte("lease"), []byte("node-1"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = db.PutIfAbsent([]byte("lease"), []byte("node-2"))
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	ok, err = db.CompareAndSwap([]byte("lease"), []byte("node-2"), []byte("node-3"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	forceFlush(t, db)
+	ok, err = db.CompareAndSwap([]byte("lease"), []byte("node-1"), []byte("node-3"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	val, err := db.Get([]byte("lease"))
+	require.NoError(t, err)
+	require.Equal(t, "node-3", string(val))
+
+	ok, err = db.DeleteIfEquals([]byte("lease"), []byte("node-1"))
+	require.NoError(t, err)
+	require.False(t, ok)
+	ok, err = db.DeleteIfEquals([]byte("lease"), []byte("node-3"))
+	require.NoError(t, err)
+	require.True(t, ok)
+	_, err = db.Get([]byte("lease"))
+	require.Error(t, err)
+
+	ok, err = db.PutIfAbsent([]byte("lease"), []byte("node-4"))
+	require.NoError(t, err)
+	require.True(t, ok)
+}
+
+func TestTimeTravelReads(t *testing.T) {
+	db := openTestDB(t, testOptions())
+
+	require.NoError(t, db.PutAt([]byte("k"), []byte("v1"), 10))
+	require.NoError(t, db.PutAt([]byte("k"), []byte("v2"), 20))
+	require.NoError(t, db.DeleteAt([]byte("k"), 30))
+	require.NoError(t, db.PutAt([]byte("other"), []byte("o"), 15))
+
+	check := func(ts uint64, want map[string]string) {
+		for _, k := range []string{"k", "other"} {
+			val, err := db.GetAt([]byte(k), ts)
+			if v, ok := want[k]; ok {
+				require.NoError(t, err)
+				require.Equal(t, v, string(val))
+			} else {
+				require.Error(t, err)
+			}
+		}
+		got := map[string]string{}
+		iter := db.IteratorAt(ts)
+		defer iter.Close()
+		for ; iter.Valid(); iter.Next() {
+			got[string(iter.Key())] = string(iter.Value())
+		}
+		require.Equal(t, want, got)
+	}
+	checkAll := func() {
+		check(5, map[string]string{})
+		check(15, map[string]string{"k": "v1", "other": "o"})
+		check(25, map[string]string{"k": "v2", "other": "o"})
+		check(35, map[string]string{"other": "o"})
+	}
+	checkAll()
+	forceFlush(t, db)
+	checkAll()
+	require.NoError(t, db.storage.performFullCompaction())
+	checkAll()
+
+	db.SetFullHistoryTsLow(25)
+	require.NoError(t, db.storage.performFullCompaction())
+	check(15, map[string]string{"other": "o"})
+	check(25, map[string]string{"k": "v2", "other": "o"})
+	check(35, map[string]string{"other": "o"})
+}
+
+func TestTimestampOutOfOrder(t *testing.T) {
+	db := openTestDB(t, testOptions())
+
+	require.NoError(t, db.PutAt([]byte("k"), []byte("new"), 20))
+	require.ErrorIs(t, db.PutAt([]byte("k"), []byte("old"), 10), ErrTimestampOutOfOrder)
+	require.ErrorIs(t, db.DeleteAt([]byte("k"), 15), ErrTimestampOutOfOrder)
+	require.ErrorIs(t, db.Put([]byte("k"), []byte("untimed")), ErrTimestampOutOfOrder)
+	require.ErrorIs(t, db.Delete("k"), ErrTimestampOutOfOrder)
+	_, err := db.CompareAndSwap([]byte("k"), []byte("new"), []byte("swapped"))
+	require.ErrorIs(t, err, ErrTimestampOutOfOrder)
+	val, err := db.Get([]byte("k"))
+	require.NoError(t, err)
+	require.Equal(t, "new", string(val))
+
+	// the same timestamp and later ones are fine, also once flushed
+	require.NoError(t, db.PutAt([]byte("k"), []byte("same"), 20))
+	forceFlush(t, db)
+	require.ErrorIs(t, db.PutAt([]byte("k"), []byte("old"), 10), ErrTimestampOutOfOrder)
+	require.NoError(t, db.PutAt([]byte("k"), []byte("later"), 30))
+	val, err = db.GetAt([]byte("k"), 25)
+	require.NoError(t, err)
+	require.Equal(t, "same", string(val))
+	// keys without a timestamp are unaffected
+	require.NoError(t, db.Put([]byte("other"), []byte("o")))
+	require.NoError(t, db.Delete("other"))
+
+	// range tombstones have no timestamp to hide "k" at
+	require.ErrorIs(t, db.DeleteRange([]byte("a"), []byte("z")), ErrTimestampOutOfOrder)
+	require.NoError(t, db.PutAt([]byte("m"), []byte("m"), 40))
+	require.ErrorIs(t, db.DeleteRange([]byte("l"), []byte("n")), ErrTimestampOutOfOrder)
+	val, err = db.GetAt([]byte("k"), 35)
+	require.NoError(t, err)
+	require.Equal(t, "later", string(val))
+	require.ErrorIs(t, db.PutAt([]byte("k"), []byte("old"), 5), ErrTimestampOutOfOrder)
+	require.NoError(t, db.Put([]byte("other"), []byte("o")))
+	require.NoError(t, db.DeleteRange([]byte("n"), []byte("z")))
+	_, err = db.Get([]byte("other"))
+	require.Error(t, err)
+}
+
+func TestIterator(t *testing.T) {
+	db := openTestDB(t, testOptions())
+
+	collect := func(iter *Iterator) []string {
+		defer iter.Close()
+		var got []string
+		for ; iter.Valid(); iter.Next() {
+			got = append(got, string(iter.Key())+"="+string(iter.Value()))
+		}
+		require.NoError(t, iter.Error())
+		return got
+	}
+
+	// a..d end up in L1, e..f in L0 and g in the memtable, with overwrites
+	// and deletes spread across them.
+	for _, k := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, db.Put([]byte(k), []byte("1")))
+	}
+	forceFlush(t, db)
+	require.NoError(t, db.storage.performFullCompaction())
+	require.NoError(t, db.Put([]byte("b"), []byte("2")))
+	require.NoError(t, db.Delete("c"))
+	require.NoError(t, db.Put([]byte("e"), []byte("2")))
+	require.NoError(t, db.Put([]byte("f"), []byte("2")))
+	forceFlush(t, db)
+	require.NoError(t, db.Put([]byte("f"), []byte("3")))
+	require.NoError(t, db.Put([]byte("g"), []byte("3")))
+	require.NoError(t, db.DeleteRange([]byte("d"), []byte("e")))
+
+	require.Equal(t, []string{"a=1", "b=2", "e=2", "f=3", "g=3"}, collect(db.NewIterator(nil)))
+	require.Equal(t, []string{"b=2", "e=2"}, collect(db.NewIterator(&IteratorOptions{
+		LowerBound: []byte("b"),
+		UpperBound: []byte("f"),
+	})))
+
+	iter := db.NewIterator(&IteratorOptions{LowerBound: []byte("b")})
+	iter.Seek([]byte("c"))
+	require.True(t, iter.Valid())
+	require.Equal(t, "e", string(iter.Key()))
+	iter.Seek([]byte("a"))
+	require.Equal(t, "b", string(iter.Key()))
+	iter.Seek([]byte("h"))
+	require.False(t, iter.Valid())
+	iter.SeekToFirst()
+	require.Equal(t, []string{"b=2", "e=2", "f=3", "g=3"}, collect(iter))
+
+	// writes after the iterator is created are not seen
+	iter = db.NewIterator(nil)
+	require.NoError(t, db.Put([]byte("0"), []byte("4")))
+	require.Equal(t, []string{"a=1", "b=2", "e=2", "f=3", "g=3"}, collect(iter))
+
+	entries, err := db.storage.store.RangeScan("b", "f")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	require.Equal(t, "f", string(entries[2].Key()))
+}
+
+func TestIteratorSnapshotSkipsUnpublishedWrites(t *testing.T) {
+	db := openTestDB(t, testOptions())
+	require.NoError(t, db.Put([]byte("a"), []byte("a")))
+	l := db.storage.store
+
+	// a writer handed a seq that hasn't put its entry yet
+	seq := l.nextSeq()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		require.NoError(t, db.Put([]byte("b"), []byte("b")))
+	}()
+	require.Eventually(t, func() bool {
+		_, ok := l.activeMemtable().Get([]byte("b"))
+		return ok
+	}, time.Second, time.Millisecond)
+
+	keys := func() []string {
+		iter := db.NewIterator(nil)
+		defer iter.Close()
+		var got []string
+		for ; iter.Valid(); iter.Next() {
+			got = append(got, string(iter.Key()))
+		}
+		return got
+	}
+	// "b" has a later seq, it waits for the earlier write
+	require.Equal(t, []string{"a"}, keys())
+	require.NoError(t, l.memtable.Put(table.BuildEntryWithSeqNo([]byte("c"), []byte("c"), seq)))
+	l.publishSeq(seq)
+	<-done
+	require.Equal(t, []string{"a", "b", "c"}, keys())
+}
+
+func TestReverseIterator(t *testing.T) {
+	db := openTestDB(t, testOptions())
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("event-%02d", i)), []byte("old")))
+	}
+	forceFlush(t, db)
+	require.NoError(t, db.storage.performFullCompaction())
+	for i := 0; i < 10; i += 2 {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("event-%02d", i)), []byte("new")))
+	}
+	forceFlush(t, db)
+	require.NoError(t, db.Delete("event-09"))
+	require.NoError(t, db.Put([]byte("event-10"), []byte("new")))
+
+	// latest three events, newest first
+	iter := db.NewIterator(&IteratorOptions{UpperBound: []byte("event-10")})
+	var got []string
+	for iter.SeekToLast(); iter.Valid() && len(got) < 3; iter.Prev() {
+		got = append(got, string(iter.Key())+"="+string(iter.Value()))
+	}
+	require.Equal(t, []string{"event-08=new", "event-07=old", "event-06=new"}, got)
+
+	iter.SeekForPrev([]byte("event-03x"))
+	require.Equal(t, "event-03", string(iter.Key()))
+	require.NoError(t, iter.Next())
+	require.Equal(t, "event-04", string(iter.Key()))
+	require.NoError(t, iter.Prev())
+	require.Equal(t, "event-03", string(iter.Key()))
+	require.NoError(t, iter.Prev())
+	require.Equal(t, "event-02", string(iter.Key()))
+	require.Equal(t, "new", string(iter.Value()))
+
+	iter = db.NewIterator(&IteratorOptions{LowerBound: []byte("event-01")})
+	iter.SeekForPrev([]byte("event-01"))
+	require.Equal(t, "event-01", string(iter.Key()))
+	require.NoError(t, iter.Prev())
+	require.False(t, iter.Valid())
+}
+
+func TestPrefixIterator(t *testing.T) {
+	opts := testOptions()
+	opts.PrefixExtractor = table.NewSeparatorPrefixExtractor('/', 2)
+	db := openTestDB(t, opts)
+
+	// one L0 file per tenant
+	for _, tenant := range []string{"t1", "t2", "t3"} {
+		for i := 0; i < 3; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("%s/orders/%d", tenant, i)), []byte(tenant)))
+		}
+		require.NoError(t, db.Put([]byte(tenant+"/users/1"), []byte(tenant)))
+		forceFlush(t, db)
+	}
+	require.NoError(t, db.Put([]byte("t2/orders/9"), []byte("mem")))
+
+	sources := db.storage.store.collectSources([]byte("t2/orders/"), nil, nil)
+	require.Len(t, sources.l0SSTables, 1)
+	// not a whole prefix, so nothing can be skipped
+	sources = db.storage.store.collectSources([]byte("t2/ord"), nil, nil)
+	require.Len(t, sources.l0SSTables, 3)
+
+	var got []string
+	iter := db.NewIterator(&IteratorOptions{Prefix: []byte("t2/orders/")})
+	for ; iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key())+"="+string(iter.Value()))
+	}
+	require.NoError(t, iter.Error())
+	require.Equal(t, []string{"t2/orders/0=t2", "t2/orders/1=t2", "t2/orders/2=t2", "t2/orders/9=mem"}, got)
+
+	iter = db.NewIterator(&IteratorOptions{Prefix: []byte("t2/orders/")})
+	iter.SeekToLast()
+	require.Equal(t, "t2/orders/9", string(iter.Key()))
+
+	iter = db.NewIterator(&IteratorOptions{Prefix: []byte("t4/orders/")})
+	require.False(t, iter.Valid())
+}
+
+func TestFilterPolicySwitch(t *testing.T) {
+	db := openTestDB(t, testOptions())
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v")))
+	}
+	forceFlush(t, db)
+
+	// tables written before the switch keep their bloom filter
+	db.storage.options.FilterPolicy = table.BlockedBloomFilterPolicy{}
+	for i := 100; i < 200; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v")))
+	}
+	forceFlush(t, db)
+	var types []table.FilterType
+	for _, id := range db.storage.store.l0SSTables {
+		types = append(types, db.storage.store.sstables[id].Filter().Type())
+	}
+	require.Equal(t, []table.FilterType{table.FilterTypeBlockedBloom, table.FilterTypeBloom}, types)
+
+	check := func() {
+		for i := 0; i < 200; i++ {
+			_, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+		}
+		_, err := db.Get([]byte("key200"))
+		require.Error(t, err)
+	}
+	check()
+	require.NoError(t, db.storage.performFullCompaction())
+	for _, id := range db.storage.store.levels[0] {
+		require.Equal(t, table.FilterTypeBlockedBloom, db.storage.store.sstables[id].Filter().Type())
+	}
+	check()
+}
+
+func TestPartitionedIndex(t *testing.T) {
+	opts := testOptions()
+	opts.BlockSize = 256
+	opts.IndexPartitionSize = 4
+	db := openTestDB(t, opts)
+	for i := 0; i < 500; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("v%d", i))))
+	}
+	forceFlush(t, db)
+	for i := 0; i < 500; i += 2 {
+		require.NoError(t, db.Delete(fmt.Sprintf("key%04d", i)))
+	}
+	forceFlush(t, db)
+
+	check := func() {
+		for i := 0; i < 500; i++ {
+			value, err := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+			if i%2 == 0 {
+				require.Error(t, err)
+				continue
+			}
+			require.NoError(t, err)
+			require.Equal(t, fmt.Sprintf("v%d", i), string(value))
+		}
+		var keys []string
+		iter := db.NewIterator(nil)
+		for iter.SeekToLast(); iter.Valid(); iter.Prev() {
+			keys = append(keys, string(iter.Key()))
+		}
+		require.NoError(t, iter.Error())
+		require.Len(t, keys, 250)
+		require.Equal(t, "key0499", keys[0])
+		require.Equal(t, "key0001", keys[249])
+	}
+	check()
+	require.NoError(t, db.storage.performFullCompaction())
+	for _, id := range db.storage.store.levels[0] {
+		require.Nil(t, db.storage.store.sstables[id].Filter())
+	}
+	require.Greater(t, db.storage.store.blockCache.Size(), int64(0))
+	check()
+}
+
+func TestRangeFilterSkipsSSTs(t *testing.T) {
+	opts := testOptions()
+	opts.RangeFilterPrefixLen = 6
+	db := openTestDB(t, opts)
+	// interleaved L0 files, so their key ranges all overlap
+	for f := 0; f < 3; f++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d%d", i, f)), []byte("v")))
+		}
+		forceFlush(t, db)
+	}
+	require.NoError(t, db.Put([]byte("key5"), []byte("mem")))
+
+	sources := db.storage.store.collectSources(nil, nil, nil)
+	require.Len(t, sources.l0SSTables, 3)
+	sources = db.storage.store.collectSources(nil, []byte("key51"), []byte("key52"))
+	require.Len(t, sources.l0SSTables, 1)
+	sources = db.storage.store.collectSources(nil, []byte("key9z"), nil)
+	require.Len(t, sources.l0SSTables, 0)
+
+	var got []string
+	iter := db.NewIterator(&IteratorOptions{LowerBound: []byte("key5"), UpperBound: []byte("key52")})
+	for ; iter.Valid(); iter.Next() {
+		got = append(got, string(iter.Key()))
+	}
+	require.NoError(t, iter.Error())
+	require.Equal(t, []string{"key5", "key50", "key51"}, got)
+}
+
+func TestBlockCacheStats(t *testing.T) {
+	opts := testOptions()
+	opts.BlockSize = 256
+	opts.BlockCacheSize = 1 << 20
+	db := openTestDB(t, opts)
+	for i := 0; i < 200; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte("v")))
+	}
+	forceFlush(t, db)
+	require.Equal(t, int64(1<<20), db.BlockCacheStats().Capacity)
+
+	iter := db.NewIterator(&IteratorOptions{NoFillCache: true})
+	for ; iter.Valid(); iter.Next() {
+	}
+	require.NoError(t, iter.Error())
+	require.Zero(t, db.BlockCacheStats().Size)
+
+	for i := 0; i < 2; i++ {
+		_, err := db.Get([]byte("key100"))
+		require.NoError(t, err)
+	}
+	stats := db.BlockCacheStats()
+	require.Greater(t, stats.Size, int64(0))
+	require.Greater(t, stats.Hits, uint64(0))
+}
+
+func TestReturnedValuesAreCopies(t *testing.T) {
+	opts := testOptions()
+	opts.MinBlobSize = 64
+	db := openTestDB(t, opts)
+	large := bytes.Repeat([]byte("b"), 100)
+	require.NoError(t, db.Put([]byte("key"), []byte("value")))
+	require.NoError(t, db.Put([]byte("large"), large))
+	mutate := func() {
+		for _, k := range []string{"key", "large"} {
+			value, err := db.Get([]byte(k))
+			require.NoError(t, err)
+			value[0] = 'X'
+			iter := db.NewIterator(&IteratorOptions{LowerBound: []byte(k)})
+			require.True(t, iter.Valid())
+			iter.Value()[0] = 'X'
+			iter.Close()
+		}
+	}
+	check := func() {
+		value, err := db.Get([]byte("key"))
+		require.NoError(t, err)
+		require.Equal(t, "value", string(value))
+		value, err = db.Get([]byte("large"))
+		require.NoError(t, err)
+		require.Equal(t, large, value)
+	}
+	// from the memtable, then from cached blocks and blobs
+	mutate()
+	check()
+	forceFlush(t, db)
+	for i := 0; i < 2; i++ {
+		mutate()
+		check()
+	}
+}
+
+func TestMaxOpenFiles(t *testing.T) {
+	opts := testOptions()
+	opts.MaxOpenFiles = 2
+	db := openTestDB(t, opts)
+	for f := 0; f < 5; f++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d%d", f, i)), []byte(fmt.Sprintf("v%d", f))))
+		}
+		forceFlush(t, db)
+	}
+	store := db.storage.store
+	require.LessOrEqual(t, store.tableCache.OpenTables(), 2)
+	for f := 0; f < 5; f++ {
+		value, err := db.Get([]byte(fmt.Sprintf("key%d3", f)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("v%d", f), string(value))
+		require.LessOrEqual(t, store.tableCache.OpenTables(), 2)
+	}
+
+	// an open iterator keeps the compacted away files
+	iter := db.NewIterator(nil)
+	paths := []string{}
+	for _, id := range store.l0SSTables {
+		paths = append(paths, db.storage.getSSTPath(id))
+	}
+	require.NoError(t, db.storage.performFullCompaction())
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		count++
+	}
+	require.NoError(t, iter.Error())
+	require.Equal(t, 50, count)
+	for _, path := range paths {
+		require.FileExists(t, path)
+	}
+	iter.Close()
+	for _, path := range paths {
+		require.NoFileExists(t, path)
+	}
+}
+
+func TestMmap(t *testing.T) {
+	opts := testOptions()
+	opts.UseMmap = true
+	opts.MaxOpenFiles = 1
+	db := openTestDB(t, opts)
+	for f := 0; f < 3; f++ {
+		for i := 0; i < 10; i++ {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%d", i)), []byte(fmt.Sprintf("v%d", f))))
+		}
+		forceFlush(t, db)
+	}
+	value, err := db.Get([]byte("key3"))
+	require.NoError(t, err)
+
+	iter := db.NewIterator(nil)
+	require.NoError(t, db.storage.performFullCompaction())
+	var values [][]byte
+	for ; iter.Valid(); iter.Next() {
+		values = append(values, iter.Value())
+	}
+	require.NoError(t, iter.Error())
+	iter.Close()
+
+	// the compacted away SSTs are unmapped, the values were copied out
+	require.Equal(t, "v2", string(value))
+	require.Len(t, values, 10)
+	for _, v := range values {
+		require.Equal(t, "v2", string(v))
+	}
+	entries, err := db.storage.store.RangeScan("key0", "key9")
+	require.NoError(t, err)
+	require.Len(t, entries, 10)
+}
+
+func TestCompressionPerLevel(t *testing.T) {
+	opts := testOptions()
+	opts.Compression = []CompressionType{table.CompressionTypeNone, table.CompressionTypeLZ4}
+	db := openTestDB(t, opts)
+	value := bytes.Repeat([]byte("compressible"), 20)
+	for i := 0; i < 500; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), value))
+	}
+	forceFlush(t, db)
+	sstSize := func(id int) int64 {
+		info, err := os.Stat(db.storage.getSSTPath(id))
+		require.NoError(t, err)
+		return info.Size()
+	}
+	require.Len(t, db.storage.store.l0SSTables, 1)
+	l0Size := sstSize(db.storage.store.l0SSTables[0])
+
+	// L1 is compressed
+	require.NoError(t, db.storage.performFullCompaction())
+	require.Len(t, db.storage.store.levels[0], 1)
+	require.Less(t, sstSize(db.storage.store.levels[0][0])*4, l0Size)
+	for i := 0; i < 500; i++ {
+		got, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+		require.NoError(t, err)
+		require.Equal(t, value, got)
+	}
+}
+
+func TestCompressionDict(t *testing.T) {
+	opts := testOptions()
+	opts.BlockSize = 512
+	opts.Compression = []CompressionType{table.CompressionTypeZlib}
+	opts.CompressionDictSize = 2048
+	db := openTestDB(t, opts)
+	for i := 0; i < 1000; i++ {
+		doc := fmt.Sprintf(`{"id":%d,"kind":"event","source":"sensor-%d","reading":%d}`, i, i%7, i*31%1000)
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("event%04d", i)), []byte(doc)))
+	}
+	forceFlush(t, db)
+	require.Len(t, db.storage.store.l0SSTables, 1)
+	props := db.storage.store.sstables[db.storage.store.l0SSTables[0]].Properties()
+	require.NotZero(t, props.CompressionDictSize)
+	require.Greater(t, props.CompressionRatio(), 2.0)
+
+	got, err := db.Get([]byte("event0500"))
+	require.NoError(t, err)
+	require.Equal(t, `{"id":500,"kind":"event","source":"sensor-3","reading":500}`, string(got))
+}
+
+func TestLargeBlocks(t *testing.T) {
+	opts := testOptions()
+	opts.BlockSize = 256 << 10
+	db := openTestDB(t, opts)
+	value := func(i int) []byte {
+		return bytes.Repeat([]byte{byte('a' + i)}, 100000+i)
+	}
+	// values past 64KB, and blocks of several of them
+	for i := 0; i < 10; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%02d", i)), value(i)))
+	}
+	for i := 0; i < 3000; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("small%04d", i)), []byte(fmt.Sprintf("value%04d", i))))
+	}
+	forceFlush(t, db)
+	require.NoError(t, db.storage.performFullCompaction())
+	for i := 0; i < 10; i++ {
+		got, err := db.Get([]byte(fmt.Sprintf("key%02d", i)))
+		require.NoError(t, err)
+		require.Equal(t, value(i), got)
+	}
+	for i := 0; i < 3000; i++ {
+		got, err := db.Get([]byte(fmt.Sprintf("small%04d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value%04d", i), string(got))
+	}
+}
+
+func TestKeyValueSizeLimits(t *testing.T) {
+	opts := testOptions()
+	opts.MaxKeySize = 16
+	opts.MaxValueSize = 1024
+	db := openTestDB(t, opts)
+	require.NoError(t, db.Put(bytes.Repeat([]byte("k"), 16), bytes.Repeat([]byte("v"), 1024)))
+	require.ErrorIs(t, db.Put(bytes.Repeat([]byte("k"), 17), []byte("v")), ErrKeyTooLarge)
+	require.ErrorIs(t, db.Put([]byte("key"), bytes.Repeat([]byte("v"), 1025)), ErrValueTooLarge)
+	require.ErrorIs(t, db.PutAt([]byte("key"), bytes.Repeat([]byte("v"), 1025), 1), ErrValueTooLarge)
+	_, err := db.CompareAndSwap(bytes.Repeat([]byte("k"), 17), nil, []byte("v"))
+	require.ErrorIs(t, err, ErrKeyTooLarge)
+	require.ErrorIs(t, db.DeleteRange([]byte("a"), bytes.Repeat([]byte("z"), 17)), ErrKeyTooLarge)
+	_, err = db.Get([]byte("key"))
+	require.Error(t, err)
+
+	// keys are capped by what index partitions can store
+	opts = testOptions()
+	opts.MaxKeySize = 1 << 20
+	db = openTestDB(t, opts)
+	require.ErrorIs(t, db.Put(bytes.Repeat([]byte("k"), 1<<16), []byte("v")), ErrKeyTooLarge)
+	require.NoError(t, db.Put(bytes.Repeat([]byte("k"), 1<<15), []byte("v")))
+}
+
+func TestBlobValues(t *testing.T) {
+	opts := testOptions()
+	opts.MinBlobSize = 1024
+	opts.MergeOperator = appendOperator{}
+	db := openTestDB(t, opts)
+	value := func(i int, version int) []byte {
+		if i%4 == 0 {
+			return []byte(fmt.Sprintf("small%d-%d", i, version))
+		}
+		return bytes.Repeat([]byte(fmt.Sprintf("%d-%d,", i, version)), 500)
+	}
+	blobFiles := func() []string {
+		files, err := filepath.Glob(filepath.Join(db.storage.path, "*.blob"))
+		require.NoError(t, err)
+		return files
+	}
+	check := func(version func(i int) int) {
+		for i := 0; i < 200; i++ {
+			got, err := db.Get([]byte(fmt.Sprintf("key%03d", i)))
+			require.NoError(t, err)
+			require.Equal(t, value(i, version(i)), got)
+		}
+		iter := db.NewIterator(nil)
+		defer iter.Close()
+		for i := 0; i < 200; i++ {
+			require.True(t, iter.Valid())
+			require.Equal(t, value(i, version(i)), iter.Value())
+			iter.Next()
+		}
+		require.False(t, iter.Valid())
+	}
+	for i := 0; i < 200; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), value(i, 0)))
+	}
+	forceFlush(t, db)
+	require.Len(t, blobFiles(), 1)
+	first := blobFiles()[0]
+	props := db.storage.store.sstables[db.storage.store.l0SSTables[0]].Properties()
+	require.Len(t, props.BlobBytes, 1)
+	require.Less(t, props.DataSize, uint64(150*1000))
+	check(func(int) int { return 0 })
+
+	// operands merge into values in blob files
+	require.NoError(t, db.Merge([]byte("key001"), []byte("!")))
+	got, err := db.Get([]byte("key001"))
+	require.NoError(t, err)
+	require.Equal(t, append(value(1, 0), '!'), got)
+	require.NoError(t, db.Put([]byte("key001"), value(1, 0)))
+
+	// compaction moves references, not values
+	require.NoError(t, db.storage.performFullCompaction())
+	require.Equal(t, []string{first}, blobFiles())
+	require.NoError(t, db.CollectBlobGarbage())
+	require.Equal(t, []string{first}, blobFiles())
+
+	// overwriting most values leaves the first blob file mostly garbage
+	for i := 0; i < 160; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), value(i, 1)))
+	}
+	forceFlush(t, db)
+	require.NoError(t, db.storage.performFullCompaction())
+	version := func(i int) int {
+		if i < 160 {
+			return 1
+		}
+		return 0
+	}
+	check(version)
+	require.Contains(t, blobFiles(), first)
+	require.NoError(t, db.CollectBlobGarbage())
+	require.NotContains(t, blobFiles(), first)
+	require.Len(t, blobFiles(), 2)
+	check(version)
+
+	// a file nothing refers to is deleted by the compaction dropping it
+	for i := 0; i < 200; i++ {
+		require.NoError(t, db.Delete(fmt.Sprintf("key%03d", i)))
+	}
+	forceFlush(t, db)
+	require.NoError(t, db.storage.performFullCompaction())
+	require.Empty(t, blobFiles())
+}
+
+func TestCorruptBlockIsReported(t *testing.T) {
+	dir, err := os.MkdirTemp("", tempDir)
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := Open(dir, testOptions())
+	require.NoError(t, err)
+	for i := 0; i < 1000; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%04d", i)), []byte("value")))
+	}
+	require.NoError(t, db.Close())
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sst"))
+	require.NoError(t, err)
+	require.Len(t, paths, 1)
+	data, err := os.ReadFile(paths[0])
+	require.NoError(t, err)
+	// inside the first data block
+	data[1] ^= 0xff
+	require.NoError(t, os.WriteFile(paths[0], data, 0644))
+
+	db, err = Open(dir, testOptions())
+	require.NoError(t, err)
+	_, err = db.Get([]byte("key0000"))
+	require.ErrorIs(t, err, table.ErrCorruption)
+	iter := db.NewIterator(nil)
+	require.False(t, iter.Valid())
+	require.ErrorIs(t, iter.Error(), table.ErrCorruption)
+	iter.Close()
+	require.NoError(t, db.Close())
+}
+
+func TestReopenBlobValues(t *testing.T) {
+	opts := testOptions()
+	opts.MinBlobSize = 64
+	dir, err := os.MkdirTemp("", tempDir)
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := Open(dir, opts)
+	require.NoError(t, err)
+	large := bytes.Repeat([]byte("large"), 100)
+	require.NoError(t, db.Put([]byte("k1"), large))
+	require.NoError(t, db.Put([]byte("k2"), []byte("small")))
+	forceFlush(t, db)
+	// left in the memtable, Close writes it out
+	require.NoError(t, db.Put([]byte("k3"), append([]byte("3"), large...)))
+	require.NoError(t, db.Close())
+
+	db, err = Open(dir, opts)
+	require.NoError(t, err)
+	check := func(key string, want []byte) {
+		got, err := db.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+	check("k1", large)
+	check("k2", []byte("small"))
+	check("k3", append([]byte("3"), large...))
+
+	// new files don't take the ids of the ones already there
+	require.NoError(t, db.Put([]byte("k1"), append([]byte("1"), large...)))
+	require.NoError(t, db.Put([]byte("k4"), append([]byte("4"), large...)))
+	forceFlush(t, db)
+	check("k1", append([]byte("1"), large...))
+	check("k3", append([]byte("3"), large...))
+	check("k4", append([]byte("4"), large...))
+	require.NoError(t, db.Close())
+}
+
+func TestBlockHashIndex(t *testing.T) {
+	opts := testOptions()
+	opts.BlockHashIndex = true
+	db := openTestDB(t, opts)
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 1000; i += round + 1 {
+			require.NoError(t, db.Put([]byte(fmt.Sprintf("key%04d", i)), []byte(fmt.Sprintf("value%d-%d", i, round))))
+		}
+		forceFlush(t, db)
+	}
+	require.NoError(t, db.storage.performFullCompaction())
+	for i := 0; i < 1000; i++ {
+		got, err := db.Get([]byte(fmt.Sprintf("key%04d", i)))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("value%d-%d", i, 1-i%2), string(got))
+		_, err = db.Get([]byte(fmt.Sprintf("key%04d.", i)))
+		require.Error(t, err)
+	}
+}
+
+// numericComparator orders decimal numbers without leading zeros by value.
+type numericComparator struct{}
+
+func (numericComparator) Compare(a []byte, b []byte) int {
+	if len(a) != len(b) {
+		if len(a) < len(b) {
+			return -1
+		}
+		return 1
+	}
+	return bytes.Compare(a, b)
+}
+
+func (numericComparator) Name() string { return "test.numeric" }
+
+func (numericComparator) FindShortestSeparator(start []byte, limit []byte) []byte { return start }
+
+func (numericComparator) FindShortSuccessor(key []byte) []byte { return key }
+
+func TestComparator(t *testing.T) {
+	keys := func(iter *Iterator) []string {
+		defer iter.Close()
+		var got []string
+		for ; iter.Valid(); iter.Next() {
+			got = append(got, string(iter.Key()))
+		}
+		require.NoError(t, iter.Error())
+		return got
+	}
+
+	opts := testOptions()
+	opts.Comparator = numericComparator{}
+	opts.BlockSize = 256
+	db := openTestDB(t, opts)
+	// spread across L1, L0 and the memtable
+	for i := 1; i <= 300; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprint(i)), []byte(fmt.Sprint(i))))
+		if i == 100 {
+			forceFlush(t, db)
+			require.NoError(t, db.storage.performFullCompaction())
+		} else if i == 200 {
+			forceFlush(t, db)
+		}
+	}
+	require.NoError(t, db.DeleteRange([]byte("9"), []byte("100")))
+	got := keys(db.NewIterator(&IteratorOptions{LowerBound: []byte("5"), UpperBound: []byte("105")}))
+	require.Equal(t, []string{"5", "6", "7", "8", "100", "101", "102", "103", "104"}, got)
+	require.Len(t, keys(db.NewIterator(nil)), 300-91)
+	require.Error(t, db.DeleteRange([]byte("20"), []byte("3")))
+	value, err := db.Get([]byte("250"))
+	require.NoError(t, err)
+	require.Equal(t, "250", string(value))
+
+	opts = testOptions()
+	opts.Comparator = table.ReverseBytewiseComparator
+	opts.BlockSize = 256
+	opts.RangeFilterPrefixLen = 4
+	db = openTestDB(t, opts)
+	for i := 0; i < 100; i++ {
+		require.NoError(t, db.Put([]byte(fmt.Sprintf("key%03d", i)), []byte(fmt.Sprint(i))))
+		if i%40 == 39 {
+			forceFlush(t, db)
+		}
+	}
+	require.NoError(t, db.storage.performFullCompaction())
+	require.NoError(t, db.DeleteRange([]byte("key050"), []byte("key040")))
+	got = keys(db.NewIterator(nil))
+	require.Len(t, got, 90)
+	require.Equal(t, []string{"key099", "key098"}, got[:2])
+	require.Equal(t, []string{"key051", "key040", "key039"}, got[48:51])
+	require.Equal(t, []string{"key023", "key022", "key021"}, keys(db.NewIterator(&IteratorOptions{
+		LowerBound: []byte("key023"),
+		UpperBound: []byte("key020"),
+	})))
+	require.Equal(t, []string{"key009", "key008"}, keys(db.NewIterator(&IteratorOptions{Prefix: []byte("key00")}))[:2])
+	entries, err := db.storage.store.RangeScan("key012", "key010")
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	iter := db.NewIterator(nil)
+	iter.SeekToLast()
+	require.Equal(t, "key000", string(iter.Key()))
+	require.NoError(t, iter.Prev())
+	require.Equal(t, "key001", string(iter.Key()))
+	iter.Close()
+
+	// the tables are checked against the comparator when opened again
+	require.NoError(t, db.Close())
+	_, err = Open(db.storage.path, testOptions())
+	require.ErrorIs(t, err, table.ErrComparatorMismatch)
+	db, err = Open(db.storage.path, opts)
+	require.NoError(t, err)
+	require.Len(t, keys(db.NewIterator(nil)), 90)
+	require.NoError(t, db.Close())
+
+	// the manifest has it even without SSTs
+	opts = testOptions()
+	opts.Comparator = numericComparator{}
+	db = openTestDB(t, opts)
+	require.NoError(t, db.Close())
+	_, err = Open(db.storage.path, testOptions())
+	require.ErrorIs(t, err, table.ErrComparatorMismatch)
+	db, err = Open(db.storage.path, opts)
+	require.NoError(t, err)
+	require.NoError(t, db.Close())
+}
+
+func TestConcurrentWriters(t *testing.T) {
+	opts := testOptions()
+	// writers fill the arena before TargetSstSize, so they freeze it themselves
+	opts.MaxMemTableSize = 64 << 10
+	opts.MaxMemTableCount = 100
+	db := openTestDB(t, opts)
+
+	const writers, perWriter = 8, 500
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := []byte(fmt.Sprintf("key%d-%04d", w, i))
+				require.NoError(t, db.Put(key, bytes.Repeat(key, 10)))
+				value, err := db.Get(key)
+				require.NoError(t, err)
+				require.Equal(t, bytes.Repeat(key, 10), value)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// bigger than any arena, it gets a memtable of its own size
+	large := bytes.Repeat([]byte("v"), 256<<10)
+	require.NoError(t, db.Put([]byte("large"), large))
+	value, err := db.Get([]byte("large"))
+	require.NoError(t, err)
+	require.Equal(t, large, value)
+
+	iter := db.NewIterator(nil)
+	defer iter.Close()
+	count := 0
+	for ; iter.Valid(); iter.Next() {
+		count++
+	}
+	require.NoError(t, iter.Error())
+	require.Equal(t, writers*perWriter+1, count)
+	s := db.storage
+	s.store.mu.RLock()
+	defer s.store.mu.RUnlock()
+	require.Greater(t, len(s.store.immutable)+len(s.store.l0SSTables), 5)
+}
+
+func TestConcurrentTimestampWriters(t *testing.T) {
+	db := openTestDB(t, testOptions())
+	const writers, perWriter, keys = 8, 300, 4
+	var ts atomic.Uint64
+	var mu sync.Mutex
+	// the highest timestamp written to each key
+	latest := make(map[string]uint64)
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				key := fmt.Sprintf("ts%d", i%keys)
+				at := ts.Add(1)
+				err := db.PutAt([]byte(key), []byte(fmt.Sprint(at)), at)
+				if errors.Is(err, ErrTimestampOutOfOrder) {
+					continue
+				}
+				require.NoError(t, err)
+				mu.Lock()
+				latest[key] = max(latest[key], at)
+				mu.Unlock()
+				// keys without a timestamp are written alongside
+				require.NoError(t, db.Put([]byte(fmt.Sprintf("plain%d-%d", w, i)), []byte("v")))
+			}
+		}(w)
+	}
+	wg.Wait()
+	for key, at := range latest {
+		value, err := db.Get([]byte(key))
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprint(at), string(value))
+	}
+}
@@ -2,17 +2,16 @@ module anchordb
 
 go 1.21.6
 
-require github.com/stretchr/testify v1.9.0
-
 require (
-	github.com/cespare/xxhash/v2 v2.3.0 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/stretchr/testify v1.9.0
 )
 
+require github.com/spf13/pflag v1.0.5 // indirect
+
 require (
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/golang/protobuf v1.5.0 // indirect
-	github.com/huandu/skiplist v1.2.0 // indirect
 	github.com/inconshreveable/mousetrap v1.1.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/spf13/cobra v1.8.1
@@ -0,0 +1,428 @@
+package anchordb
+
+import (
+	"anchordb/table"
+	"bytes"
+	"math"
+)
+
+type IteratorOptions struct{
+	// first key to return, inclusive. nil starts at the first key.
+	LowerBound []byte
+	// key to stop at, exclusive. nil runs to the last key.
+	UpperBound []byte
+	// only keys starting with Prefix are returned. When it is a whole prefix
+	// of StorageOptions.PrefixExtractor, SSTs whose bloom filter rules it
+	// out are not read.
+	Prefix []byte
+	// blocks read by the iterator are not added to the block cache, so a
+	// large scan doesn't evict the blocks of hot keys. Cached blocks are
+	// still used.
+	NoFillCache bool
+}
+
+// Iterator walks the keys visible at a read timestamp in either direction,
+// folding merge operands and hiding deleted keys and stale versions.
+type Iterator struct{
+	readTs uint64
+	mergeOperator MergeOperator
+	lowerBound []byte
+	upperBound []byte
+	cmp Comparator
+	// keys without it are skipped, set when the bounds can't be narrowed to
+	// the keys of the prefix
+	prefix []byte
+	// yields every version of a key, newest first going forward
+	iter table.BidirectionalIterator
+	// referenced until Close, so compaction doesn't delete them
+	tables []*table.SSTable
+	reverse bool
+	// reads the values in blob files, kept while the SSTs referring to them are
+	blobs table.BlobSource
+	key []byte
+	value []byte
+	err error
+}
+
+// iteratorSources is the set of memtables and SSTs an iterator reads,
+// captured when it is created so seeks see the same data.
+type iteratorSources struct{
+	memtables []*table.MemtableIterator
+	l0SSTables []*table.SSTable
+	levels [][]*table.SSTable
+	tombstones []table.RangeTombstone
+	cmp Comparator
+}
+
+// withoutCacheFill makes the SSTs read without adding blocks to the cache.
+func (s *iteratorSources) withoutCacheFill(){
+	for i, sst := range s.l0SSTables{
+		s.l0SSTables[i] = sst.WithoutCacheFill()
+	}
+	for _, level := range s.levels{
+		for i, sst := range level{
+			level[i] = sst.WithoutCacheFill()
+		}
+	}
+}
+
+// tables returns the SSTs read, each referenced once.
+func (s *iteratorSources) tables() []*table.SSTable{
+	tables := append([]*table.SSTable{},s.l0SSTables...)
+	for _, level := range s.levels{
+		tables = append(tables, level...)
+	}
+	return tables
+}
+
+// build merges every source into one iterator, which still has to be
+// positioned with a seek.
+func (s *iteratorSources) build() table.BidirectionalIterator{
+	l0Iters := make([]*table.SSTIterator,0,len(s.l0SSTables))
+	for _, sst := range s.l0SSTables{
+		l0Iters = append(l0Iters, table.CreateSSTIterAndSeekToFirst(sst))
+	}
+	levelIters := make([]*table.LevelIterator,0,len(s.levels))
+	for _, level := range s.levels{
+		levelIters = append(levelIters, table.CreateLevelIterAndSeekToFirst(level))
+	}
+
+	memAndL0,_ := table.NewTwoMergeIterator(
+		table.NewMergeIterator(s.memtables,s.cmp),
+		table.NewMergeIterator(l0Iters,s.cmp),
+		s.cmp,
+	)
+	merged,_ := table.NewTwoMergeIterator(memAndL0,table.NewMergeIterator(levelIters,s.cmp),s.cmp)
+	return table.NewRangeDelIterator(merged,s.tombstones,s.cmp)
+}
+
+// resolve collapses the versions collected for key and, if the key is
+// visible, makes it the current entry.
+func (it *Iterator) resolve(key []byte, ctx *table.MergeContext) bool{
+	if it.prefix!=nil && !bytes.HasPrefix(key,it.prefix){
+		return false
+	}
+	ctx.SetBlobSource(it.blobs)
+	iv,err := ctx.Resolve(it.mergeOperator,true)
+	if err!=nil{
+		it.err = err
+		return false
+	}
+	if iv==nil{
+		return false
+	}
+	value := iv.Value()
+	if iv.Kind() == table.KindBlob{
+		if value, err = table.ReadBlobValue(it.blobs,iv); err!=nil{
+			it.err = err
+			return false
+		}
+	}
+	it.key = key
+	// copied out of cached blocks, the memtable arena and mapped SSTs, which
+	// may be unmapped after Close
+	it.value = bytes.Clone(value)
+	return true
+}
+
+// advance moves to the next key with a visible value. iter yields every
+// version of a key newest first.
+func (it *Iterator) advance(){
+	it.key, it.value = nil, nil
+	for it.err==nil && it.iter.IsValid(){
+		if it.upperBound!=nil && it.cmp.Compare(it.iter.Key(),it.upperBound) >= 0{
+			return
+		}
+		key := append([]byte{},it.iter.Key()...)
+		ctx := table.NewMergeContextAt(key,it.readTs)
+		settled := false
+		for it.iter.IsValid() && bytes.Equal(it.iter.Key(),key){
+			if !settled{
+				iv,err := table.DecodeInternalValue(it.iter.Value())
+				if err!=nil{
+					it.err = err
+					return
+				}
+				settled = ctx.Add(iv)
+			}
+			if err := it.iter.Next(); err!=nil{
+				it.err = err
+				return
+			}
+		}
+		// the versions of key may be cut short
+		if it.err = it.iter.Error(); it.err!=nil{
+			return
+		}
+		if it.resolve(key,ctx){
+			return
+		}
+	}
+	if it.err==nil{
+		it.err = it.iter.Error()
+	}
+}
+
+// advanceBack moves to the previous key with a visible value. Going
+// backwards iter yields the versions of a key oldest first.
+func (it *Iterator) advanceBack(){
+	it.key, it.value = nil, nil
+	for it.err==nil && it.iter.IsValid(){
+		if it.lowerBound!=nil && it.cmp.Compare(it.iter.Key(),it.lowerBound) < 0{
+			return
+		}
+		key := append([]byte{},it.iter.Key()...)
+		outOfBounds := it.upperBound!=nil && it.cmp.Compare(key,it.upperBound) >= 0
+		var versions []*table.InternalValue
+		for it.iter.IsValid() && bytes.Equal(it.iter.Key(),key){
+			if !outOfBounds{
+				iv,err := table.DecodeInternalValue(it.iter.Value())
+				if err!=nil{
+					it.err = err
+					return
+				}
+				versions = append(versions, iv)
+			}
+			if err := it.iter.Prev(); err!=nil{
+				it.err = err
+				return
+			}
+		}
+		if it.err = it.iter.Error(); it.err!=nil{
+			return
+		}
+		if outOfBounds{
+			continue
+		}
+		ctx := table.NewMergeContextAt(key,it.readTs)
+		for i := len(versions)-1; i >= 0; i--{
+			if ctx.Add(versions[i]){
+				break
+			}
+		}
+		if it.resolve(key,ctx){
+			return
+		}
+	}
+	if it.err==nil{
+		it.err = it.iter.Error()
+	}
+}
+
+// Seek moves to the first key at or after key, within the bounds.
+func (it *Iterator) Seek(key []byte){
+	if it.iter==nil{
+		return
+	}
+	if it.lowerBound!=nil && it.cmp.Compare(key,it.lowerBound) < 0{
+		key = it.lowerBound
+	}
+	it.err = nil
+	it.reverse = false
+	it.iter.SeekToKey(key)
+	it.advance()
+}
+
+func (it *Iterator) SeekToFirst(){
+	if it.iter==nil{
+		return
+	}
+	it.err = nil
+	it.reverse = false
+	if it.lowerBound!=nil{
+		it.iter.SeekToKey(it.lowerBound)
+	} else {
+		it.iter.SeekToFirst()
+	}
+	it.advance()
+}
+
+// SeekForPrev moves to the last key at or before key, within the bounds.
+func (it *Iterator) SeekForPrev(key []byte){
+	if it.iter==nil{
+		return
+	}
+	if it.upperBound!=nil && it.cmp.Compare(key,it.upperBound) >= 0{
+		key = it.upperBound
+	}
+	it.err = nil
+	it.reverse = true
+	it.iter.SeekForPrev(key)
+	it.advanceBack()
+}
+
+func (it *Iterator) SeekToLast(){
+	if it.iter==nil{
+		return
+	}
+	it.err = nil
+	it.reverse = true
+	if it.upperBound!=nil{
+		it.iter.SeekForPrev(it.upperBound)
+	} else {
+		it.iter.SeekToLast()
+	}
+	it.advanceBack()
+}
+
+func (it *Iterator) Valid() bool{
+	return it.err==nil && it.key!=nil
+}
+
+func (it *Iterator) Key() []byte{
+	return it.key
+}
+
+func (it *Iterator) Value() []byte{
+	return it.value
+}
+
+func (it *Iterator) Error() error{
+	return it.err
+}
+
+func (it *Iterator) Next() error{
+	if !it.Valid(){
+		return it.err
+	}
+	if it.reverse{
+		// iter is before the current key, move it past its versions
+		it.reverse = false
+		it.iter.SeekToKey(it.key)
+		for it.iter.IsValid() && bytes.Equal(it.iter.Key(),it.key){
+			if err := it.iter.Next(); err!=nil{
+				it.err = err
+				return err
+			}
+		}
+	}
+	it.advance()
+	return it.err
+}
+
+func (it *Iterator) Prev() error{
+	if !it.Valid(){
+		return it.err
+	}
+	if !it.reverse{
+		// iter is after the current key, move it before its versions
+		it.reverse = true
+		it.iter.SeekForPrev(it.key)
+		for it.iter.IsValid() && bytes.Equal(it.iter.Key(),it.key){
+			if err := it.iter.Prev(); err!=nil{
+				it.err = err
+				return err
+			}
+		}
+	}
+	it.advanceBack()
+	return it.err
+}
+
+// Close releases the sources, the iterator is invalid afterwards. SSTs
+// compacted away while an iterator is open are only deleted once it is
+// closed.
+func (it *Iterator) Close(){
+	for _, sst := range it.tables{
+		sst.Unref()
+	}
+	it.tables = nil
+	it.iter = nil
+	it.key, it.value = nil, nil
+}
+
+func (l *LSMStore) NewIterator(opts *IteratorOptions) *Iterator{
+	return l.IteratorAt(math.MaxUint64,opts)
+}
+
+// IteratorAt returns an iterator over every source of the store as of
+// timestamp ts, positioned at the first key. Memtables are snapshotted, so
+// later writes are not seen.
+func (l *LSMStore) IteratorAt(ts uint64, opts *IteratorOptions) *Iterator{
+	if opts==nil{
+		opts = &IteratorOptions{}
+	}
+	cmp := l.options.comparator()
+	lower, upper := opts.LowerBound, opts.UpperBound
+	var prefix []byte
+	if opts.Prefix!=nil && !table.IsBytewise(cmp){
+		prefix = opts.Prefix
+	} else if opts.Prefix!=nil{
+		if lower==nil || bytes.Compare(lower,opts.Prefix) < 0{
+			lower = opts.Prefix
+		}
+		if succ := table.PrefixSuccessor(opts.Prefix); succ!=nil && (upper==nil || bytes.Compare(succ,upper) < 0){
+			upper = succ
+		}
+	}
+
+	sources := l.collectSources(opts.Prefix,lower,upper)
+	if opts.NoFillCache{
+		sources.withoutCacheFill()
+	}
+	it := &Iterator{
+		iter: sources.build(),
+		tables: sources.tables(),
+		readTs: ts,
+		cmp: cmp,
+		prefix: prefix,
+		mergeOperator: l.options.MergeOperator,
+		blobs: l,
+		lowerBound: lower,
+		upperBound: upper,
+	}
+	it.SeekToFirst()
+	return it
+}
+
+// collectSources snapshots the memtables and picks the SSTs to read. SSTs
+// whose range filter rules out [lower, upper) are left out, and with a whole
+// prefix so are those whose filter rules it out.
+func (l *LSMStore) collectSources(prefix []byte, lower []byte, upper []byte) (sources *iteratorSources){
+	wholePrefix := table.IsWholePrefix(l.options.PrefixExtractor,prefix)
+	mayContain := func(sst *table.SSTable) bool{
+		if (lower!=nil || upper!=nil) && !sst.MayContainRange(lower,upper){
+			return false
+		}
+		return !wholePrefix || sst.MayContainPrefix(l.options.PrefixExtractor,prefix)
+	}
+
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	// referenced under the lock, so compaction can't delete them before
+	defer func(){
+		for _, sst := range sources.tables(){
+			sst.Ref()
+		}
+	}()
+	sources = &iteratorSources{cmp: l.options.comparator()}
+	// writes are only seen up to the last seq published, a write with a seq
+	// handed out before may still be on its way into the memtable
+	seq := l.publishedSeq.Load()
+	for _, mem := range append([]*table.Memtable{l.memtable},l.immutable...){
+		sources.memtables = append(sources.memtables, mem.Iter(seq))
+		sources.tombstones = append(sources.tombstones, mem.RangeTombstones()...)
+	}
+	// tombstones are kept even from skipped tables, they may cover other ones
+	for _, tableID := range l.l0SSTables{
+		if sst, ok := l.sstables[tableID]; ok{
+			sources.tombstones = append(sources.tombstones, sst.RangeTombstones()...)
+			if mayContain(sst){
+				sources.l0SSTables = append(sources.l0SSTables, sst)
+			}
+		}
+	}
+	for _, level := range l.levels{
+		levelSSTs := make([]*table.SSTable,0,len(level))
+		for _, tableID := range level{
+			if sst, ok := l.sstables[tableID]; ok{
+				sources.tombstones = append(sources.tombstones, sst.RangeTombstones()...)
+				if mayContain(sst){
+					levelSSTs = append(levelSSTs, sst)
+				}
+			}
+		}
+		sources.levels = append(sources.levels, levelSSTs)
+	}
+	return sources
+}
@@ -6,12 +6,19 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"hash/crc32"
+	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/cespare/xxhash/v2"
 )
 
 
@@ -26,9 +33,45 @@ type LSMStore struct{
 	ctx context.Context
 	cancel context.CancelFunc
 	seqCounter uint64
+	// every write up to this seq is in the memtable, iterators read as of it
+	publishedSeq atomic.Uint64
 	options *StorageOptions
+	// holds the blocks and the index and filter partitions read from the SSTs
+	blockCache *table.BlockCache
+	// closes the least recently used SSTs past MaxOpenFiles
+	tableCache *table.TableCache
+	// blob files by id, each kept while an SST refers to it
+	blobFiles map[int]*table.BlobFile
+	blobMu sync.Mutex
+	// writers of a key hold its lock from checking the key's timestamps to
+	// putting the new version, keys being spread over the locks by hash
+	keyLocks [keyLockCount]sync.Mutex
 }
 
+const keyLockCount = 256
+
+const defaultBlockCacheSize = 8 << 20
+
+const defaultBlobGarbageRatio = 0.5
+
+const minMemtableArenaSize = 64 << 10
+
+const (
+	defaultMaxKeySize = 16 << 10
+	// index partitions store key lengths in 16 bits
+	maxKeySizeLimit = 1<<16 - 1
+	defaultMaxValueSize = 64 << 20
+)
+
+var (
+	ErrKeyTooLarge = errors.New("key too large")
+	ErrValueTooLarge = errors.New("value too large")
+	// a write's timestamp is before the latest version of its key. Reads
+	// take the newest write at or before their timestamp, so a key's
+	// timestamps may only grow. Put, Merge and Delete write at timestamp 0.
+	ErrTimestampOutOfOrder = errors.New("timestamp before the latest version of the key")
+)
+
 type Storage struct {
 	store *LSMStore
 	options *StorageOptions
@@ -38,18 +81,134 @@ type Storage struct {
 	path string
 	flushNotifier chan struct{}
 	flushStop chan struct{}
+	// versions older than this timestamp may be discarded by compaction
+	fullHistoryTsLow uint64
 }
 
 type StorageOptions struct{
 	EnableWal bool
 	EnableBloomFilter bool
+	// bloom filter bits per key for each level, L0 first. Deeper levels use
+	// the last entry and without any a 1% false positive rate is targeted.
+	// Lower levels hold most of the data, so they can take fewer bits.
+	BloomBitsPerKey []int
+	// filter new SSTs are built with, nil for the classic bloom filter.
+	// Existing SSTs keep the filter they were written with.
+	FilterPolicy FilterPolicy
+	// bytes of the arena each memtable allocates its entries from, 0 for a
+	// quarter more than TargetSstSize. Memtables are frozen once they reach
+	// TargetSstSize, the rest taking the writes racing with the freeze.
 	MaxMemTableSize int64
 	MaxMemTableCount int
 	BlockSize uint
+	// keys between the restart points of a block, the ones in between only
+	// storing what they don't share with the key before. 0 uses 16.
+	BlockRestartInterval int
+	// give every block of new SSTs a hash index of its keys, so point reads
+	// find a key in its block without a binary search, for about a byte per
+	// key
+	BlockHashIndex bool
 	TargetSstSize uint
 	CompactionType CompactionType
+	MergeOperator MergeOperator
+	// when set, SST bloom filters also hold key prefixes so prefix
+	// iterators can skip tables
+	PrefixExtractor PrefixExtractor
+	// blocks covered by each index and filter partition of new SSTs, 0 for a
+	// single index and filter kept in memory. Partitions are read through
+	// the block cache, so large SSTs don't pin all their metadata.
+	IndexPartitionSize int
+	// bytes of each key kept in the range filters of new SSTs, 0 for none.
+	// Iterators with bounds skip SSTs whose range filter rules them out,
+	// longer prefixes rule out more ranges but take more space.
+	RangeFilterPrefixLen int
+	// bytes of SST blocks kept decoded in memory, shared by every SST. 0
+	// uses 8MB.
+	BlockCacheSize int64
+	// SSTs kept open at once, each holding a file descriptor and its index
+	// and filters. The least recently used are closed past it and reopened
+	// when read again. 0 keeps every SST open.
+	MaxOpenFiles int
+	// read SSTs through memory mappings of their files, decoding blocks
+	// without copying them. Best when the data fits in the page cache. A
+	// mapping stays until its SST is compacted away and no iterator reads it.
+	UseMmap bool
+	// codec the blocks of new SSTs are compressed with for each level, L0
+	// first. Deeper levels use the last entry and without any blocks aren't
+	// compressed. L0 is rewritten soon, so it is best left uncompressed or
+	// fast, while the bottom level holds most of the data and suits a heavy
+	// codec. A block is kept uncompressed unless it shrinks by 1/8.
+	Compression []CompressionType
+	// bytes of the dictionary trained from the values of each new compressed
+	// SST, which its blocks are all compressed with. Small values like JSON
+	// documents compress poorly a block at a time but share a lot across
+	// blocks. 0 trains none.
+	CompressionDictSize int
+	// compaction keeps every version written at or after this timestamp so
+	// they can be read with GetAt. Only the latest older version is kept.
+	FullHistoryTsLow uint64
+	// values over this many bytes are moved to blob files when flushed, the
+	// SSTs only keeping a reference, so compaction doesn't rewrite them. 0
+	// keeps every value in the SSTs.
+	MinBlobSize int
+	// share of a blob file's bytes no longer referenced past which
+	// compaction moves its live values to a new blob file, so it can be
+	// deleted. 0 uses 0.5.
+	BlobGarbageRatio float64
+	// largest key in bytes writes accept, 0 for 16KB. It can't be over 65535.
+	MaxKeySize int
+	// largest value or merge operand in bytes writes accept, 0 for 64MB.
+	// Bigger values make bigger blocks, each read whole.
+	MaxValueSize int
+	// order of the keys, nil for table.BytewiseComparator. Its name is
+	// recorded in every SST, which fail to open with another comparator.
+	// Prefix iterators only skip to the keys of their prefix with the
+	// bytewise order, others go through every key.
+	Comparator Comparator
+}
+
+func (o *StorageOptions) comparator() Comparator{
+	if o.Comparator==nil{
+		return table.BytewiseComparator
+	}
+	return o.Comparator
+}
+
+func (o *StorageOptions) memtableArenaSize() int64{
+	if o.MaxMemTableSize > 0{
+		return o.MaxMemTableSize
+	}
+	return max(int64(o.TargetSstSize)+int64(o.TargetSstSize)/4,minMemtableArenaSize)
+}
+
+func (o *StorageOptions) maxKeySize() int{
+	if o.MaxKeySize <= 0{
+		return defaultMaxKeySize
+	}
+	return min(o.MaxKeySize,maxKeySizeLimit)
+}
+
+func (o *StorageOptions) blobGarbageRatio() float64{
+	if o.BlobGarbageRatio <= 0{
+		return defaultBlobGarbageRatio
+	}
+	return o.BlobGarbageRatio
 }
 
+func (o *StorageOptions) maxValueSize() int{
+	if o.MaxValueSize <= 0{
+		return defaultMaxValueSize
+	}
+	return o.MaxValueSize
+}
+
+type MergeOperator = table.MergeOperator
+type PrefixExtractor = table.PrefixExtractor
+type FilterPolicy = table.FilterPolicy
+type BlockCacheStats = table.BlockCacheStats
+type CompressionType = table.CompressionType
+type Comparator = table.Comparator
+
 func setupStorage(path string,options *StorageOptions) (*Storage,error){
 	dbPath := filepath.Join(path)
 	if err := os.MkdirAll(dbPath,os.ModePerm); err!=nil{
@@ -60,7 +219,8 @@ func setupStorage(path string,options *StorageOptions) (*Storage,error){
 		return nil,err
 	}
 
-	nextId := 1
+	// ids go on past the files already in the directory
+	nextId := store.memtable.GetID()+1
 	storage:= &Storage{
 		store:store,
 		options:options,
@@ -68,11 +228,36 @@ func setupStorage(path string,options *StorageOptions) (*Storage,error){
 		path: path,
 		flushNotifier: make(chan struct{}, 1), // Buffered to avoid blocking
 		flushStop:    make(chan struct{}),
+		fullHistoryTsLow: options.FullHistoryTsLow,
 	}
 	storage.spawnFlushTrigger()
 	return storage,nil
 }
 
+// write runs put, which writes key and value to the active memtable. When
+// the memtable's arena is full it is frozen and put runs again on the next.
+func (s *Storage) write(key string, value []byte, put func() error) error{
+	for{
+		mem := s.store.activeMemtable()
+		err := put()
+		if !errors.Is(err,table.ErrArenaFull){
+			return err
+		}
+		s.freeze(mem,table.MemtableEntrySize(len(key),len(value)))
+	}
+}
+
+// checkSize returns an error if key or value is over the configured limits.
+func (s *Storage) checkSize(key string, value []byte) error{
+	if limit := s.options.maxKeySize(); len(key) > limit{
+		return fmt.Errorf("%w: %d bytes, the limit is %d",ErrKeyTooLarge,len(key),limit)
+	}
+	if limit := s.options.maxValueSize(); len(value) > limit{
+		return fmt.Errorf("%w: %d bytes, the limit is %d",ErrValueTooLarge,len(value),limit)
+	}
+	return nil
+}
+
 func (s *Storage) Put(key string, value []byte) error{
 	if key == "" {
 		return errors.New("key cannot be empty")
@@ -80,8 +265,13 @@ func (s *Storage) Put(key string, value []byte) error{
 	if len(value) == 0 {
 		return errors.New("value cannot be empty")
 	}
+	if err := s.checkSize(key, value); err != nil {
+		return err
+	}
 	
-	err := s.store.Put(key, value)
+	err := s.write(key, value, func() error {
+		return s.store.Put(key, value)
+	})
 	if err != nil {
 		return err
 	}
@@ -90,8 +280,127 @@ func (s *Storage) Put(key string, value []byte) error{
 	return nil
 }
 
+func (s *Storage) Merge(key string, operand []byte) error{
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+	if s.options.MergeOperator == nil {
+		return table.ErrNoMergeOperator
+	}
+	if err := s.checkSize(key, operand); err != nil {
+		return err
+	}
+
+	err := s.write(key, operand, func() error {
+		return s.store.Merge(key, operand)
+	})
+	if err != nil {
+		return err
+	}
+	s.attemptFreeze()
+
+	return nil
+}
+
+func (s *Storage) CompareAndSwap(key string, expected []byte, value []byte) (bool,error){
+	if key == "" {
+		return false,errors.New("key cannot be empty")
+	}
+	if value != nil && len(value) == 0 {
+		return false,errors.New("value cannot be empty")
+	}
+	if err := s.checkSize(key, value); err != nil {
+		return false,err
+	}
+
+	var swapped bool
+	err := s.write(key, value, func() (err error) {
+		swapped, err = s.store.CompareAndSwap(key, expected, value)
+		return err
+	})
+	if err != nil || !swapped {
+		return false,err
+	}
+	s.attemptFreeze()
+
+	return true,nil
+}
+
 func (s *Storage) Delete(key string) error{
-	return s.store.Delete(key)
+	err := s.write(key, nil, func() error {
+		return s.store.Delete(key)
+	})
+	if err != nil {
+		return err
+	}
+	s.attemptFreeze()
+
+	return nil
+}
+
+func (s *Storage) PutAt(key string, value []byte, ts uint64) error{
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+	if value != nil && len(value) == 0 {
+		return errors.New("value cannot be empty")
+	}
+	if err := s.checkSize(key, value); err != nil {
+		return err
+	}
+
+	err := s.write(key, value, func() error {
+		return s.store.PutAt(key, value, ts)
+	})
+	if err != nil {
+		return err
+	}
+	s.attemptFreeze()
+
+	return nil
+}
+
+func (s *Storage) GetAt(key string, ts uint64) (*table.Entry,error){
+	return s.store.GetAt([]byte(key),ts)
+}
+
+func (s *Storage) IteratorAt(ts uint64) *Iterator{
+	return s.store.IteratorAt(ts,nil)
+}
+
+func (s *Storage) NewIterator(opts *IteratorOptions) *Iterator{
+	return s.store.NewIterator(opts)
+}
+
+// SetFullHistoryTsLow moves the history retention timestamp forward, it never
+// moves back since older versions may already be gone.
+func (s *Storage) SetFullHistoryTsLow(ts uint64){
+	for{
+		current := atomic.LoadUint64(&s.fullHistoryTsLow)
+		if ts <= current || atomic.CompareAndSwapUint64(&s.fullHistoryTsLow,current,ts){
+			return
+		}
+	}
+}
+
+func (s *Storage) DeleteRange(start string, end string) error{
+	if s.options.comparator().Compare([]byte(start),[]byte(end)) >= 0 {
+		return errors.New("range start must be before range end")
+	}
+	if err := s.checkSize(start, nil); err != nil {
+		return err
+	}
+	if err := s.checkSize(end, nil); err != nil {
+		return err
+	}
+
+	err := s.store.DeleteRange(start, end)
+	if err != nil {
+		return err
+	}
+	s.attemptFreeze()
+
+	return nil
 }
 
 func (s *Storage) Get(key string) (*table.Entry,error){
@@ -104,155 +413,504 @@ func (s *Storage) Get(key string) (*table.Entry,error){
 
 
 func createNewLSMStore(path string, options *StorageOptions) (*LSMStore,error){
+	if err := checkManifest(path,options.comparator()); err!=nil{
+		return nil,err
+	}
+	sstIds,maxId,err := dataFileIds(path)
+	if err!=nil{
+		return nil,err
+	}
 	var memtable *table.Memtable
 	if(options.EnableWal){
-		memtable = table.CreateNewMemTableWithWal(0,path)
+		memtable = table.CreateNewMemTableWithWal(maxId+1,path,options.memtableArenaSize(),options.comparator())
 	} else {
-		memtable = table.CreateNewMemTable(0)
+		memtable = table.CreateNewMemTable(maxId+1,options.memtableArenaSize(),options.comparator())
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	sstables := make(map[int]*table.SSTable)
+	cacheSize := options.BlockCacheSize
+	if cacheSize == 0{
+		cacheSize = defaultBlockCacheSize
+	}
+	blockCache := table.NewBlockCache(cacheSize)
+	tableCache := table.NewTableCache(options.MaxOpenFiles)
 	
-	for i:=0;i<=2;i++{
-		fw,err := table.OpenFileWrapper(fmt.Sprintf("%d.sst",i))
+	for _,i := range sstIds{
+		fw,err := table.OpenFileWrapper(filepath.Join(path,fmt.Sprintf("%d.sst",i)))
 		if err!=nil{
 			//fmt.Printf("error opening sstable")
 			continue
 		}
-		sst := table.OpenSSTable(i,fw)
+		if options.UseMmap{
+			if err := fw.Map(); err!=nil{
+				log.Printf("failed to map sstable %d: %v",i,err)
+			}
+		}
+		sst,err := table.OpenSSTable(i,fw,options.comparator())
+		if errors.Is(err,table.ErrComparatorMismatch){
+			fw.Close()
+			for _,sst := range sstables{
+				sst.Close()
+			}
+			cancel()
+			return nil,err
+		}
+		if err!=nil{
+			log.Printf("failed to open sstable %d: %v",i,err)
+			fw.Close()
+			continue
+		}
+		sst.SetBlockCache(blockCache)
+		sst.SetTableCache(tableCache)
 		sstables[i] = sst
 	}
-	return &LSMStore{
+	l := &LSMStore{
 		sstables: sstables,
 		memtable:memtable,
 		immutable: make([]*table.Memtable,0),
+		path: path,
 		ctx: ctx,
 		cancel: cancel,
 		options: options,
-	},nil
+		blockCache: blockCache,
+		tableCache: tableCache,
+		blobFiles: make(map[int]*table.BlobFile),
+	}
+	// the manifest doesn't record levels, so every SST comes back in L0,
+	// newest first
+	for id,sst := range sstables{
+		l.openBlobFiles(sst)
+		l.linkBlobFiles(sst)
+		l.seqCounter = max(l.seqCounter,sst.Properties().MaxSeq)
+		l.l0SSTables = append(l.l0SSTables, id)
+	}
+	l.publishedSeq.Store(l.seqCounter)
+	sort.Slice(l.l0SSTables,func(i, j int) bool {
+		return sstables[l.l0SSTables[i]].Properties().MaxSeq > sstables[l.l0SSTables[j]].Properties().MaxSeq
+	})
+	// written once the SSTs agree on the comparator
+	if err := writeManifest(path,options.comparator()); err!=nil{
+		l.close()
+		return nil,err
+	}
+	return l,nil
 }
 
+// dataFileIds returns the ids of the SSTs in dir, and the largest id of its
+// SSTs and blob files, -1 if there are none.
+func dataFileIds(dir string) ([]int,int,error){
+	entries,err := os.ReadDir(dir)
+	if err!=nil{
+		return nil,-1,err
+	}
+	var sstIds []int
+	maxId := -1
+	for _,e := range entries{
+		name := e.Name()
+		ext := filepath.Ext(name)
+		if e.IsDir() || (ext!=".sst" && ext!=".blob"){
+			continue
+		}
+		id,err := strconv.Atoi(strings.TrimSuffix(name,ext))
+		if err!=nil || id < 0{
+			continue
+		}
+		if ext==".sst"{
+			sstIds = append(sstIds, id)
+		}
+		maxId = max(maxId,id)
+	}
+	return sstIds,maxId,nil
+}
 
+// openBlobFiles opens the blob files sst refers to that aren't open yet,
+// they are only known from the SSTs when the store is opened.
+func (l *LSMStore) openBlobFiles(sst *table.SSTable){
+	l.blobMu.Lock()
+	defer l.blobMu.Unlock()
+	for id := range sst.Properties().BlobBytes{
+		if _,ok := l.blobFiles[id]; ok{
+			continue
+		}
+		f,err := table.OpenBlobFile(id,filepath.Join(l.path,fmt.Sprintf("%d.blob",id)))
+		if err!=nil{
+			log.Printf("failed to open blob file %d: %v",id,err)
+			continue
+		}
+		f.SetBlockCache(l.blockCache)
+		l.blobFiles[id] = f
+	}
+}
+
+// nextSeq hands out the seq of a write, which has to be passed to publishSeq
+// once the write is done or has failed.
 func (l *LSMStore) nextSeq() uint64 {
 	return atomic.AddUint64(&l.seqCounter, 1)
 }
 
+// publishSeq makes the write at seq visible to new iterators, once the writes
+// with every seq before it are. Writers finish out of order, so a later seq
+// waits for the earlier ones.
+func (l *LSMStore) publishSeq(seq uint64){
+	for !l.publishedSeq.CompareAndSwap(seq-1,seq){
+		runtime.Gosched()
+	}
+}
+
 func (l *LSMStore) Put(key string, value []byte) error{
-	l.mu.Lock()
-	defer l.mu.Unlock()
+	return l.PutAt(key,value,0)
+} 
+
+// PutAt writes value for key tagged with timestamp ts. A nil value writes a
+// tombstone.
+func (l *LSMStore) PutAt(key string, value []byte, ts uint64) error{
+	return l.write([]byte(key),ts,func(seq uint64) *table.Entry{
+		return table.BuildEntryWithTimestamp([]byte(key),value,seq,ts)
+	})
+}
+
+func (l *LSMStore) Merge(key string, operand []byte) error{
+	return l.write([]byte(key),0,func(seq uint64) *table.Entry{
+		return table.BuildMergeEntryWithSeqNo([]byte(key),operand,seq)
+	})
+}
+
+// keyLock returns the lock writers of key hold.
+func (l *LSMStore) keyLock(key []byte) *sync.Mutex{
+	return &l.keyLocks[xxhash.Sum64(key)%keyLockCount]
+}
+
+// write puts the entry build returns for the next seq in the memtable.
+// Writers share l.mu, the memtable taking concurrent puts, which keeps it
+// from being frozen under them. Only writers of keys under the same key
+// lock wait for each other.
+func (l *LSMStore) write(key []byte, ts uint64, build func(seq uint64) *table.Entry) error{
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	lock := l.keyLock(key)
+	lock.Lock()
+	defer lock.Unlock()
+	if err := l.checkTimestamp(key,ts); err!=nil{
+		return err
+	}
 	seq := l.nextSeq()
-	entry := table.BuildEntryWithSeqNo([]byte(key),value,seq)
-	l.memtable.Put(entry)
+	defer l.publishSeq(seq)
+	return l.memtable.Put(build(seq))
+}
+
+// checkTimestamp returns ErrTimestampOutOfOrder if ts is before the latest
+// version of key. Timestamps of a key only grow, so the latest is the one of
+// its newest version, and only sources with a later timestamp are searched.
+// l.mu and the key's lock must be held.
+func (l *LSMStore) checkTimestamp(key []byte, ts uint64) error{
+	if ts==math.MaxUint64{
+		return nil
+	}
+	var latest uint64
+	err := l.lookup(key,ts+1,func(iv *table.InternalValue) bool{
+		latest = iv.Timestamp()
+		return true
+	})
+	if err!=nil{
+		return err
+	}
+	if ts < latest{
+		return fmt.Errorf("%w: %d, key %s has a version at %d",ErrTimestampOutOfOrder,ts,key,latest)
+	}
 	return nil
-} 
+}
 
 func (l *LSMStore) Get(key []byte) (*table.Entry,error){
-	
-	var memtable *table.Memtable
-	var immutable []*table.Memtable
+	return l.GetAt(key,math.MaxUint64)
+}
 
+// GetAt returns the value of key as of timestamp ts, ignoring versions
+// written with a later timestamp.
+func (l *LSMStore) GetAt(key []byte, ts uint64) (*table.Entry,error){
 	l.mu.RLock()
 	defer l.mu.RUnlock()
-	memtable = l.memtable
-	immutable = l.immutable
-	
+	value,err := l.get(key,ts)
+	if err!=nil{
+		return nil,err
+	}
+	if value==nil{
+		return nil, fmt.Errorf("key %s does not exist", key)
+	}
+	// the value may be in a cached block, the memtable arena or a mapping,
+	// which the caller must not change or see unmapped
+	return table.BuildEntry(key,bytes.Clone(value)),nil
+}
+
+// get returns the value of key visible at ts, nil if there is none.
+// l.mu must be held.
+func (l *LSMStore) get(key []byte, ts uint64) ([]byte,error){
+	// merge operands are collected until a value or tombstone settles the key
+	ctx := table.NewMergeContextAt(key,ts)
+	ctx.SetBlobSource(l)
+	if err := l.lookup(key,0,ctx.Add); err!=nil{
+		return nil,err
+	}
+	iv,err := ctx.Resolve(l.options.MergeOperator,true)
+	if err!=nil || iv==nil{
+		return nil,err
+	}
+	if iv.Kind() == table.KindBlob{
+		return table.ReadBlobValue(l,iv)
+	}
+	return iv.Value(),nil
+}
 
-	if entry, ok := memtable.Get(key); ok {
-		if len(entry.Value()) == 0 {
-			return nil, nil // Tombstone found, key was deleted
+// lookup passes the versions of key to add newest first, until add reports
+// the key is settled. A range tombstone covering the rest is passed as a
+// tombstone at its seq. Memtables and SSTs without a version at minTs or
+// later are skipped, with their range tombstones. l.mu must be held.
+func (l *LSMStore) lookup(key []byte, minTs uint64, add func(*table.InternalValue) bool) error{
+	memtable := l.memtable
+	immutable := l.immutable
+	settled := false
+	// seq of the newest range tombstone covering key so far. Sources are
+	// visited newest first, so every older version is deleted by it.
+	var rangeDelSeq uint64
+	// visit feeds the versions of key in one source to add, next returns
+	// them newest first and nil once there are no more
+	visit := func(next func() (*table.InternalValue,error), tombstones []table.RangeTombstone) error{
+		if seq := table.MaxCoveringSeq(tombstones,key,l.options.comparator()); seq > rangeDelSeq{
+			rangeDelSeq = seq
+		}
+		for !settled{
+			iv,err := next()
+			if err!=nil{
+				return err
+			}
+			if iv==nil || iv.Seq() < rangeDelSeq{
+				break
+			}
+			settled = add(iv)
+		}
+		if !settled && rangeDelSeq > 0{
+			settled = add(table.BuildEntryWithSeqNo(key,nil,rangeDelSeq).InternalValue())
 		}
-		return entry,nil
+		return nil
 	}
-	for _, imm := range immutable{
-		if entry, ok := imm.Get(key); ok {
-			if len(entry.Value()) == 0 {
-				return nil, nil
+	iterVersions := func(iter table.StorageIterator) func() (*table.InternalValue,error){
+		return func() (*table.InternalValue,error){
+			if iter==nil{
+				return nil,nil
+			}
+			if !iter.IsValid() || !bytes.Equal(iter.Key(), key){
+				return nil,iter.Error()
+			}
+			iv,err := table.DecodeInternalValue(iter.Value())
+			if err!=nil{
+				return nil,err
 			}
-			return entry,nil
+			return iv,iter.Next()
+		}
+	}
+
+	for _, mem := range append([]*table.Memtable{memtable},immutable...){
+		if settled{
+			break
+		}
+		if mem.MaxTimestamp() < minTs{
+			continue
+		}
+		iter := mem.Iter(math.MaxUint64)
+		iter.SeekToKey(key)
+		if err := visit(iterVersions(iter),mem.RangeTombstones()); err!=nil{
+			return err
 		}
 	}
-	var iter *table.SSTIterator
-	l0Iters := make([]*table.SSTIterator, 0, len(l.l0SSTables))
 	//fmt.Println("we here")
 	for _, tableID := range l.l0SSTables {
-		sst, ok := l.sstables[tableID]
-		if !ok {
-			continue
+		if settled{
+			break
 		}
-	
-		if !isKeyWithinRange(key, sst.GetFirstKey(), sst.GetLastKey()) {
+		sst, ok := l.sstables[tableID]
+		if !ok || sst.Properties().MaxTimestamp < minTs{
 			continue
 		}
-	
+		var iter table.StorageIterator
+		mayContain := isKeyWithinRange(l.options.comparator(), key, sst.GetFirstKey(), sst.GetLastKey())
 		// If bloom filter is enabled, use it
-		if l.options.EnableBloomFilter {
-			if !sst.BloomFilter.MayContain(crc32.ChecksumIEEE(key)) {
-				continue
-			}
+		if mayContain && l.options.EnableBloomFilter {
+			mayContain = sst.MayContain(key)
 		}
-	
-		iter = table.CreateSSTIterAndSeekToKey(sst, key)
-		if iter.IsValid() && bytes.Equal(iter.Key(), key) {
-			l0Iters = append(l0Iters, iter)
+		if mayContain{
+			iter = table.CreateSSTIterAndSeekToKey(sst, key)
+		}
+		if err := visit(iterVersions(iter),sst.RangeTombstones()); err!=nil{
+			return err
 		}
 	}
 
-	levelIters := make([]*table.LevelIterator,0,len(l.levels))
 	for _, level := range l.levels{
+		if settled{
+			break
+		}
 		levelSSTs := make([]*table.SSTable,0,len(level))
+		var tombstones []table.RangeTombstone
 		for _,tableId := range level{
-			if sst,ok := l.sstables[tableId];ok{
+			if sst,ok := l.sstables[tableId];ok && sst.Properties().MaxTimestamp >= minTs{
 				levelSSTs = append(levelSSTs, sst)
+				tombstones = append(tombstones, sst.RangeTombstones()...)
 			}
 		}
-		levelIters = append(levelIters, table.CreateLevelIterAndSeekToKey(levelSSTs,key))
+		if err := visit(iterVersions(table.CreateLevelIterAndSeekToKey(levelSSTs,key)),tombstones); err!=nil{
+			return err
+		}
 	}
-	twoMergeIter,_ := table.NewTwoMergeIterator(
-		table.NewMergeIterator(l0Iters),
-		table.NewMergeIterator(levelIters),
-	)
-	if twoMergeIter.IsValid() && bytes.Equal(twoMergeIter.Key(),key) && len(twoMergeIter.Value())>0{
-		e:= table.BuildEntry(key,twoMergeIter.Value()) 
-		/*&table.Entry{}
-		e.SetKey(key)
-		e.SetValue(twoMergeIter.Value())*/
-		return e,nil
-	}
-	return nil, fmt.Errorf("key %s does not exist", key)
-} 
+	return nil
+}
 
-func isKeyWithinRange(key, firstKey, lastKey []byte) bool{
-	return bytes.Compare(key, firstKey) >= 0 && bytes.Compare(key, lastKey) <= 0
+// CompareAndSwap writes value, or a tombstone if value is nil, when the latest
+// visible value of key equals expected. A nil expected means the key must not
+// exist.
+func (l *LSMStore) CompareAndSwap(key string, expected []byte, value []byte) (bool,error){
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	lock := l.keyLock([]byte(key))
+	lock.Lock()
+	defer lock.Unlock()
+	current,err := l.get([]byte(key),math.MaxUint64)
+	if err!=nil{
+		return false,err
+	}
+	if !valueMatches(current,expected){
+		return false,nil
+	}
+	if err := l.checkTimestamp([]byte(key),0); err!=nil{
+		return false,err
+	}
+	seq := l.nextSeq()
+	defer l.publishSeq(seq)
+	entry := table.BuildEntryWithSeqNo([]byte(key),value,seq)
+	return true,l.memtable.Put(entry)
+}
+
+func valueMatches(current []byte, expected []byte) bool{
+	if expected==nil{
+		return current==nil
+	}
+	return current!=nil && bytes.Equal(current,expected)
+}
+
+func isKeyWithinRange(cmp Comparator, key, firstKey, lastKey []byte) bool{
+	return cmp.Compare(key, firstKey) >= 0 && cmp.Compare(key, lastKey) <= 0
 }
 
 func (l *LSMStore) Delete(key string) error{
+	return l.write([]byte(key),0,func(seq uint64) *table.Entry{
+		return table.BuildEntryWithSeqNo([]byte(key),nil,seq)
+	})
+} 
+
+func (l *LSMStore) DeleteRange(start string, end string) error{
 	l.mu.Lock()
 	defer l.mu.Unlock()
+	// a range tombstone has no timestamp, it would hide the versions of a key
+	// at every read timestamp
+	if err := l.checkRangeTimestamps([]byte(start),[]byte(end)); err!=nil{
+		return err
+	}
 	seq := l.nextSeq()
-	entry := table.BuildEntryWithSeqNo([]byte(key),nil,seq)
-	return l.memtable.Put(entry)
-} 
+	defer l.publishSeq(seq)
+	l.memtable.DeleteRange(table.NewRangeTombstone([]byte(start),[]byte(end),seq))
+	return nil
+}
 
-func (l *LSMStore) RangeScan(start string, end string) []*table.Entry{
-	return l.memtable.Scan([]byte(start),[]byte(end))
+// checkRangeTimestamps returns ErrTimestampOutOfOrder if a key in
+// [start, end) has a version with a timestamp. Only sources with a timestamp
+// are searched. l.mu must be held, keeping writers out.
+func (l *LSMStore) checkRangeTimestamps(start []byte, end []byte) error{
+	cmp := l.options.comparator()
+	check := func(iter table.StorageIterator) error{
+		for iter.IsValid() && cmp.Compare(iter.Key(),end) < 0{
+			iv,err := table.DecodeInternalValue(iter.Value())
+			if err!=nil{
+				return err
+			}
+			if iv.Timestamp() > 0{
+				return fmt.Errorf("%w: key %s in the deleted range has a version at %d",ErrTimestampOutOfOrder,iter.Key(),iv.Timestamp())
+			}
+			if err := iter.Next(); err!=nil{
+				return err
+			}
+		}
+		return iter.Error()
+	}
+	for _,mem := range append([]*table.Memtable{l.memtable},l.immutable...){
+		if mem.MaxTimestamp()==0{
+			continue
+		}
+		iter := mem.Iter(math.MaxUint64)
+		iter.SeekToKey(start)
+		if err := check(iter); err!=nil{
+			return err
+		}
+	}
+	for _,sst := range l.sstables{
+		if sst.Properties().MaxTimestamp==0 || cmp.Compare(sst.GetLastKey(),start) < 0 || cmp.Compare(sst.GetFirstKey(),end) >= 0{
+			continue
+		}
+		if err := check(table.CreateSSTIterAndSeekToKey(sst,start)); err!=nil{
+			return err
+		}
+	}
+	return nil
+}
+
+// RangeScan returns the live entries with keys in [start, end], across the
+// memtables and every SST.
+func (l *LSMStore) RangeScan(start string, end string) ([]*table.Entry,error){
+	cmp := l.options.comparator()
+	opts := &IteratorOptions{LowerBound: []byte(start)}
+	if table.IsBytewise(cmp){
+		// the first key after end, so SSTs past it are skipped
+		opts.UpperBound = append([]byte(end),0)
+	}
+	iter := l.NewIterator(opts)
+	defer iter.Close()
+	var entries []*table.Entry
+	for ; iter.Valid() && cmp.Compare(iter.Key(),[]byte(end)) <= 0; iter.Next(){
+		entries = append(entries, table.BuildEntry(iter.Key(),iter.Value()))
+	}
+	return entries,iter.Error()
 }
 
 func (s *Storage) attemptFreeze(){
-	currentSize := s.store.memtable.GetSize()
-	if currentSize >= int64(s.options.TargetSstSize){
-		s.storeLock.Lock()
-		defer s.storeLock.Unlock()
-		memtableID := s.nextId
-		s.nextId++  
-		s.store.freezeAndReplaceMemtable(memtableID)
+	mem := s.store.activeMemtable()
+	if mem.GetSize() >= int64(s.options.TargetSstSize){
+		s.freeze(mem,0)
 	}
 }
 
-func (l *LSMStore) freezeAndReplaceMemtable(id int){
+// freeze replaces mem with a new memtable with an arena of at least
+// arenaSize bytes, unless another writer replaced it first.
+func (s *Storage) freeze(mem *table.Memtable, arenaSize int64){
+	s.storeLock.Lock()
+	defer s.storeLock.Unlock()
+	if s.store.activeMemtable() != mem{
+		return
+	}
+	memtableID := s.nextId
+	s.nextId++
+	s.store.freezeAndReplaceMemtable(memtableID,arenaSize)
+}
+
+func (l *LSMStore) activeMemtable() *table.Memtable{
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.memtable
+}
+
+// freezeAndReplaceMemtable makes the active memtable immutable, replacing
+// it with one whose arena is at least arenaSize bytes.
+func (l *LSMStore) freezeAndReplaceMemtable(id int, arenaSize int64){
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	newMemtable := table.CreateNewMemTable(id)
+	newMemtable := table.CreateNewMemTable(id,max(arenaSize,l.options.memtableArenaSize()),l.options.comparator())
 	oldMemtable := l.memtable
 	l.immutable = append([]*table.Memtable{oldMemtable},l.immutable...)
 	l.memtable = newMemtable
@@ -272,13 +930,20 @@ func (s *Storage) flushLastImmutableMemTable() error{
 	}
 	flushMemtable = s.store.immutable[immCount-1]
 	s.store.mu.RUnlock()
-	sstBuilder := table.NewSSTBuilder(int(s.options.BlockSize))
-	flushMemtable.Flush(sstBuilder)
+	blobs := s.newBlobWriter()
+	sstBuilder := s.newSSTBuilder(0,blobs)
+	if err := flushMemtable.Flush(sstBuilder,s.options.MergeOperator); err!=nil{
+		return err
+	}
+	if err := s.finishBlobFile(blobs); err!=nil{
+		return err
+	}
 	sstPath := filepath.Join(s.path,fmt.Sprintf("%d.sst",flushMemtable.GetID()))
 	sst := sstBuilder.Build(
 		flushMemtable.GetID(),
 		sstPath,
 	)
+	s.store.linkBlobFiles(sst)
 	s.store.mu.Lock()
 	defer s.store.mu.Unlock()
 	fmt.Println("got sst")
@@ -303,13 +968,20 @@ func (s *Storage) flushAllImmutableMemTables() error {
 		flushMemtable := s.store.immutable[immCount-1]
 		s.store.mu.RUnlock()
 
-		sstBuilder := table.NewSSTBuilder(int(s.options.BlockSize))
-		flushMemtable.Flush(sstBuilder)
+		blobs := s.newBlobWriter()
+		sstBuilder := s.newSSTBuilder(0,blobs)
+		if err := flushMemtable.Flush(sstBuilder,s.options.MergeOperator); err!=nil{
+			return err
+		}
+		if err := s.finishBlobFile(blobs); err!=nil{
+			return err
+		}
 		sstPath := filepath.Join(s.path, fmt.Sprintf("%d.sst", flushMemtable.GetID()))
 		sst := sstBuilder.Build(
 			flushMemtable.GetID(),
 			sstPath,
 		)
+		s.store.linkBlobFiles(sst)
 
 		s.store.mu.Lock()
 		s.store.immutable = s.store.immutable[:immCount-1]
@@ -362,6 +1034,159 @@ func (s *Storage) stopFlushTrigger(){
 	close(s.flushStop)
 }
 
+// Close stops the flushes and writes the memtables out, there being no WAL
+// to recover them from, then closes the files of the store.
+func (s *Storage) Close() error{
+	s.stopFlushTrigger()
+	if mem := s.store.activeMemtable(); !mem.IsEmpty(){
+		s.freeze(mem,0)
+	}
+	if err := s.flushAllImmutableMemTables(); err!=nil{
+		return err
+	}
+	s.store.close()
+	return nil
+}
+
+// close closes the SSTs and blob files of the store.
+func (l *LSMStore) close(){
+	l.cancel()
+	l.mu.Lock()
+	for _,sst := range l.sstables{
+		sst.Close()
+	}
+	l.mu.Unlock()
+	l.blobMu.Lock()
+	for id,f := range l.blobFiles{
+		if err := f.Close(); err!=nil{
+			log.Printf("failed to close blob file %d: %v",id,err)
+		}
+	}
+	l.blobMu.Unlock()
+}
+
 func (s *Storage) getSSTPath(id int) string{
-	return fmt.Sprintf("%s/%d.sst",s.store.path,id)
-}
\ No newline at end of file
+	return filepath.Join(s.path,fmt.Sprintf("%d.sst",id))
+}
+
+// newSSTBuilder returns a builder for an SST of the given level, moving large
+// values to blobs unless it is nil.
+func (s *Storage) newSSTBuilder(level int, blobs *table.BlobWriter) *table.SSTBuilder{
+	builder := table.NewSSTBuilder(int(s.options.BlockSize))
+	if blobs!=nil{
+		builder.SetBlobWriter(blobs,s.options.MinBlobSize)
+	}
+	builder.SetBlockRestartInterval(s.options.BlockRestartInterval)
+	builder.SetBlockHashIndex(s.options.BlockHashIndex)
+	builder.SetComparator(s.options.comparator())
+	builder.SetPrefixExtractor(s.options.PrefixExtractor)
+	builder.SetFilterPolicy(s.options.FilterPolicy)
+	builder.SetIndexPartitionSize(s.options.IndexPartitionSize)
+	builder.SetRangeFilterPrefixLen(s.options.RangeFilterPrefixLen)
+	builder.SetBlockCache(s.store.blockCache)
+	builder.SetTableCache(s.store.tableCache)
+	builder.SetMmap(s.options.UseMmap)
+	if compression := s.options.Compression; len(compression) > 0{
+		builder.SetCompression(compression[min(level,len(compression)-1)])
+	}
+	builder.SetCompressionDictSize(s.options.CompressionDictSize)
+	if bitsPerKey := s.options.BloomBitsPerKey; len(bitsPerKey) > 0{
+		builder.SetBloomBitsPerKey(bitsPerKey[min(level,len(bitsPerKey)-1)])
+	}
+	return builder
+}
+func (s *Storage) getBlobPath(id int) string{
+	return filepath.Join(s.path,fmt.Sprintf("%d.blob",id))
+}
+
+// newBlobWriter returns a writer for a new blob file, nil unless large
+// values are moved to blobs. s.storeLock must be held.
+func (s *Storage) newBlobWriter() *table.BlobWriter{
+	if s.options.MinBlobSize <= 0{
+		return nil
+	}
+	id := s.nextId
+	s.nextId++
+	return table.NewBlobWriter(id,s.getBlobPath(id))
+}
+
+// finishBlobFile syncs the file of blobs and adds it to the store, before the
+// SSTs referring to it are. blobs may be nil.
+func (s *Storage) finishBlobFile(blobs *table.BlobWriter) error{
+	if blobs==nil{
+		return nil
+	}
+	f,err := blobs.Finish()
+	if err!=nil || f==nil{
+		return err
+	}
+	f.SetBlockCache(s.store.blockCache)
+	s.store.blobMu.Lock()
+	s.store.blobFiles[f.Id] = f
+	s.store.blobMu.Unlock()
+	return nil
+}
+
+// GetBlob reads the value ref points at from its blob file.
+func (l *LSMStore) GetBlob(ref table.BlobRef) ([]byte,error){
+	l.blobMu.Lock()
+	f,ok := l.blobFiles[ref.File]
+	l.blobMu.Unlock()
+	if !ok{
+		return nil,fmt.Errorf("%w: blob file %d not found",table.ErrCorruption,ref.File)
+	}
+	return f.Get(ref)
+}
+
+// linkBlobFiles keeps the blob files sst refers to until its file is
+// deleted, once no iterator reads it.
+func (l *LSMStore) linkBlobFiles(sst *table.SSTable){
+	var files []*table.BlobFile
+	l.blobMu.Lock()
+	for id := range sst.Properties().BlobBytes{
+		if f,ok := l.blobFiles[id]; ok{
+			f.Ref()
+			files = append(files, f)
+		}
+	}
+	l.blobMu.Unlock()
+	if len(files)==0{
+		return
+	}
+	sst.OnRemove(func(){
+		for _,f := range files{
+			removed,err := f.Unref()
+			if err!=nil{
+				log.Printf("failed to remove blob file %d: %v",f.Id,err)
+			}
+			if removed{
+				l.blobMu.Lock()
+				delete(l.blobFiles,f.Id)
+				l.blobMu.Unlock()
+			}
+		}
+	})
+}
+
+// blobFilesToRelocate returns the blob files whose share of bytes no SST
+// refers to anymore is at least the garbage ratio. Compaction moves their
+// live values out, and they are deleted with the last SST referring to them.
+func (l *LSMStore) blobFilesToRelocate() map[int]bool{
+	live := make(map[int]uint64)
+	l.mu.RLock()
+	for _,sst := range l.sstables{
+		for id,n := range sst.Properties().BlobBytes{
+			live[id] += n
+		}
+	}
+	l.mu.RUnlock()
+	relocate := make(map[int]bool)
+	l.blobMu.Lock()
+	defer l.blobMu.Unlock()
+	for id,f := range l.blobFiles{
+		if garbage := 1-float64(live[id])/float64(f.Size()); garbage >= l.options.blobGarbageRatio(){
+			relocate[id] = true
+		}
+	}
+	return relocate
+}
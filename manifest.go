@@ -0,0 +1,94 @@
+package anchordb
+
+import (
+	"anchordb/table"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+MANIFEST
+---------------------------------
+| comparator: <name>\n | ... |
+---------------------------------
+The MANIFEST holds what a store was created with and can't be read without,
+one "key: value" line each. The comparator is checked on every open, so even
+a store without SSTs can't be reopened with another order. It is written
+once, to a temporary file renamed into place.
+*/
+const manifestName = "MANIFEST"
+
+const manifestComparator = "comparator"
+
+// readManifest returns the fields of the manifest in dir, nil if there is
+// none yet.
+func readManifest(dir string) (map[string]string,error){
+	data,err := os.ReadFile(filepath.Join(dir,manifestName))
+	if errors.Is(err,os.ErrNotExist){
+		return nil,nil
+	}
+	if err!=nil{
+		return nil,err
+	}
+	fields := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan(){
+		key,value,ok := strings.Cut(scanner.Text(),": ")
+		if !ok{
+			return nil,fmt.Errorf("%w: invalid manifest line %q",table.ErrCorruption,scanner.Text())
+		}
+		fields[key] = value
+	}
+	return fields,scanner.Err()
+}
+
+// checkManifest returns ErrComparatorMismatch if the store in dir was created
+// with a comparator other than cmp. A store without a manifest passes.
+func checkManifest(dir string, cmp Comparator) error{
+	fields,err := readManifest(dir)
+	if err!=nil || fields==nil{
+		return err
+	}
+	name,ok := fields[manifestComparator]
+	if !ok{
+		return fmt.Errorf("%w: manifest has no comparator",table.ErrCorruption)
+	}
+	if name != cmp.Name(){
+		return fmt.Errorf("%w: store was created with comparator %s, not %s",table.ErrComparatorMismatch,name,cmp.Name())
+	}
+	return nil
+}
+
+// writeManifest records cmp in the manifest of the store in dir, unless it
+// has one.
+func writeManifest(dir string, cmp Comparator) error{
+	path := filepath.Join(dir,manifestName)
+	if _,err := os.Stat(path); err==nil || !errors.Is(err,os.ErrNotExist){
+		return err
+	}
+	tmp := path + ".tmp"
+	f,err := os.Create(tmp)
+	if err!=nil{
+		return err
+	}
+	_,err = fmt.Fprintf(f,"%s: %s\n",manifestComparator,cmp.Name())
+	if err==nil{
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err==nil{
+		err = closeErr
+	}
+	if err==nil{
+		err = os.Rename(tmp,path)
+	}
+	if err!=nil{
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(dir)
+}
@@ -0,0 +1,245 @@
+package table
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+/*
+Blob File Encoding
+-----------------------------------------
+| Record #1 | ... | Record #N |
+-----------------------------------------
+| Record: key len (uvarint) | value len (uvarint) | key | value | checksum (u32) |
+---------------------------------------------------------------------------------
+Large values are kept out of the SSTs in append-only blob files, so
+compaction moves a small reference instead of rewriting them. The checksum
+covers the record before it, and the key lets a record be traced back to
+the entry referencing it.
+*/
+
+const BLOB_CHECKSUM_SIZE = 4
+
+// BlobRef locates the record of a value in a blob file.
+type BlobRef struct{
+	File int
+	Offset uint64
+	// bytes of the whole record
+	Size uint64
+}
+
+// EncodeBlobRef encodes ref as the payload of a KindBlob value.
+func EncodeBlobRef(ref BlobRef) []byte{
+	buf := binary.AppendUvarint(nil,uint64(ref.File))
+	buf = binary.AppendUvarint(buf,ref.Offset)
+	return binary.AppendUvarint(buf,ref.Size)
+}
+
+func DecodeBlobRef(data []byte) (BlobRef,error){
+	var fields [3]uint64
+	for i := range fields{
+		v, n := binary.Uvarint(data)
+		if n <= 0{
+			return BlobRef{},fmt.Errorf("%w: invalid blob reference",ErrCorruption)
+		}
+		fields[i] = v
+		data = data[n:]
+	}
+	if len(data) > 0{
+		return BlobRef{},fmt.Errorf("%w: invalid blob reference",ErrCorruption)
+	}
+	return BlobRef{File: int(fields[0]), Offset: fields[1], Size: fields[2]},nil
+}
+
+// BlobWriter appends values to a new blob file, created with the first one.
+type BlobWriter struct{
+	id int
+	path string
+	file *os.File
+	w *bufio.Writer
+	offset uint64
+	err error
+}
+
+func NewBlobWriter(id int, path string) *BlobWriter{
+	return &BlobWriter{id: id, path: path}
+}
+
+// Add appends the record of key and value and returns where it is.
+func (w *BlobWriter) Add(key []byte, value []byte) (BlobRef,error){
+	if w.err!=nil{
+		return BlobRef{},w.err
+	}
+	if w.file==nil{
+		if err := os.MkdirAll(filepath.Dir(w.path),0755); err!=nil{
+			w.err = err
+			return BlobRef{},err
+		}
+		file, err := os.Create(w.path)
+		if err!=nil{
+			w.err = fmt.Errorf("failed to create blob file: %w",err)
+			return BlobRef{},w.err
+		}
+		w.file = file
+		w.w = bufio.NewWriter(file)
+	}
+	buf := make([]byte,0,len(key)+len(value)+2*binary.MaxVarintLen64+BLOB_CHECKSUM_SIZE)
+	buf = binary.AppendUvarint(buf,uint64(len(key)))
+	buf = binary.AppendUvarint(buf,uint64(len(value)))
+	buf = append(buf, key...)
+	buf = append(buf, value...)
+	buf = binary.BigEndian.AppendUint32(buf,crc32.ChecksumIEEE(buf))
+	if _, err := w.w.Write(buf); err!=nil{
+		w.err = fmt.Errorf("failed to write blob file: %w",err)
+		return BlobRef{},w.err
+	}
+	ref := BlobRef{File: w.id, Offset: w.offset, Size: uint64(len(buf))}
+	w.offset += uint64(len(buf))
+	return ref,nil
+}
+
+// IsEmpty reports whether nothing was added, so there is no file.
+func (w *BlobWriter) IsEmpty() bool{
+	return w.file==nil
+}
+
+// Finish syncs the file and opens it for reading, returning nil if nothing
+// was added.
+func (w *BlobWriter) Finish() (*BlobFile,error){
+	if w.file==nil{
+		return nil,w.err
+	}
+	defer w.file.Close()
+	if w.err!=nil{
+		return nil,w.err
+	}
+	if err := w.w.Flush(); err!=nil{
+		return nil,fmt.Errorf("failed to write blob file: %w",err)
+	}
+	if err := w.file.Sync(); err!=nil{
+		return nil,fmt.Errorf("failed to sync blob file: %w",err)
+	}
+	return OpenBlobFile(w.id,w.path)
+}
+
+// BlobFile reads the values of a blob file through the block cache. It is
+// referenced by every SST pointing into it and deleted with the last one.
+type BlobFile struct{
+	Id int
+	path string
+	file *FileWrapper
+	cache *BlockCache
+	mu sync.Mutex
+	refs int
+	removed bool
+}
+
+func OpenBlobFile(id int, path string) (*BlobFile,error){
+	f, err := OpenFileWrapper(path)
+	if err!=nil{
+		return nil,err
+	}
+	return &BlobFile{Id: id, path: path, file: f},nil
+}
+
+// SetBlockCache sets the cache values are read through.
+func (b *BlobFile) SetBlockCache(c *BlockCache){
+	b.cache = c
+}
+
+// Size returns the bytes of the records in the file, live or not.
+func (b *BlobFile) Size() uint64{
+	return uint64(b.file.size)
+}
+
+// Get returns the value ref points at. It must not be modified, it may be
+// shared through the cache.
+func (b *BlobFile) Get(ref BlobRef) ([]byte,error){
+	// the cache is keyed by 32-bit offsets, so records past 4GB aren't cached
+	cacheable := ref.Offset <= 1<<32-1
+	if cacheable{
+		if v, ok := b.cache.Get(b.Id,uint32(ref.Offset)); ok{
+			// callers may change the value, the cached one must stay
+			return bytes.Clone(v.([]byte)),nil
+		}
+	}
+	if ref.Size < BLOB_CHECKSUM_SIZE || ref.Offset+ref.Size > b.Size(){
+		return nil,fmt.Errorf("%w: blob reference %d+%d past the end of blob file %d",ErrCorruption,ref.Offset,ref.Size,b.Id)
+	}
+	record := b.file.ReadAt(int64(ref.Offset),int(ref.Size))
+	value, err := decodeBlobRecord(record)
+	if err!=nil{
+		return nil,fmt.Errorf("blob file %d offset %d: %w",b.Id,ref.Offset,err)
+	}
+	if cacheable{
+		b.cache.Insert(b.Id,uint32(ref.Offset),value,len(value))
+		return bytes.Clone(value),nil
+	}
+	return value,nil
+}
+
+func decodeBlobRecord(record []byte) ([]byte,error){
+	data := record[:len(record)-BLOB_CHECKSUM_SIZE]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(record[len(data):]){
+		return nil,fmt.Errorf("%w: blob record checksum mismatched",ErrCorruption)
+	}
+	keyLen, n := binary.Uvarint(data)
+	if n <= 0{
+		return nil,fmt.Errorf("%w: invalid blob record",ErrCorruption)
+	}
+	data = data[n:]
+	valueLen, n := binary.Uvarint(data)
+	if n <= 0 || keyLen+valueLen != uint64(len(data)-n){
+		return nil,fmt.Errorf("%w: invalid blob record",ErrCorruption)
+	}
+	return data[n+int(keyLen):],nil
+}
+
+// Ref keeps the file until Unref.
+func (b *BlobFile) Ref(){
+	b.mu.Lock()
+	b.refs++
+	b.mu.Unlock()
+}
+
+// Unref deletes the file once nothing references it, reporting whether it
+// did.
+func (b *BlobFile) Unref() (bool,error){
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refs--
+	if b.refs > 0 || b.removed{
+		return false,nil
+	}
+	b.removed = true
+	b.file.Close()
+	return true,os.Remove(b.path)
+}
+
+// Close closes the file, when the store is closed.
+func (b *BlobFile) Close() error{
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.removed{
+		return nil
+	}
+	return b.file.Close()
+}
+
+// ReadBlobValue returns the value of a KindBlob version from src.
+func ReadBlobValue(src BlobSource, iv *InternalValue) ([]byte,error){
+	ref, err := DecodeBlobRef(iv.value)
+	if err!=nil{
+		return nil,err
+	}
+	if src==nil{
+		return nil,fmt.Errorf("no blob source to read blob file %d from",ref.File)
+	}
+	return src.GetBlob(ref)
+}
@@ -0,0 +1,150 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type blobFiles map[int]*BlobFile
+
+func (b blobFiles) GetBlob(ref BlobRef) ([]byte,error){
+	f, ok := b[ref.File]
+	if !ok{
+		return nil,fmt.Errorf("blob file %d not found",ref.File)
+	}
+	return f.Get(ref)
+}
+
+func TestBlobFile(t *testing.T){
+	dir := t.TempDir()
+	w := NewBlobWriter(7,filepath.Join(dir,"7.blob"))
+	require.True(t,w.IsEmpty())
+	var refs []BlobRef
+	for i := 0; i < 10; i++{
+		ref, err := w.Add([]byte(fmt.Sprintf("key%d",i)),bytes.Repeat([]byte{byte(i)},1000*i))
+		require.NoError(t,err)
+		require.Equal(t,ref,mustDecodeBlobRef(t,EncodeBlobRef(ref)))
+		refs = append(refs, ref)
+	}
+	f, err := w.Finish()
+	require.NoError(t,err)
+	f.SetBlockCache(NewBlockCache(1<<20))
+	_, err = f.Get(BlobRef{File: 7, Offset: refs[9].Offset, Size: refs[9].Size+1})
+	require.ErrorIs(t,err,ErrCorruption)
+	for i, ref := range refs{
+		// the second read is cached
+		for j := 0; j < 2; j++{
+			value, err := f.Get(ref)
+			require.NoError(t,err)
+			require.Equal(t,bytes.Repeat([]byte{byte(i)},1000*i),value)
+		}
+	}
+	_, err = f.Get(BlobRef{File: 7, Offset: refs[5].Offset+1, Size: refs[5].Size-1})
+	require.ErrorIs(t,err,ErrCorruption)
+	_, err = DecodeBlobRef([]byte{0x80})
+	require.ErrorIs(t,err,ErrCorruption)
+
+	// deleted with the last reference
+	f.Ref()
+	f.Ref()
+	removed, err := f.Unref()
+	require.NoError(t,err)
+	require.False(t,removed)
+	removed, err = f.Unref()
+	require.NoError(t,err)
+	require.True(t,removed)
+	_, err = os.Stat(filepath.Join(dir,"7.blob"))
+	require.True(t,os.IsNotExist(err))
+
+	// nothing added, no file
+	f, err = NewBlobWriter(8,filepath.Join(dir,"8.blob")).Finish()
+	require.NoError(t,err)
+	require.Nil(t,f)
+}
+
+func mustDecodeBlobRef(t *testing.T, data []byte) BlobRef{
+	ref, err := DecodeBlobRef(data)
+	require.NoError(t,err)
+	return ref
+}
+
+func TestSSTBlobSeparation(t *testing.T){
+	dir := t.TempDir()
+	w := NewBlobWriter(1,filepath.Join(dir,"1.blob"))
+	builder := NewSSTBuilder(4096)
+	builder.SetBlobWriter(w,100)
+	value := func(i int) []byte{
+		if i%2 == 0{
+			return bytes.Repeat([]byte{byte(i)},1000)
+		}
+		return []byte(fmt.Sprintf("small%d",i))
+	}
+	for i := 0; i < 100; i++{
+		builder.Add([]byte(fmt.Sprintf("key%03d",i)),BuildEntryWithSeqNo(nil,value(i),uint64(i+1)).InternalValue().Encode())
+	}
+	f, err := w.Finish()
+	require.NoError(t,err)
+	sst := builder.Build(2,filepath.Join(dir,"2.sst"))
+	props := sst.Properties()
+	require.Equal(t,map[int]uint64{1: f.Size()},props.BlobBytes)
+	// the values stay out of the table
+	require.Less(t,props.DataSize,uint64(20000))
+
+	reopened, err := OpenSSTable(2,mustOpenFile(t,filepath.Join(dir,"2.sst")),nil)
+	require.NoError(t,err)
+	require.Equal(t,props.BlobBytes,reopened.Properties().BlobBytes)
+
+	src := blobFiles{1: f}
+	iter := CreateSSTIterAndSeekToFirst(sst)
+	for i := 0; i < 100; i++{
+		require.True(t,iter.IsValid())
+		iv, err := DecodeInternalValue(iter.Value())
+		require.NoError(t,err)
+		require.Equal(t,uint64(i+1),iv.Seq())
+		if i%2 == 0{
+			require.Equal(t,KindBlob,iv.Kind())
+			got, err := ReadBlobValue(src,iv)
+			require.NoError(t,err)
+			require.Equal(t,value(i),got)
+		} else {
+			require.Equal(t,KindValue,iv.Kind())
+			require.Equal(t,value(i),iv.Value())
+		}
+		iter.Next()
+	}
+
+	// operands merge into the value in the blob file
+	ctx := NewMergeContext([]byte("key000"))
+	ctx.SetBlobSource(src)
+	iter.SeekToKey([]byte("key000"))
+	base, err := DecodeInternalValue(iter.Value())
+	require.NoError(t,err)
+	require.False(t,ctx.Add(BuildMergeEntryWithSeqNo([]byte("key000"),[]byte("!"),200).InternalValue()))
+	require.True(t,ctx.Add(base))
+	iv, err := ctx.Resolve(appendMergeOperator{},true)
+	require.NoError(t,err)
+	require.Equal(t,append(value(0),'!'),iv.Value())
+}
+
+func mustOpenFile(t *testing.T, path string) *FileWrapper{
+	f, err := OpenFileWrapper(path)
+	require.NoError(t,err)
+	return f
+}
+
+type appendMergeOperator struct{}
+
+func (appendMergeOperator) Name() string{ return "append" }
+
+func (appendMergeOperator) FullMerge(key []byte, existing []byte, operands [][]byte) ([]byte,error){
+	return append(append([]byte{},existing...),bytes.Join(operands,nil)...),nil
+}
+
+func (appendMergeOperator) PartialMerge(key []byte, operands [][]byte) ([]byte,bool){
+	return bytes.Join(operands,nil),true
+}
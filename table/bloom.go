@@ -21,10 +21,15 @@ const (
 
 // BuildFromKeyHashes builds a Bloom filter from 32-bit key hashes.
 func BuildFromKeyHashes(keys []uint32, falsePositiveRate float64) *BloomFilter {
-    n := len(keys)
     // bits per key: m = -n ln(p) / (ln2)^2, then m/n
-    m := -float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)
-    bitsPerKey := int(math.Ceil(m / float64(n)))
+    bitsPerKey := int(math.Ceil(-math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+    return BuildFromKeyHashesWithBitsPerKey(keys, bitsPerKey)
+}
+
+// BuildFromKeyHashesWithBitsPerKey builds a Bloom filter using bitsPerKey bits
+// for every key hash.
+func BuildFromKeyHashesWithBitsPerKey(keys []uint32, bitsPerKey int) *BloomFilter {
+    n := len(keys)
     kf := int(math.Ceil(float64(bitsPerKey) * math.Ln2)) // optimal k
     if kf < 1 {
         kf = 1
@@ -93,6 +98,10 @@ func DecodeBloom(buf []byte) (*BloomFilter, error) {
 
 // MayContain returns true if key (32-bit hash) may be in the set.
 func (bf *BloomFilter) MayContain(hash32 uint32) bool {
+    if len(bf.filter) == 0 {
+        // no filter was loaded, nothing can be ruled out
+        return true
+    }
     totalBits := len(bf.filter) * 8
     h := uint64(hash32)
     delta := (h >> 17) | (h << 15)
@@ -1 +1,61 @@
-package table
\ No newline at end of file
+package table
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// falsePositiveRate builds policy's filter over n keys and probes it with n
+// keys that were not added, all added keys having to pass.
+func falsePositiveRate(t *testing.T, policy FilterPolicy, n int, bitsPerKey int) float64{
+	hashes := make([]uint64,n)
+	for i := range hashes{
+		hashes[i] = policy.HashKey([]byte(fmt.Sprintf("key%d",i)))
+	}
+	f := policy.Build(hashes,bitsPerKey)
+	for i := 0; i < n; i++{
+		require.True(t,f.MayContainKey([]byte(fmt.Sprintf("key%d",i))))
+	}
+	positives := 0
+	for i := 0; i < n; i++{
+		if f.MayContainKey([]byte(fmt.Sprintf("missing%d",i))){
+			positives++
+		}
+	}
+	return float64(positives)/float64(n)
+}
+
+func TestFilterPolicies(t *testing.T){
+	require.Less(t,falsePositiveRate(t,BloomFilterPolicy{},10000,0),0.03)
+	require.Less(t,falsePositiveRate(t,BlockedBloomFilterPolicy{},10000,10),0.03)
+	require.Less(t,falsePositiveRate(t,BlockedBloomFilterPolicy{},10000,16),0.005)
+	// a single key still gets a whole block
+	require.Less(t,falsePositiveRate(t,BlockedBloomFilterPolicy{},1,10),0.5)
+}
+
+func TestFilterTypeRecorded(t *testing.T){
+	dir := t.TempDir() + "/"
+
+	for i,policy := range []FilterPolicy{BloomFilterPolicy{},BlockedBloomFilterPolicy{}}{
+		path := fmt.Sprintf("%s%d.sst",dir,i)
+		builder := NewSSTBuilder(4096)
+		builder.SetFilterPolicy(policy)
+		for j := 0; j < 100; j++{
+			builder.Add([]byte(fmt.Sprintf("key%03d",j)),[]byte("v"))
+		}
+		sst := builder.Build(i,path)
+
+		fw, err := OpenFileWrapper(path)
+		require.NoError(t,err)
+		opened, err := OpenSSTable(i,fw,nil)
+		require.NoError(t,err)
+		require.Equal(t,policy.Type(),opened.Filter().Type())
+		require.Equal(t,sst.Filter(),opened.Filter())
+		require.True(t,opened.MayContain([]byte("key042")))
+	}
+
+	_, err := decodeFilterBlock([]byte{9,1,2,3,4,5})
+	require.Error(t,err)
+}
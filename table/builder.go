@@ -2,20 +2,61 @@ package table
 
 import (
 	"anchordb/block"
+	"bytes"
 	"encoding/binary"
-	"fmt"
 	"hash/crc32"
+	"log"
+	"time"
 )
 
 
 type SSTBuilder struct{
 	blockBuilder *block.BlockBuilder
 	blockSize int
+	// 0 for block.DefaultRestartInterval
+	restartInterval int
+	blockHashIndex bool
 	blockMeta []BlockMeta
+	// first key of the first block
+	smallestKey []byte
 	firstKey []byte
 	lastKey []byte
 	data []byte
-	keyHashes []uint32
+	keyHashes []uint64
+	filterPolicy FilterPolicy
+	rangeDels []RangeTombstone
+	prefixExtractor PrefixExtractor
+	lastPrefix []byte
+	// 0 sizes the bloom filter for a 1% false positive rate
+	bitsPerKey int
+	// blocks per index partition, 0 for a single index
+	partitionSize int
+	// end of the key hashes of each completed partition
+	partitionHashEnd []int
+	cache *BlockCache
+	tableCache *TableCache
+	mmap bool
+	compression CompressionType
+	// bytes of the dictionary trained for the table, 0 for none
+	dictSize int
+	samples [][]byte
+	sampledBytes int
+	// nil until trained
+	dict []byte
+	// encoded blocks waiting for the dictionary to be compressed with it,
+	// the last ones of blockMeta
+	pendingBlocks [][]byte
+	pendingBytes int
+	properties TableProperties
+	// MinSeq and MaxSeq of properties are set
+	hasSeq bool
+	// nil unless the table gets a range filter
+	rangeFilter *rangeFilterBuilder
+	// values over minBlobSize go to blobWriter, nil keeps them all inline
+	blobWriter *BlobWriter
+	minBlobSize int
+	// nil for BytewiseComparator
+	comparator Comparator
 }
 
 func NewSSTBuilder(blockSize int) *SSTBuilder{
@@ -26,15 +67,160 @@ func NewSSTBuilder(blockSize int) *SSTBuilder{
 		firstKey: make([]byte, 0),
 		//lastKey: make([]byte, 0),
 		data: make([]byte, 0),
+		filterPolicy: BloomFilterPolicy{},
 	}
 }
 
+// SetBlockRestartInterval sets how many keys of a block share prefixes
+// between restart points. It must be set before adding keys.
+func (b *SSTBuilder) SetBlockRestartInterval(n int){
+	b.restartInterval = n
+	b.blockBuilder = b.newBlockBuilder()
+}
+
+// SetBlockHashIndex gives every block a hash index of its keys, so point
+// lookups don't binary search the block. It must be set before adding keys.
+func (b *SSTBuilder) SetBlockHashIndex(enabled bool){
+	b.blockHashIndex = enabled
+	b.blockBuilder = b.newBlockBuilder()
+}
+
+func (b *SSTBuilder) newBlockBuilder() *block.BlockBuilder{
+	bb := block.NewBlockBuilder(b.blockSize)
+	bb.SetRestartInterval(b.restartInterval)
+	bb.SetHashIndex(b.blockHashIndex)
+	return bb
+}
+
+// SetPrefixExtractor makes the bloom filter hold the prefixes of the keys as
+// well as the keys, so prefix scans can skip the table.
+func (b *SSTBuilder) SetPrefixExtractor(p PrefixExtractor){
+	b.prefixExtractor = p
+}
+
+// SetFilterPolicy picks the filter the table is built with, nil keeps the
+// default bloom filter.
+func (b *SSTBuilder) SetFilterPolicy(p FilterPolicy){
+	if p!=nil{
+		b.filterPolicy = p
+	}
+}
+
+// SetBloomBitsPerKey sets how many bits of the filter each key gets.
+func (b *SSTBuilder) SetBloomBitsPerKey(bitsPerKey int){
+	b.bitsPerKey = bitsPerKey
+}
+
+// SetIndexPartitionSize splits the index and filter of the table into
+// partitions of n blocks each, which are only read when needed. 0 keeps a
+// single index and filter.
+func (b *SSTBuilder) SetIndexPartitionSize(n int){
+	b.partitionSize = n
+}
+
+// SetRangeFilterPrefixLen gives the table a range filter keeping the first n
+// bytes of every key, 0 builds none.
+func (b *SSTBuilder) SetRangeFilterPrefixLen(n int){
+	b.rangeFilter = nil
+	if n > 0{
+		b.rangeFilter = &rangeFilterBuilder{prefixLen: n}
+	}
+}
+
+// SetComparator sets the order the keys are added in, recorded in the table
+// so it is opened with the same one. Range filters need the keys in bytewise
+// order, so other comparators build none.
+func (b *SSTBuilder) SetComparator(c Comparator){
+	b.comparator = c
+}
+
+// SetBlockCache sets the cache the built table reads its blocks and
+// partitions through.
+func (b *SSTBuilder) SetBlockCache(c *BlockCache){
+	b.cache = c
+}
+
+// SetMmap makes the built table read through a memory mapping of its file.
+func (b *SSTBuilder) SetMmap(mmap bool){
+	b.mmap = mmap
+}
+
+// SetBlobWriter moves values over minSize bytes out of the table into w,
+// leaving a reference to them.
+func (b *SSTBuilder) SetBlobWriter(w *BlobWriter, minSize int){
+	b.blobWriter = w
+	b.minBlobSize = minSize
+}
+
+// SetCompression sets the codec blocks are compressed with.
+func (b *SSTBuilder) SetCompression(t CompressionType){
+	b.compression = t
+}
+
+// SetCompressionDictSize has the builder train a dictionary of up to n
+// bytes from the values of the table and compress every block with it. Blocks
+// are held in memory until enough values are sampled. 0 trains none.
+func (b *SSTBuilder) SetCompressionDictSize(n int){
+	b.dictSize = n
+}
+
+// dictSampleBytes is how many bytes of values are sampled for each byte of
+// dictionary.
+const dictSampleBytes = 64
+
+func (b *SSTBuilder) sampling() bool{
+	return b.dictSize > 0 && b.compression != CompressionTypeNone && b.dict==nil
+}
+
+// SetTableCache sets the cache that closes the built table when too many
+// are open.
+func (b *SSTBuilder) SetTableCache(c *TableCache){
+	b.tableCache = c
+}
+
 func hashKey(key []byte)uint32{
 	return crc32.ChecksumIEEE(key)
 }
 
+func (b *SSTBuilder) addKeyHashes(key []byte){
+	b.keyHashes = append(b.keyHashes, b.filterPolicy.HashKey(key))
+	if b.prefixExtractor!=nil && b.prefixExtractor.InDomain(key){
+		// keys come sorted, so each prefix only needs adding once
+		prefix := b.prefixExtractor.Transform(key)
+		if b.lastPrefix==nil || !bytes.Equal(prefix,b.lastPrefix){
+			b.keyHashes = append(b.keyHashes, b.filterPolicy.HashKey(prefix))
+			b.lastPrefix = append([]byte{},prefix...)
+		}
+	}
+}
+
 func (b *SSTBuilder) Add(key []byte,value []byte) {
-	b.keyHashes = append(b.keyHashes, hashKey(key))
+	// hashed once the key has its block, which may start a new partition
+	defer b.addKeyHashes(key)
+	if b.rangeFilter!=nil{
+		b.rangeFilter.add(key)
+	}
+	b.properties.NumEntries++
+	b.properties.RawKeySize += uint64(len(key))
+	b.properties.RawValueSize += uint64(len(value))
+	if kind, seq, ts, ok := peekInternalValue(value); ok{
+		switch kind{
+		case KindDelete:
+			b.properties.NumDeletions++
+		case KindValue:
+			// the encoded value is a few bytes longer than the value itself
+			if b.blobWriter!=nil && len(value) > b.minBlobSize{
+				value = b.separateValue(key,value)
+			}
+		}
+		b.addSeq(seq)
+		b.properties.MaxTimestamp = max(b.properties.MaxTimestamp,ts)
+		b.addBlobRef(value)
+	}
+	if b.sampling(){
+		b.samples = append(b.samples, append([]byte{},value...))
+		b.sampledBytes += len(value)
+	}
 	if len(b.firstKey)==0{
 		b.firstKey = b.firstKey[:0]
 		b.firstKey = append(b.firstKey, key...)
@@ -46,6 +232,7 @@ func (b *SSTBuilder) Add(key []byte,value []byte) {
 	}
 	// add failed - no space left in block
 	b.addBlockToSST()
+	b.shortenSeparator(key)
 	b.firstKey = append([]byte{}, key...)
 	b.lastKey = append([]byte{}, key...)
 	if !b.blockBuilder.Add(key, value) {
@@ -53,50 +240,254 @@ func (b *SSTBuilder) Add(key []byte,value []byte) {
 	}
 }
 
+// separateValue writes the value of the encoded KindValue version to the blob
+// writer if it is over the minimum blob size, returning the version to add.
+func (b *SSTBuilder) separateValue(key []byte, value []byte) []byte{
+	iv, err := DecodeInternalValue(value)
+	if err!=nil || len(iv.value) <= b.minBlobSize{
+		return value
+	}
+	ref, err := b.blobWriter.Add(key,iv.value)
+	if err!=nil{
+		log.Printf("failed to write blob, keeping the value inline: %v",err)
+		return value
+	}
+	blob := &InternalValue{value: EncodeBlobRef(ref), seq: iv.seq, ts: iv.ts, kind: KindBlob}
+	return blob.Encode()
+}
+
+// addBlobRef counts the record referenced by an encoded KindBlob version
+// towards the blob bytes of the table.
+func (b *SSTBuilder) addBlobRef(value []byte){
+	if ValueKind(value[0]) != KindBlob{
+		return
+	}
+	iv, err := DecodeInternalValue(value)
+	if err!=nil{
+		return
+	}
+	ref, err := DecodeBlobRef(iv.value)
+	if err!=nil{
+		return
+	}
+	if b.properties.BlobBytes==nil{
+		b.properties.BlobBytes = make(map[int]uint64)
+	}
+	b.properties.BlobBytes[ref.File] += ref.Size
+}
+
+func (b *SSTBuilder) AddRangeTombstone(t RangeTombstone){
+	b.rangeDels = append(b.rangeDels, t)
+	b.addSeq(t.seq)
+}
+
+// addSeq widens the sequence number range of the table to seq.
+func (b *SSTBuilder) addSeq(seq uint64){
+	if !b.hasSeq{
+		b.properties.MinSeq = seq
+		b.properties.MaxSeq = seq
+		b.hasSeq = true
+		return
+	}
+	b.properties.MinSeq = min(b.properties.MinSeq,seq)
+	b.properties.MaxSeq = max(b.properties.MaxSeq,seq)
+}
+
 func (b *SSTBuilder) Build(tableId int,path string) *SSTable{
-	b.addBlockToSST()
+	if !b.blockBuilder.IsEmpty(){
+		b.addBlockToSST()
+	}
+	if b.sampling(){
+		b.trainDictionary()
+	}
 	buf := b.data
+	dataEndOffset := uint32(len(buf))
+	var partitions []indexPartition
+	if b.partitionSize > 0{
+		buf, partitions = b.appendPartitions(buf)
+	}
+	buf = append(buf, encodeRangeDelBlock(b.rangeDels)...)
+	var rangeFilter *RangeFilter
+	if b.rangeFilter!=nil && IsBytewise(b.comparator){
+		rangeFilter = b.rangeFilter.build()
+	}
+	buf = append(buf, encodeRangeFilterBlock(rangeFilter)...)
+	buf = append(buf, encodeCompressionDictBlock(b.compression,b.dict)...)
+	b.properties.NumRangeDeletions = uint64(len(b.rangeDels))
+	b.properties.CreationTime = time.Now().Unix()
+	b.properties.Compression = b.compression
+	b.properties.FilterType = b.filterPolicy.Type()
+	b.properties.Comparator = comparatorOrDefault(b.comparator).Name()
+	ft := footer{formatVersion: CurrentFormatVersion, checksumType: ChecksumTypeCRC32}
+	ft.properties.offset = uint64(len(buf))
+	buf = append(buf, encodePropertiesBlock(b.properties)...)
+	ft.properties.size = uint64(len(buf))-ft.properties.offset
 	metaOffset := uint32(len(buf))
-	encodedMetaData := encodeBlockMetaData(b.blockMeta)
-	buf = append(buf, encodedMetaData...)
-	buf = append(buf, byte(metaOffset))
-	bf := BuildFromKeyHashes(b.keyHashes,0.01)
-	//start := len(buf)
-	buf = bf.Encode(buf)
-	/*fmt.Printf(" Bloom written: crc32=%08x, len=%d\n",
-    binary.BigEndian.Uint32(buf[start+len(bf.filter):start+len(bf.filter)+4]),
-    len(buf)-start,
-	)*/
+	var filter Filter
+	var filterOffset uint32
+	if partitions!=nil{
+		buf = append(buf, indexTypePartitioned)
+		buf = append(buf, encodeIndexPartitions(partitions)...)
+		// the filters are in the partitions
+		filterOffset = uint32(len(buf))
+	} else {
+		buf = append(buf, indexTypeFlat)
+		buf = append(buf, encodeBlockMetaData(b.smallestKey,b.blockMeta)...)
+		filter = b.filterPolicy.Build(b.keyHashes,b.bitsPerKey)
+		filterOffset = uint32(len(buf))
+		buf = encodeFilterBlock(buf,filter)
+	}
+	ft.index = blockHandle{uint64(metaOffset),uint64(filterOffset-metaOffset)}
+	ft.filter = blockHandle{uint64(filterOffset),uint64(len(buf))-uint64(filterOffset)}
+	buf = encodeFooter(buf,ft)
 
 	fileWrap,err := CreateFileWrapper(path,buf)
 	if err!=nil{
-		fmt.Printf("err : %s",err.Error())
+		log.Printf("failed to write sstable %s: %v",path,err)
+	}
+	mapped := false
+	if fileWrap!=nil && b.mmap{
+		if err := fileWrap.Map(); err!=nil{
+			log.Printf("failed to map sstable: %v",err)
+		} else {
+			mapped = true
+		}
 	}
-	firstKey := b.blockMeta[0].firstKey
-	lastKey := b.blockMeta[len(b.blockMeta)-1].lastKey
-	return &SSTable{
+	var firstKey,lastKey []byte
+	if len(b.blockMeta) > 0{
+		firstKey = b.smallestKey
+		lastKey = b.blockMeta[len(b.blockMeta)-1].separator
+	}
+	sst := &SSTable{
 		Id: tableId,
-		fileWrap: fileWrap,
+		handle: &tableHandle{path: path, mmap: b.mmap},
 		firstKey: firstKey,
 		lastKey: lastKey,
-		blockMeta: b.blockMeta,
 		blockMetaOffset: metaOffset,
-		BloomFilter: *bf,
+		dataEndOffset: dataEndOffset,
+		rangeDels: b.rangeDels,
+		prefixExtractor: prefixExtractorName(b.prefixExtractor),
+		cache: b.cache,
+		properties: b.properties,
+		comparator: comparatorOrDefault(b.comparator),
+	}
+	if fileWrap!=nil{
+		r := &tableReader{file: fileWrap, formatVersion: ft.formatVersion, filter: filter, rangeFilter: rangeFilter, dict: b.dict, dictCompression: b.compression}
+		if partitions!=nil{
+			r.partitions = partitions
+			r.blockCount = len(b.blockMeta)
+		} else {
+			r.blockMeta = b.blockMeta
+		}
+		sst.handle.reader = r
+		if mapped{
+			sst.handle.mapped = fileWrap
+		}
 	}
+	sst.SetTableCache(b.tableCache)
+	return sst
+}
+
+// appendPartitions appends the index and filter of every partition to buf.
+func (b *SSTBuilder) appendPartitions(buf []byte) ([]byte,[]indexPartition){
+	partitions := []indexPartition{}
+	hashStart := 0
+	for start := 0; start < len(b.blockMeta); start += b.partitionSize{
+		end := min(start+b.partitionSize,len(b.blockMeta))
+		hashEnd := len(b.keyHashes)
+		if i := len(partitions); i < len(b.partitionHashEnd){
+			hashEnd = b.partitionHashEnd[i]
+		}
+		// the separators around the partition bound its keys, the first and
+		// last partitions getting the keys of the table
+		firstKey := b.smallestKey
+		if start > 0{
+			firstKey = b.blockMeta[start-1].separator
+		}
+		p := indexPartition{
+			firstBlock: uint32(start),
+			numBlocks: uint32(end-start),
+			firstKey: firstKey,
+			lastKey: b.blockMeta[end-1].separator,
+		}
+		p.indexOffset = uint32(len(buf))
+		buf = append(buf, encodeBlockMetaData(firstKey,b.blockMeta[start:end])...)
+		p.indexSize = uint32(len(buf)) - p.indexOffset
+		p.filterOffset = uint32(len(buf))
+		buf = encodeFilterBlock(buf,b.filterPolicy.Build(b.keyHashes[hashStart:hashEnd],b.bitsPerKey))
+		p.filterSize = uint32(len(buf)) - p.filterOffset
+		partitions = append(partitions, p)
+		hashStart = hashEnd
+	}
+	return buf,partitions
 }
 
 func (b *SSTBuilder) addBlockToSST(){
 	blk := b.blockBuilder.Build()
 	encoded := blk.Encode()
+	if len(b.blockMeta) == 0{
+		b.smallestKey = b.blockBuilder.FirstKey()
+	}
 	b.blockMeta = append(b.blockMeta, BlockMeta{
-		offset: uint32(len(b.data)),
-		firstKey: b.blockBuilder.FirstKey(),
-		lastKey: b.blockBuilder.LastKey(),
+		// shortened once the first key of the next block is known
+		separator: b.blockBuilder.LastKey(),
 	})
-	checksum := crc32.ChecksumIEEE(encoded)
-	var checksumBuf [4]byte
-	binary.BigEndian.PutUint32(checksumBuf[:], checksum)
-	b.data = append(b.data, encoded...)
-	b.data = append(b.data, checksumBuf[:]...)
-	b.blockBuilder = block.NewBlockBuilder(b.blockSize)
-}
\ No newline at end of file
+	if b.sampling(){
+		b.pendingBlocks = append(b.pendingBlocks, encoded)
+		b.pendingBytes += len(encoded)
+		if b.sampledBytes >= b.dictSize*dictSampleBytes{
+			b.trainDictionary()
+		}
+	} else {
+		b.writeBlock(len(b.blockMeta)-1,encoded)
+	}
+	b.blockBuilder = b.newBlockBuilder()
+	if b.partitionSize > 0 && len(b.blockMeta)%b.partitionSize == 0{
+		b.partitionHashEnd = append(b.partitionHashEnd, len(b.keyHashes))
+		// each partition's filter needs its own prefixes
+		b.lastPrefix = nil
+	}
+}
+
+// shortenSeparator replaces the separator of the last block, its last key,
+// with the shortest key between it and next, the first key of the block after.
+// Versions of a key spanning both leave it.
+func (b *SSTBuilder) shortenSeparator(next []byte){
+	cmp := comparatorOrDefault(b.comparator)
+	meta := &b.blockMeta[len(b.blockMeta)-1]
+	if cmp.Compare(meta.separator,next) < 0{
+		meta.separator = cmp.FindShortestSeparator(meta.separator,next)
+	}
+}
+
+// writeBlock compresses the encoded block idx into the data.
+func (b *SSTBuilder) writeBlock(idx int, encoded []byte){
+	b.blockMeta[idx].offset = uint32(len(b.data))
+	stored, compression := compressBlock(b.compression,encoded,b.dict)
+	b.properties.RawDataSize += uint64(len(encoded))
+	b.properties.DataSize += uint64(len(stored))
+	start := len(b.data)
+	b.data = append(b.data, stored...)
+	b.data = append(b.data, byte(compression))
+	// the checksum covers the compression type too
+	b.data = binary.BigEndian.AppendUint32(b.data,crc32.ChecksumIEEE(b.data[start:]))
+	b.blockMeta[idx].size = uint32(len(b.data)-start)
+}
+
+// trainDictionary trains the dictionary from the sampled values and writes
+// the blocks that waited for it.
+func (b *SSTBuilder) trainDictionary(){
+	b.dict = TrainDictionary(b.samples,b.dictSize)
+	b.samples = nil
+	b.properties.CompressionDictSize = uint64(len(b.dict))
+	first := len(b.blockMeta)-len(b.pendingBlocks)
+	for i,encoded := range b.pendingBlocks{
+		b.writeBlock(first+i,encoded)
+	}
+	b.pendingBlocks = nil
+	b.pendingBytes = 0
+}
+
+func (b *SSTBuilder) EstimatedSize() int{
+	return len(b.data)+b.pendingBytes
+}
@@ -0,0 +1,142 @@
+package table
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// BlockCache keeps decoded blocks and index and filter partitions of SSTs,
+// keyed by table id and file offset, evicting the least recently used once
+// their size passes the capacity. It is shared by every table of a store and
+// split into shards with their own lock, so concurrent readers rarely wait on
+// each other. A nil cache caches nothing.
+type BlockCache struct{
+	shards [blockCacheShards]blockCacheShard
+	hits atomic.Uint64
+	misses atomic.Uint64
+}
+
+const blockCacheShards = 16
+
+type blockCacheShard struct{
+	mu sync.Mutex
+	capacity int64
+	size int64
+	lru *list.List
+	items map[blockCacheKey]*list.Element
+}
+
+type blockCacheKey struct{
+	sstID int
+	offset uint32
+}
+
+type blockCacheEntry struct{
+	key blockCacheKey
+	value interface{}
+	charge int64
+}
+
+// BlockCacheStats counts the lookups of a BlockCache since it was created.
+type BlockCacheStats struct{
+	Hits uint64
+	Misses uint64
+	// bytes charged by the cached entries
+	Size int64
+	Capacity int64
+}
+
+// NewBlockCache returns a cache holding up to capacity bytes, split evenly
+// across its shards.
+func NewBlockCache(capacity int64) *BlockCache{
+	c := &BlockCache{}
+	for i := range c.shards{
+		c.shards[i] = blockCacheShard{
+			capacity: capacity/blockCacheShards,
+			lru: list.New(),
+			items: make(map[blockCacheKey]*list.Element),
+		}
+	}
+	return c
+}
+
+func (c *BlockCache) shard(key blockCacheKey) *blockCacheShard{
+	// blocks of a table have nearby offsets, so mix both into the shard
+	h := uint64(key.sstID)*0x9e3779b97f4a7c15 ^ uint64(key.offset)*0xff51afd7ed558ccd
+	return &c.shards[h>>60]
+}
+
+func (c *BlockCache) Get(sstID int, offset uint32) (interface{},bool){
+	if c==nil{
+		return nil,false
+	}
+	key := blockCacheKey{sstID,offset}
+	s := c.shard(key)
+	s.mu.Lock()
+	elem, ok := s.items[key]
+	if ok{
+		s.lru.MoveToFront(elem)
+	}
+	s.mu.Unlock()
+	if !ok{
+		c.misses.Add(1)
+		return nil,false
+	}
+	c.hits.Add(1)
+	return elem.Value.(*blockCacheEntry).value,true
+}
+
+// Insert adds value, charging its size in bytes against the capacity.
+func (c *BlockCache) Insert(sstID int, offset uint32, value interface{}, charge int){
+	if c==nil{
+		return
+	}
+	key := blockCacheKey{sstID,offset}
+	s := c.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if elem, ok := s.items[key]; ok{
+		s.size -= elem.Value.(*blockCacheEntry).charge
+		s.lru.Remove(elem)
+	}
+	s.items[key] = s.lru.PushFront(&blockCacheEntry{key: key, value: value, charge: int64(charge)})
+	s.size += int64(charge)
+	for s.size > s.capacity && s.lru.Len() > 0{
+		oldest := s.lru.Back()
+		entry := oldest.Value.(*blockCacheEntry)
+		s.lru.Remove(oldest)
+		delete(s.items,entry.key)
+		s.size -= entry.charge
+	}
+}
+
+// Size returns the bytes charged by the cached entries.
+func (c *BlockCache) Size() int64{
+	if c==nil{
+		return 0
+	}
+	var size int64
+	for i := range c.shards{
+		s := &c.shards[i]
+		s.mu.Lock()
+		size += s.size
+		s.mu.Unlock()
+	}
+	return size
+}
+
+func (c *BlockCache) Stats() BlockCacheStats{
+	if c==nil{
+		return BlockCacheStats{}
+	}
+	stats := BlockCacheStats{
+		Hits: c.hits.Load(),
+		Misses: c.misses.Load(),
+		Size: c.Size(),
+	}
+	for i := range c.shards{
+		stats.Capacity += c.shards[i].capacity
+	}
+	return stats
+}
@@ -0,0 +1,87 @@
+package table
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockCache(t *testing.T){
+	c := NewBlockCache(blockCacheShards * 100)
+	for i := 0; i < 1000; i++{
+		c.Insert(1,uint32(i),i,10)
+	}
+	// no shard holds more than its share
+	require.LessOrEqual(t,c.Size(),int64(blockCacheShards * 100))
+	hits := 0
+	for i := 0; i < 1000; i++{
+		if v, ok := c.Get(1,uint32(i)); ok{
+			require.Equal(t,i,v)
+			hits++
+		}
+	}
+	require.Greater(t,hits,0)
+	require.Less(t,hits,1000)
+	stats := c.Stats()
+	require.Equal(t,uint64(hits),stats.Hits)
+	require.Equal(t,uint64(1000-hits),stats.Misses)
+	require.Equal(t,int64(blockCacheShards * 100),stats.Capacity)
+
+	// the least recently used entry goes first
+	c = NewBlockCache(blockCacheShards * 30)
+	key := blockCacheKey{2,0}
+	var sameShard []uint32
+	for off := uint32(0); len(sameShard) < 4; off++{
+		if c.shard(blockCacheKey{2,off}) == c.shard(key){
+			sameShard = append(sameShard, off)
+		}
+	}
+	for _, off := range sameShard[:3]{
+		c.Insert(2,off,off,10)
+	}
+	_, ok := c.Get(2,sameShard[0])
+	require.True(t,ok)
+	c.Insert(2,sameShard[3],sameShard[3],10)
+	_, ok = c.Get(2,sameShard[1])
+	require.False(t,ok)
+	for _, off := range []uint32{sameShard[0],sameShard[2],sameShard[3]}{
+		_, ok = c.Get(2,off)
+		require.True(t,ok)
+	}
+
+	var nilCache *BlockCache
+	nilCache.Insert(1,0,"v",1)
+	_, ok = nilCache.Get(1,0)
+	require.False(t,ok)
+	require.Equal(t,BlockCacheStats{},nilCache.Stats())
+}
+
+func TestSSTBlockCache(t *testing.T){
+	builder := NewSSTBuilder(256)
+	for i := 0; i < 200; i++{
+		builder.Add([]byte(fmt.Sprintf("key%03d",i)),[]byte("value"))
+	}
+	sst := builder.Build(0,t.TempDir() + "/0.sst")
+	cache := NewBlockCache(1 << 20)
+	sst.SetBlockCache(cache)
+
+	scan := func(sst *SSTable){
+		iter := CreateSSTIterAndSeekToFirst(sst)
+		for ; iter.IsValid(); iter.Next(){}
+	}
+	scan(sst.WithoutCacheFill())
+	require.Zero(t,cache.Size())
+	require.Zero(t,cache.Stats().Hits)
+
+	scan(sst)
+	// every block missed once by each scan
+	misses := cache.Stats().Misses
+	require.Equal(t,uint64(2*sst.getBlockCount()),misses)
+	require.Greater(t,cache.Size(),int64(0))
+
+	// cached blocks are used by views too
+	scan(sst.WithoutCacheFill())
+	require.Equal(t,misses,cache.Stats().Misses)
+	require.GreaterOrEqual(t,cache.Stats().Hits,uint64(sst.getBlockCount()))
+}
@@ -0,0 +1,101 @@
+package table
+
+import "bytes"
+
+// Comparator orders the keys of a store. Keys comparing equal must be the
+// same bytes. Its name is recorded in every SST, which can then only be
+// opened with a comparator of the same name.
+type Comparator interface{
+	// Compare returns -1, 0 or 1 as a is before, equal to or after b.
+	Compare(a []byte, b []byte) int
+	Name() string
+	// FindShortestSeparator returns a key k, as short as it can, with
+	// start <= k < limit, given start < limit. Returning start is always
+	// correct.
+	FindShortestSeparator(start []byte, limit []byte) []byte
+	// FindShortSuccessor returns a key k, as short as it can, with key <= k.
+	// Returning key is always correct.
+	FindShortSuccessor(key []byte) []byte
+}
+
+// BytewiseComparator orders keys lexicographically by their bytes, the
+// default.
+var BytewiseComparator Comparator = bytewiseComparator{}
+
+// ReverseBytewiseComparator orders keys in the reverse of
+// BytewiseComparator, so newer timestamp keys come first.
+var ReverseBytewiseComparator Comparator = reverseBytewiseComparator{}
+
+type bytewiseComparator struct{}
+
+func (bytewiseComparator) Compare(a []byte, b []byte) int{
+	return bytes.Compare(a,b)
+}
+
+func (bytewiseComparator) Name() string{
+	return "anchordb.BytewiseComparator"
+}
+
+func (bytewiseComparator) FindShortestSeparator(start []byte, limit []byte) []byte{
+	n := 0
+	for n < len(start) && n < len(limit) && start[n] == limit[n]{
+		n++
+	}
+	if n >= len(start) || n >= len(limit){
+		// one is a prefix of the other
+		return start
+	}
+	if c := start[n]; c < 0xff && c+1 < limit[n]{
+		return append(append([]byte{},start[:n]...),c+1)
+	}
+	// start[n]+1 is limit[n], so anything keeping start[n] is before limit.
+	// Bumping a later byte of start gives a key after it.
+	for i := n+1; i < len(start)-1; i++{
+		if start[i] < 0xff{
+			return append(append([]byte{},start[:i]...),start[i]+1)
+		}
+	}
+	return start
+}
+
+func (bytewiseComparator) FindShortSuccessor(key []byte) []byte{
+	for i,c := range key{
+		if c != 0xff{
+			return append(append([]byte{},key[:i]...),c+1)
+		}
+	}
+	// a run of 0xff has no shorter successor
+	return key
+}
+
+type reverseBytewiseComparator struct{}
+
+func (reverseBytewiseComparator) Compare(a []byte, b []byte) int{
+	return bytes.Compare(b,a)
+}
+
+func (reverseBytewiseComparator) Name() string{
+	return "anchordb.ReverseBytewiseComparator"
+}
+
+func (reverseBytewiseComparator) FindShortestSeparator(start []byte, limit []byte) []byte{
+	return start
+}
+
+func (reverseBytewiseComparator) FindShortSuccessor(key []byte) []byte{
+	return key
+}
+
+// IsBytewise reports whether c orders keys by their bytes, nil being
+// BytewiseComparator. Prefix bounds and range filters depend on it.
+func IsBytewise(c Comparator) bool{
+	return c==nil || c.Name() == BytewiseComparator.Name()
+}
+
+// comparatorOrDefault returns c, BytewiseComparator if it is nil.
+func comparatorOrDefault(c Comparator) Comparator{
+	if c==nil{
+		return BytewiseComparator
+	}
+	return c
+}
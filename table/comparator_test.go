@@ -0,0 +1,68 @@
+package table
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBytewiseComparator(t *testing.T){
+	cmp := BytewiseComparator
+	for _, c := range []struct{ start, limit, want string }{
+		{"abc", "abd", "abc"},
+		{"abc", "abz", "abd"},
+		{"abcdef", "abzzzz", "abd"},
+		{"ab", "abc", "ab"},
+		{"a\xff", "b", "a\xff"},
+		{"ab123", "ac", "ab2"},
+		{"ab\xff\xff1", "ac", "ab\xff\xff1"},
+		{"", "b", ""},
+	}{
+		sep := cmp.FindShortestSeparator([]byte(c.start),[]byte(c.limit))
+		require.Equal(t,c.want,string(sep),"%q %q",c.start,c.limit)
+		require.LessOrEqual(t,cmp.Compare([]byte(c.start),sep),0)
+		require.Less(t,cmp.Compare(sep,[]byte(c.limit)),0)
+	}
+	require.Equal(t,"b",string(cmp.FindShortSuccessor([]byte("abc"))))
+	require.Equal(t,"\xff\xffb",string(cmp.FindShortSuccessor([]byte("\xff\xffabc"))))
+	require.Equal(t,"\xff\xff",string(cmp.FindShortSuccessor([]byte("\xff\xff"))))
+}
+
+func TestSSTComparator(t *testing.T){
+	dir := t.TempDir()
+	builder := NewSSTBuilder(256)
+	builder.SetComparator(ReverseBytewiseComparator)
+	builder.SetRangeFilterPrefixLen(3)
+	for i := 99; i >= 0; i--{
+		builder.Add([]byte(fmt.Sprintf("key%03d",i)),BuildEntryWithSeqNo(nil,[]byte(fmt.Sprintf("value%d",i)),uint64(i+1)).InternalValue().Encode())
+	}
+	built := builder.Build(1,filepath.Join(dir,"1.sst"))
+	require.Equal(t,ReverseBytewiseComparator.Name(),built.Properties().Comparator)
+	// range filters need bytewise order
+	require.True(t,built.MayContainRange([]byte("key050"),[]byte("key040")))
+	require.False(t,built.MayContainRange([]byte("key200"),[]byte("key100")))
+
+	opened, err := OpenSSTable(1,mustOpenFile(t,filepath.Join(dir,"1.sst")),ReverseBytewiseComparator)
+	require.NoError(t,err)
+	for _, sst := range []*SSTable{built,opened}{
+		iter := CreateSSTIterAndSeekToKey(sst,[]byte("key050"))
+		for i := 50; i >= 0; i--{
+			require.True(t,iter.IsValid())
+			require.Equal(t,fmt.Sprintf("key%03d",i),string(iter.Key()))
+			require.NoError(t,iter.Next())
+		}
+		require.False(t,iter.IsValid())
+		iter = CreateSSTIterAndSeekForPrev(sst,[]byte("key0505"))
+		require.Equal(t,"key051",string(iter.Key()))
+	}
+
+	_, err = OpenSSTable(1,mustOpenFile(t,filepath.Join(dir,"1.sst")),nil)
+	require.ErrorIs(t,err,ErrComparatorMismatch)
+	bytewise := NewSSTBuilder(256)
+	bytewise.Add([]byte("key"),BuildEntryWithSeqNo(nil,[]byte("value"),1).InternalValue().Encode())
+	bytewise.Build(2,filepath.Join(dir,"2.sst"))
+	_, err = OpenSSTable(2,mustOpenFile(t,filepath.Join(dir,"2.sst")),ReverseBytewiseComparator)
+	require.ErrorIs(t,err,ErrComparatorMismatch)
+}
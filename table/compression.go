@@ -0,0 +1,363 @@
+package table
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+)
+
+// CompressionType is recorded after every block, so a table can mix
+// compressed and uncompressed blocks and is read whatever the current
+// options are.
+type CompressionType uint8
+
+const (
+	CompressionTypeNone CompressionType = iota
+	CompressionTypeFlate
+	CompressionTypeZlib
+	// LZ4-style byte oriented LZ77, much faster than flate for less savings
+	CompressionTypeLZ4
+)
+
+// Codec compresses blocks of one CompressionType.
+type Codec interface{
+	Type() CompressionType
+	// Compress appends src compressed to dst.
+	Compress(dst []byte, src []byte) []byte
+	Decompress(src []byte) ([]byte,error)
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs = map[CompressionType]Codec{
+		CompressionTypeFlate: flateCodec{},
+		CompressionTypeZlib: zlibCodec{},
+		CompressionTypeLZ4: lz4Codec{},
+	}
+)
+
+// RegisterCodec makes the codec used for its type, replacing any codec
+// registered for it. Tables written with a type can only be read while its
+// codec is registered.
+func RegisterCodec(c Codec){
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[c.Type()] = c
+}
+
+func codecFor(t CompressionType) (Codec,error){
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	c, ok := codecs[t]
+	if !ok{
+		return nil,fmt.Errorf("unknown compression type %d",t)
+	}
+	return c,nil
+}
+
+// DictCodec is a Codec that can also compress with a dictionary, data the
+// compressed data may refer back to as if it came before it. A dictionary
+// trained from a table's values lets small blocks compress like large ones.
+type DictCodec interface{
+	Codec
+	CompressDict(dst []byte, src []byte, dict []byte) []byte
+	DecompressDict(src []byte, dict []byte) ([]byte,error)
+}
+
+// compressBlock returns the data a block is stored as and the type to record
+// with it, using dict if the codec takes one. Blocks compression doesn't
+// shrink by at least 1/8 are stored as they are, not worth decompressing on
+// every read.
+func compressBlock(t CompressionType, data []byte, dict []byte) ([]byte,CompressionType){
+	if t == CompressionTypeNone{
+		return data,CompressionTypeNone
+	}
+	c, err := codecFor(t)
+	if err!=nil{
+		log.Printf("failed to compress block: %v",err)
+		return data,CompressionTypeNone
+	}
+	var compressed []byte
+	if dc, ok := c.(DictCodec); ok && dict!=nil{
+		compressed = dc.CompressDict(nil,data,dict)
+	} else {
+		compressed = c.Compress(nil,data)
+	}
+	if len(compressed) > len(data)-len(data)/8{
+		return data,CompressionTypeNone
+	}
+	return compressed,t
+}
+
+func decompressBlock(t CompressionType, data []byte, dict []byte) ([]byte,error){
+	if t == CompressionTypeNone{
+		return data,nil
+	}
+	c, err := codecFor(t)
+	if err!=nil{
+		return nil,err
+	}
+	if dc, ok := c.(DictCodec); ok && dict!=nil{
+		return dc.DecompressDict(data,dict)
+	}
+	return c.Decompress(data)
+}
+
+type resetWriter interface{
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+type dictWriter struct{
+	dict []byte
+	w resetWriter
+}
+
+// writerPool reuses compressing writers, which allocate several hundred KB.
+// A writer keeps the dictionary it was made with, so one made with another
+// dictionary is replaced. A table compresses all its blocks with the same
+// dictionary, so they are mostly reused.
+type writerPool struct{
+	pool sync.Pool
+	newWriter func(dict []byte) resetWriter
+}
+
+func (p *writerPool) compress(dst []byte, src []byte, dict []byte) []byte{
+	buf := bytes.NewBuffer(dst)
+	dw, _ := p.pool.Get().(*dictWriter)
+	if dw==nil || !sameBytes(dw.dict,dict){
+		dw = &dictWriter{dict: dict, w: p.newWriter(dict)}
+	}
+	defer p.pool.Put(dw)
+	dw.w.Reset(buf)
+	dw.w.Write(src)
+	dw.w.Close()
+	return buf.Bytes()
+}
+
+// sameBytes reports whether a and b are the same slice, not just equal.
+func sameBytes(a []byte, b []byte) bool{
+	return len(a) == len(b) && (len(a) == 0 || &a[0] == &b[0])
+}
+
+var flateWriters = &writerPool{newWriter: func(dict []byte) resetWriter{
+	w,_ := flate.NewWriterDict(nil,flate.DefaultCompression,dict)
+	return w
+}}
+
+var zlibWriters = &writerPool{newWriter: func(dict []byte) resetWriter{
+	w,_ := zlib.NewWriterLevelDict(nil,zlib.DefaultCompression,dict)
+	return w
+}}
+
+type flateCodec struct{}
+
+func (flateCodec) Type() CompressionType{
+	return CompressionTypeFlate
+}
+
+func (flateCodec) Compress(dst []byte, src []byte) []byte{
+	return flateWriters.compress(dst,src,nil)
+}
+
+func (flateCodec) Decompress(src []byte) ([]byte,error){
+	return flateCodec{}.DecompressDict(src,nil)
+}
+
+func (flateCodec) CompressDict(dst []byte, src []byte, dict []byte) []byte{
+	return flateWriters.compress(dst,src,dict)
+}
+
+func (flateCodec) DecompressDict(src []byte, dict []byte) ([]byte,error){
+	r := flate.NewReaderDict(bytes.NewReader(src),dict)
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+type zlibCodec struct{}
+
+func (zlibCodec) Type() CompressionType{
+	return CompressionTypeZlib
+}
+
+func (zlibCodec) Compress(dst []byte, src []byte) []byte{
+	return zlibWriters.compress(dst,src,nil)
+}
+
+func (zlibCodec) Decompress(src []byte) ([]byte,error){
+	return zlibCodec{}.DecompressDict(src,nil)
+}
+
+func (zlibCodec) CompressDict(dst []byte, src []byte, dict []byte) []byte{
+	return zlibWriters.compress(dst,src,dict)
+}
+
+func (zlibCodec) DecompressDict(src []byte, dict []byte) ([]byte,error){
+	r, err := zlib.NewReaderDict(bytes.NewReader(src),dict)
+	if err!=nil{
+		return nil,err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+/*
+LZ4-style Encoding
+-------------------------------------------------------
+| decoded size (uvarint) | Sequence #1 | ... | Sequence #N |
+-------------------------------------------------------
+| Sequence: token (u8) | [literal len] | literals | offset (u16 LE) | [match len] |
+---------------------------------------------------------------------------------
+The high nibble of the token is the literal length, the low one the match
+length minus 4, and a nibble of 15 continues in bytes added to it until one
+is below 255. The last sequence only has literals.
+*/
+
+const (
+	lz4MinMatch = 4
+	lz4HashLog = 14
+	lz4MaxOffset = 1<<16 - 1
+)
+
+type lz4Codec struct{}
+
+func (lz4Codec) Type() CompressionType{
+	return CompressionTypeLZ4
+}
+
+func (lz4Codec) Compress(dst []byte, src []byte) []byte{
+	return lz4Codec{}.CompressDict(dst,src,nil)
+}
+
+// CompressDict compresses src as if it followed dict, so matches can reach
+// back into the last 64KB of it.
+func (lz4Codec) CompressDict(dst []byte, src []byte, dict []byte) []byte{
+	dst = binary.AppendUvarint(dst,uint64(len(src)))
+	dict = dict[max(0,len(dict)-lz4MaxOffset):]
+	if len(dict) > 0{
+		src = append(append(make([]byte,0,len(dict)+len(src)),dict...),src...)
+	}
+	// last position+1 of each hashed 4 bytes
+	var table [1<<lz4HashLog]int32
+	hash := func(i int) uint32{
+		return (binary.LittleEndian.Uint32(src[i:])*2654435761) >> (32-lz4HashLog)
+	}
+	for i := 0; i+lz4MinMatch <= len(dict); i++{
+		table[hash(i)] = int32(i+1)
+	}
+	anchor := len(dict)
+	for i := len(dict); i+lz4MinMatch <= len(src);{
+		h := hash(i)
+		candidate := int(table[h])-1
+		table[h] = int32(i+1)
+		if candidate < 0 || i-candidate > lz4MaxOffset || binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]){
+			i++
+			continue
+		}
+		n := lz4MinMatch
+		for i+n < len(src) && src[candidate+n] == src[i+n]{
+			n++
+		}
+		dst = appendLZ4Sequence(dst,src[anchor:i],i-candidate,n)
+		i += n
+		anchor = i
+	}
+	return appendLZ4Sequence(dst,src[anchor:],0,0)
+}
+
+// appendLZ4Sequence appends literals followed by a match of matchLen bytes
+// offset bytes back, no match if matchLen is 0.
+func appendLZ4Sequence(dst []byte, literals []byte, offset int, matchLen int) []byte{
+	token := byte(min(len(literals),15)) << 4
+	if matchLen > 0{
+		token |= byte(min(matchLen-lz4MinMatch,15))
+	}
+	dst = append(dst, token)
+	dst = appendLZ4Length(dst,len(literals))
+	dst = append(dst, literals...)
+	if matchLen == 0{
+		return dst
+	}
+	dst = binary.LittleEndian.AppendUint16(dst,uint16(offset))
+	return appendLZ4Length(dst,matchLen-lz4MinMatch)
+}
+
+func appendLZ4Length(dst []byte, n int) []byte{
+	if n < 15{
+		return dst
+	}
+	for n -= 15; n >= 255; n -= 255{
+		dst = append(dst, 255)
+	}
+	return append(dst, byte(n))
+}
+
+func (lz4Codec) Decompress(src []byte) ([]byte,error){
+	return lz4Codec{}.DecompressDict(src,nil)
+}
+
+func (lz4Codec) DecompressDict(src []byte, dict []byte) ([]byte,error){
+	errInvalid := fmt.Errorf("invalid lz4 block")
+	size, n := binary.Uvarint(src)
+	// a byte can't expand to more than 255 bytes
+	if n <= 0 || size > uint64(len(src))*255{
+		return nil,errInvalid
+	}
+	src = src[n:]
+	readLength := func(nibble byte) (int,bool){
+		length := int(nibble)
+		if nibble < 15{
+			return length,true
+		}
+		for len(src) > 0{
+			b := src[0]
+			src = src[1:]
+			length += int(b)
+			if b < 255{
+				return length,true
+			}
+		}
+		return 0,false
+	}
+	// matches may reach into the dictionary, as if it was decoded before
+	dict = dict[max(0,len(dict)-lz4MaxOffset):]
+	out := append(make([]byte,0,len(dict)+int(size)),dict...)
+	size += uint64(len(dict))
+	for len(src) > 0{
+		token := src[0]
+		src = src[1:]
+		literals, ok := readLength(token >> 4)
+		if !ok || literals > len(src) || len(out)+literals > int(size){
+			return nil,errInvalid
+		}
+		out = append(out, src[:literals]...)
+		src = src[literals:]
+		if len(src) == 0{
+			break
+		}
+		if len(src) < 2{
+			return nil,errInvalid
+		}
+		offset := int(binary.LittleEndian.Uint16(src))
+		src = src[2:]
+		matchLen, ok := readLength(token & 15)
+		matchLen += lz4MinMatch
+		if !ok || offset == 0 || offset > len(out) || len(out)+matchLen > int(size){
+			return nil,errInvalid
+		}
+		// the match may overlap what it appends, so byte by byte
+		start := len(out)-offset
+		for k := 0; k < matchLen; k++{
+			out = append(out, out[start+k])
+		}
+	}
+	if len(out) != int(size){
+		return nil,errInvalid
+	}
+	return out[len(dict):],nil
+}
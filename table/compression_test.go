@@ -0,0 +1,111 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCodecs(t *testing.T){
+	rng := rand.New(rand.NewSource(1))
+	random := make([]byte,5000)
+	rng.Read(random)
+	var text []byte
+	for i := 0; i < 500; i++{
+		text = append(text, fmt.Sprintf("user:%05d:name=user%d;",i%37,i)...)
+	}
+	inputs := [][]byte{
+		nil,
+		[]byte("abc"),
+		random,
+		text,
+		bytes.Repeat([]byte{'a'},70000),
+		append(append([]byte{},random[:300]...),random[:300]...),
+	}
+	for _,typ := range []CompressionType{CompressionTypeFlate,CompressionTypeZlib,CompressionTypeLZ4}{
+		c, err := codecFor(typ)
+		require.NoError(t,err)
+		require.Equal(t,typ,c.Type())
+		for _,in := range inputs{
+			compressed := c.Compress([]byte("prefix"),in)
+			require.Equal(t,"prefix",string(compressed[:6]))
+			out, err := c.Decompress(compressed[6:])
+			require.NoError(t,err)
+			require.Equal(t,len(in),len(out))
+			require.True(t,bytes.Equal(in,out))
+		}
+		require.Less(t,len(c.Compress(nil,text)),len(text)/2)
+	}
+
+	lz4 := lz4Codec{}
+	compressed := lz4.Compress(nil,text)
+	for _,corrupt := range [][]byte{
+		compressed[:len(compressed)/2],
+		append([]byte{0xff,0xff,0xff,0xff,0x0f},compressed[1:]...),
+		{5,0x04,0,0},
+	}{
+		_, err := lz4.Decompress(corrupt)
+		require.Error(t,err)
+	}
+
+	_, err := codecFor(CompressionType(200))
+	require.Error(t,err)
+}
+
+func TestCompressBlock(t *testing.T){
+	text := bytes.Repeat([]byte("compressible "),100)
+	stored, typ := compressBlock(CompressionTypeLZ4,text,nil)
+	require.Equal(t,CompressionTypeLZ4,typ)
+	out, err := decompressBlock(typ,stored,nil)
+	require.NoError(t,err)
+	require.Equal(t,text,out)
+
+	// not worth it, so kept as it is
+	random := make([]byte,1000)
+	rand.New(rand.NewSource(1)).Read(random)
+	stored, typ = compressBlock(CompressionTypeZlib,random,nil)
+	require.Equal(t,CompressionTypeNone,typ)
+	require.Equal(t,random,stored)
+}
+
+func TestSSTCompression(t *testing.T){
+	dir := t.TempDir() + "/"
+	rng := rand.New(rand.NewSource(1))
+	sizes := map[CompressionType]int64{}
+	for _,typ := range []CompressionType{CompressionTypeNone,CompressionTypeFlate,CompressionTypeZlib,CompressionTypeLZ4}{
+		builder := NewSSTBuilder(1024)
+		builder.SetCompression(typ)
+		for i := 0; i < 500; i++{
+			value := []byte(fmt.Sprintf("value-%d-%s",i%10,bytes.Repeat([]byte{'v'},50)))
+			if i%50 == 0{
+				// a few blocks don't compress
+				value = make([]byte,900)
+				rng.Read(value)
+			}
+			builder.Add([]byte(fmt.Sprintf("key%04d",i)),value)
+		}
+		path := fmt.Sprintf("%s%d.sst",dir,typ)
+		built := builder.Build(int(typ),path)
+		require.Equal(t,500,countEntries(built))
+
+		fw, err := OpenFileWrapper(path)
+		require.NoError(t,err)
+		sst, err := OpenSSTable(int(typ),fw,nil)
+		require.NoError(t,err)
+		iter := CreateSSTIterAndSeekToKey(sst,[]byte("key0123"))
+		require.Equal(t,"key0123",string(iter.Key()))
+		require.Equal(t,fmt.Sprintf("value-3-%s",bytes.Repeat([]byte{'v'},50)),string(iter.Value()))
+		require.Equal(t,500,countEntries(sst))
+
+		info, err := os.Stat(path)
+		require.NoError(t,err)
+		sizes[typ] = info.Size()
+	}
+	for _,typ := range []CompressionType{CompressionTypeFlate,CompressionTypeZlib,CompressionTypeLZ4}{
+		require.Less(t,sizes[typ]*2,sizes[CompressionTypeNone])
+	}
+}
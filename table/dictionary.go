@@ -0,0 +1,147 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+const (
+	// bytes of the substrings counted across samples
+	dictKmerLen = 6
+	// bytes of the segments a dictionary is made of
+	dictSegmentLen = 64
+)
+
+// TrainDictionary builds a dictionary of at most size bytes for compressing
+// data like the samples. Like zstd's cover algorithm it is made of the
+// segments of the samples whose substrings recur across the most samples,
+// a substring only counting for the first segment picked with it. The
+// samples are split into epochs, each giving a segment in turn, so the
+// dictionary covers all of them.
+func TrainDictionary(samples [][]byte, size int) []byte{
+	kmer := func(b []byte) uint64{
+		var k uint64
+		for _,c := range b[:dictKmerLen]{
+			k = k<<8 | uint64(c)
+		}
+		return k
+	}
+	// samples holding each substring
+	freqs := make(map[uint64]int)
+	seen := make(map[uint64]bool)
+	for _,s := range samples{
+		clear(seen)
+		for i := 0; i+dictKmerLen <= len(s); i++{
+			if k := kmer(s[i:]); !seen[k]{
+				seen[k] = true
+				freqs[k]++
+			}
+		}
+	}
+	score := func(k uint64) int{
+		// substrings of a single sample don't help compress others
+		if f := freqs[k]; f > 1{
+			return f
+		}
+		return 0
+	}
+	// bestSegment returns the segment of s scoring highest and its score
+	bestSegment := func(s []byte) ([]byte,int){
+		if len(s) < dictKmerLen{
+			return nil,0
+		}
+		segLen := min(dictSegmentLen,len(s))
+		kmers := segLen-dictKmerLen+1
+		sum := 0
+		for i := 0; i < kmers; i++{
+			sum += score(kmer(s[i:]))
+		}
+		best, bestScore := 0, sum
+		for start := 1; start+segLen <= len(s); start++{
+			sum -= score(kmer(s[start-1:]))
+			sum += score(kmer(s[start+kmers-1:]))
+			if sum > bestScore{
+				best, bestScore = start, sum
+			}
+		}
+		return s[best:best+segLen],bestScore
+	}
+
+	type segment struct{
+		data []byte
+		score int
+	}
+	var segments []segment
+	total := 0
+	epochs := max(1,min(len(samples),size/dictSegmentLen))
+	for picked := true; picked && total < size;{
+		picked = false
+		for e := 0; e < epochs && total < size; e++{
+			var best []byte
+			bestScore := 0
+			for i := e; i < len(samples); i += epochs{
+				if seg, score := bestSegment(samples[i]); score > bestScore{
+					best, bestScore = seg, score
+				}
+			}
+			if best==nil{
+				continue
+			}
+			for i := 0; i+dictKmerLen <= len(best); i++{
+				delete(freqs,kmer(best[i:]))
+			}
+			segments = append(segments, segment{data: best, score: bestScore})
+			total += len(best)
+			picked = true
+		}
+	}
+	// the end of a dictionary is the cheapest to refer to, so the best
+	// segments go last
+	sort.SliceStable(segments,func(i, j int) bool{
+		return segments[i].score < segments[j].score
+	})
+	dict := make([]byte,0,total)
+	for _,seg := range segments{
+		dict = append(dict, seg.data...)
+	}
+	return dict[max(0,len(dict)-size):]
+}
+
+/*
+Compression Dictionary Block Encoding
+------------------------------------------------------------------------
+| compression type (u8) | dictionary | checksum (u32) | size (u32) |
+------------------------------------------------------------------------
+Blocks of the compression type are compressed with the dictionary. A table
+without a dictionary has an empty block, just the trailer.
+*/
+
+const COMPRESSION_DICT_TRAILER_SIZE = 8
+
+func encodeCompressionDictBlock(t CompressionType, dict []byte) []byte{
+	var buf []byte
+	if dict!=nil{
+		buf = append(buf, byte(t))
+		buf = append(buf, dict...)
+	}
+	size := len(buf)
+	buf = binary.BigEndian.AppendUint32(buf,crc32.ChecksumIEEE(buf))
+	return binary.BigEndian.AppendUint32(buf,uint32(size))
+}
+
+func decodeCompressionDictBlock(data []byte) (CompressionType,[]byte,error){
+	if len(data) < COMPRESSION_DICT_TRAILER_SIZE{
+		return CompressionTypeNone,nil,fmt.Errorf("compression dictionary block too small")
+	}
+	checksum := binary.BigEndian.Uint32(data[len(data)-COMPRESSION_DICT_TRAILER_SIZE:])
+	data = data[:len(data)-COMPRESSION_DICT_TRAILER_SIZE]
+	if checksum != crc32.ChecksumIEEE(data){
+		return CompressionTypeNone,nil,fmt.Errorf("compression dictionary block checksum mismatched")
+	}
+	if len(data) == 0{
+		return CompressionTypeNone,nil,nil
+	}
+	return CompressionType(data[0]),append([]byte{},data[1:]...),nil
+}
@@ -0,0 +1,82 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func jsonDocument(rng *rand.Rand, i int) []byte{
+	return []byte(fmt.Sprintf(`{"id":%d,"type":"order","status":%q,"customer":{"name":"customer-%d","country":%q},"total":%d.%02d}`,
+		i,[]string{"pending","shipped","delivered"}[rng.Intn(3)],rng.Intn(1000),[]string{"DE","FR","US"}[rng.Intn(3)],rng.Intn(500),rng.Intn(100)))
+}
+
+func TestTrainDictionary(t *testing.T){
+	rng := rand.New(rand.NewSource(1))
+	var samples [][]byte
+	for i := 0; i < 1000; i++{
+		samples = append(samples, jsonDocument(rng,i))
+	}
+	dict := TrainDictionary(samples,1024)
+	require.LessOrEqual(t,len(dict),1024)
+	require.Contains(t,string(dict),`"customer":{"name":"customer-`)
+
+	// a small block of documents the dictionary wasn't trained on
+	var doc []byte
+	for i := 1000; i < 1003; i++{
+		doc = append(doc, jsonDocument(rng,i)...)
+	}
+	for _,typ := range []CompressionType{CompressionTypeFlate,CompressionTypeZlib,CompressionTypeLZ4}{
+		c, err := codecFor(typ)
+		require.NoError(t,err)
+		dc := c.(DictCodec)
+		withDict := dc.CompressDict(nil,doc,dict)
+		out, err := dc.DecompressDict(withDict,dict)
+		require.NoError(t,err)
+		require.Equal(t,doc,out)
+		require.Less(t,len(withDict)*3,len(c.Compress(nil,doc))*2,typ)
+	}
+
+	require.Empty(t,TrainDictionary(nil,1024))
+	require.Empty(t,TrainDictionary([][]byte{[]byte("one sample only")},1024))
+}
+
+func TestSSTCompressionDict(t *testing.T){
+	dir := t.TempDir() + "/"
+	build := func(id int, dictSize int) *SSTable{
+		rng := rand.New(rand.NewSource(1))
+		builder := NewSSTBuilder(256)
+		builder.SetCompression(CompressionTypeLZ4)
+		builder.SetCompressionDictSize(dictSize)
+		for i := 0; i < 2000; i++{
+			builder.Add([]byte(fmt.Sprintf("order%05d",i)),jsonDocument(rng,i))
+		}
+		return builder.Build(id,fmt.Sprintf("%s%d.sst",dir,id))
+	}
+	plain := build(0,0)
+	require.Zero(t,plain.Properties().CompressionDictSize)
+	// blocks written before and after the dictionary was trained
+	built := build(1,1024)
+	props := built.Properties()
+	require.Equal(t,uint64(1024),props.CompressionDictSize)
+	require.Equal(t,plain.Properties().RawDataSize,props.RawDataSize)
+	require.Greater(t,props.CompressionRatio(),plain.Properties().CompressionRatio()*1.5)
+
+	fw, err := OpenFileWrapper(dir + "1.sst")
+	require.NoError(t,err)
+	sst, err := OpenSSTable(1,fw,nil)
+	require.NoError(t,err)
+	require.Equal(t,props,sst.Properties())
+	rng := rand.New(rand.NewSource(1))
+	iter := CreateSSTIterAndSeekToFirst(sst)
+	for i := 0; i < 2000; i++{
+		require.True(t,iter.IsValid())
+		require.Equal(t,fmt.Sprintf("order%05d",i),string(iter.Key()))
+		require.True(t,bytes.Equal(jsonDocument(rng,i),iter.Value()))
+		iter.Next()
+	}
+	require.False(t,iter.IsValid())
+}
@@ -1,6 +1,8 @@
 package table
 
 import (
+	"encoding/binary"
+	"fmt"
 	"time"
 )
 
@@ -11,10 +13,27 @@ type OldEntry struct{
 	timestamp int64
 }
 
+// ValueKind tags what an InternalValue holds. It is written as the first
+// byte of every value stored in an SST block.
+type ValueKind uint8
+
+const(
+	KindValue ValueKind = iota
+	KindDelete
+	KindMerge
+	// the value is in a blob file, the payload is its BlobRef
+	KindBlob
+)
+
 type InternalValue struct{
 	value []byte
 	seq uint64
-	tombstone bool
+	// application supplied timestamp, the version is visible to reads at ts or later
+	ts uint64
+	kind ValueKind
+	// pending merge operands, oldest first. For KindValue and KindDelete
+	// they apply on top of the value, for KindMerge there is no base yet.
+	operands [][]byte
 }
 type Entry struct{
 	key []byte
@@ -42,6 +61,93 @@ type Entry struct{
 	return 0
 }*/
 func (i *InternalValue) Value() []byte{return i.value}
+func (i *InternalValue) Kind() ValueKind{return i.kind}
+func (i *InternalValue) Operands() [][]byte{return i.operands}
+
+func (i *InternalValue) Seq() uint64{return i.seq}
+func (i *InternalValue) Timestamp() uint64{return i.ts}
+
+/*
+Encoded Internal Value
+----------------------------------------------------------------------------------------------------------
+| kind (1B) | seq (varint) | ts (varint) | KindValue: value | KindMerge: count (varint) | len (varint) | op | ... |
+----------------------------------------------------------------------------------------------------------
+KindBlob carries an encoded BlobRef and KindDelete no payload. Operands still pending on a value must be
+collapsed before it is encoded.
+*/
+func (i *InternalValue) Encode() []byte{
+	buf := make([]byte, 0, len(i.value)+1+binary.MaxVarintLen64)
+	buf = append(buf, byte(i.kind))
+	buf = binary.AppendUvarint(buf,i.seq)
+	buf = binary.AppendUvarint(buf,i.ts)
+	switch i.kind{
+	case KindMerge:
+		buf = binary.AppendUvarint(buf,uint64(len(i.operands)))
+		for _,op := range i.operands{
+			buf = binary.AppendUvarint(buf,uint64(len(op)))
+			buf = append(buf, op...)
+		}
+		return buf
+	case KindDelete:
+		return buf
+	default:
+		return append(buf, i.value...)
+	}
+}
+
+// peekInternalValue returns the kind, sequence number and timestamp of an
+// encoded internal value without decoding the rest, ok false if it isn't one.
+func peekInternalValue(data []byte) (ValueKind,uint64,uint64,bool){
+	if len(data)==0 || ValueKind(data[0]) > KindBlob{
+		return 0,0,0,false
+	}
+	seq, n := binary.Uvarint(data[1:])
+	if n <= 0{
+		return 0,0,0,false
+	}
+	ts, m := binary.Uvarint(data[1+n:])
+	return ValueKind(data[0]),seq,ts,m > 0
+}
+
+func DecodeInternalValue(data []byte) (*InternalValue,error){
+	if len(data)==0{
+		return nil,fmt.Errorf("empty internal value")
+	}
+	kind := ValueKind(data[0])
+	seq, n := binary.Uvarint(data[1:])
+	if n <= 0{
+		return nil,fmt.Errorf("invalid sequence number")
+	}
+	data = data[1+n:]
+	ts, n := binary.Uvarint(data)
+	if n <= 0{
+		return nil,fmt.Errorf("invalid timestamp")
+	}
+	data = data[n:]
+	switch kind{
+	case KindValue, KindBlob:
+		return &InternalValue{value: data, seq: seq, ts: ts, kind: kind},nil
+	case KindDelete:
+		return &InternalValue{seq: seq, ts: ts, kind: KindDelete},nil
+	case KindMerge:
+		count, n := binary.Uvarint(data)
+		if n <= 0{
+			return nil,fmt.Errorf("invalid merge operand count")
+		}
+		data = data[n:]
+		operands := make([][]byte,0,count)
+		for j:=uint64(0);j<count;j++{
+			opLen, n := binary.Uvarint(data)
+			if n <= 0 || uint64(len(data)-n) < opLen{
+				return nil,fmt.Errorf("invalid merge operand %d",j)
+			}
+			operands = append(operands, data[n:n+int(opLen)])
+			data = data[n+int(opLen):]
+		}
+		return &InternalValue{seq: seq, ts: ts, kind: KindMerge, operands: operands},nil
+	}
+	return nil,fmt.Errorf("unknown value kind %d",kind)
+}
 func (e *OldEntry) SetKey(key []byte){ e.key = string(key)}
 func (e *OldEntry) SetValue(value []byte){ e.value = value}
 
@@ -49,9 +155,12 @@ func BuildEntry(key []byte, value []byte) *Entry{
 	entry := Entry{
 		key: key,
 		internalValue: &InternalValue{
-			tombstone: value==nil,
+			kind: KindValue,
 		},
 	}
+	if value==nil{
+		entry.internalValue.kind = KindDelete
+	}
 	if len(value)>0{
 		entry.internalValue.value = value
 	}
@@ -64,6 +173,23 @@ func BuildEntryWithSeqNo(key []byte, value []byte, seqNo uint64) *Entry{
 	return entry
 }
 
+func BuildEntryWithTimestamp(key []byte, value []byte, seqNo uint64, ts uint64) *Entry{
+	entry := BuildEntryWithSeqNo(key,value,seqNo)
+	entry.internalValue.ts = ts
+	return entry
+}
+
+func BuildMergeEntryWithSeqNo(key []byte, operand []byte, seqNo uint64) *Entry{
+	return &Entry{
+		key: key,
+		internalValue: &InternalValue{
+			seq: seqNo,
+			kind: KindMerge,
+			operands: [][]byte{operand},
+		},
+	}
+}
+
 func (e *Entry) InternalValue() *InternalValue{
 	return e.internalValue
 }
@@ -73,7 +199,7 @@ func (e *Entry) Key() []byte{
 }
 
 func (e *Entry) IsTombstone() bool{
-	return e.internalValue.tombstone
+	return e.internalValue.kind == KindDelete
 }
 
 func (e *Entry) SeqNo() uint64{
@@ -2,15 +2,31 @@ package table
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 )
 
 type FileWrapper struct{
+	// nil once the file is mapped
 	file *os.File
+	path string
 	size int64
+	// the mapped file, nil unless Map was called
+	data []byte
 }
 
+// AccessPattern is how a mapped file is expected to be read, passed on to
+// the kernel so it can read ahead or not.
+type AccessPattern int
+
+const (
+	// point lookups, the default for mapped tables
+	AccessRandom AccessPattern = iota
+	// full scans, such as compaction inputs
+	AccessSequential
+)
+
 func OpenFileWrapper(path string) (*FileWrapper,error){
 	file, err := os.OpenFile(path, os.O_RDONLY, 0644)
 	if err != nil {
@@ -21,7 +37,7 @@ func OpenFileWrapper(path string) (*FileWrapper,error){
 		file.Close()
 		return nil, fmt.Errorf("failed to get stats: %w", err)
 	}
-	return &FileWrapper{ file: file, size: stat.Size()},nil
+	return &FileWrapper{ file: file, path: path, size: stat.Size()},nil
 }
 
 func CreateFileWrapper(path string, data []byte) (*FileWrapper, error) {
@@ -64,12 +80,72 @@ func CreateFileWrapper(path string, data []byte) (*FileWrapper, error) {
 	}
 
 	// Return the FileWrapper
-	return &FileWrapper{size: stat.Size(), file: file}, nil
+	return &FileWrapper{size: stat.Size(), file: file, path: path}, nil
 }
 
 
+// ReadAt returns a copy of len bytes at offset, safe to keep after the file
+// is closed.
 func (f *FileWrapper) ReadAt(offset int64, len int) []byte{
 	buf := make([]byte, len)
+	if f.data!=nil{
+		if offset >= 0 && offset <= int64(cap(f.data)){
+			copy(buf,f.data[offset:])
+		}
+		return buf
+	}
 	_,_ = f.file.ReadAt(buf,offset)
 	return buf
-}
\ No newline at end of file
+}
+
+// Slice returns len bytes at offset, straight from the mapping when the file
+// is mapped, so they are only valid until the file is closed. It returns nil
+// if they are not all in the file.
+func (f *FileWrapper) Slice(offset int64, len int) []byte{
+	if offset < 0 || len < 0 || offset+int64(len) > f.size{
+		return nil
+	}
+	if f.data!=nil{
+		return f.data[offset:offset+int64(len)]
+	}
+	buf := make([]byte, len)
+	if _, err := f.file.ReadAt(buf,offset); err!=nil{
+		return nil
+	}
+	return buf
+}
+
+// Map memory-maps the file, advised for random access, and closes its
+// descriptor, which the mapping doesn't need.
+func (f *FileWrapper) Map() error{
+	data, err := mmapFile(f)
+	if err!=nil{
+		return err
+	}
+	f.data = data
+	if err := madviseFile(data,AccessRandom); err!=nil{
+		log.Printf("failed to advise %s: %v",f.path,err)
+	}
+	err = f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Advise tells the kernel how a mapped file will be read. It does nothing
+// for a file that isn't mapped.
+func (f *FileWrapper) Advise(p AccessPattern) error{
+	if f.data==nil{
+		return nil
+	}
+	return madviseFile(f.data,p)
+}
+// Close closes the file or unmaps it, after which nothing sliced from the
+// mapping may be read.
+func (f *FileWrapper) Close() error{
+	if f.data!=nil{
+		data := f.data
+		f.data = nil
+		return munmapFile(data)
+	}
+	return f.file.Close()
+}
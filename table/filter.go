@@ -0,0 +1,196 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// FilterType is recorded at the start of the filter block, so tables are read
+// with the filter they were written with whatever the current policy is.
+type FilterType uint8
+
+const (
+	FilterTypeBloom FilterType = iota
+	FilterTypeBlockedBloom
+)
+
+// Filter answers whether a table may hold a key (or key prefix), with false
+// positives but no false negatives.
+type Filter interface{
+	Type() FilterType
+	MayContainKey(key []byte) bool
+	// Encode appends the filter to dst, without the type.
+	Encode(dst []byte) []byte
+}
+
+// FilterPolicy decides which filter new tables are built with.
+type FilterPolicy interface{
+	Type() FilterType
+	HashKey(key []byte) uint64
+	// Build builds a filter over the key hashes, 0 bitsPerKey meaning the
+	// policy's default.
+	Build(hashes []uint64, bitsPerKey int) Filter
+}
+
+// BloomFilterPolicy builds the classic BloomFilter, which probes bits across
+// the whole filter.
+type BloomFilterPolicy struct{}
+
+func (BloomFilterPolicy) Type() FilterType{
+	return FilterTypeBloom
+}
+
+func (BloomFilterPolicy) HashKey(key []byte) uint64{
+	return uint64(hashKey(key))
+}
+
+func (BloomFilterPolicy) Build(hashes []uint64, bitsPerKey int) Filter{
+	hashes32 := make([]uint32,len(hashes))
+	for i,h := range hashes{
+		hashes32[i] = uint32(h)
+	}
+	if bitsPerKey > 0{
+		return BuildFromKeyHashesWithBitsPerKey(hashes32,bitsPerKey)
+	}
+	return BuildFromKeyHashes(hashes32,0.01)
+}
+
+func (bf *BloomFilter) Type() FilterType{
+	return FilterTypeBloom
+}
+
+func (bf *BloomFilter) MayContainKey(key []byte) bool{
+	return bf.MayContain(hashKey(key))
+}
+
+// BlockedBloomFilterPolicy builds a BlockedBloomFilter, which keeps every
+// probe of a key within one cache line.
+type BlockedBloomFilterPolicy struct{}
+
+const (
+	// bits in a 64 byte cache line
+	blockedBloomBlockBits = 512
+	blockedBloomBlockBytes = blockedBloomBlockBits/8
+	blockedBloomDefaultBitsPerKey = 10
+)
+
+func (BlockedBloomFilterPolicy) Type() FilterType{
+	return FilterTypeBlockedBloom
+}
+
+func (BlockedBloomFilterPolicy) HashKey(key []byte) uint64{
+	return xxhash.Sum64(key)
+}
+
+func (BlockedBloomFilterPolicy) Build(hashes []uint64, bitsPerKey int) Filter{
+	if bitsPerKey <= 0{
+		bitsPerKey = blockedBloomDefaultBitsPerKey
+	}
+	// a key's probes can't spread over the whole filter, so a little
+	// fewer than the optimal ln2 * bits per key do best
+	k := int(math.Round(float64(bitsPerKey) * 0.6))
+	k = min(max(k,1),16)
+	numBlocks := (len(hashes)*bitsPerKey + blockedBloomBlockBits-1) / blockedBloomBlockBits
+	numBlocks = max(numBlocks,1)
+
+	f := &BlockedBloomFilter{filter: make([]byte,numBlocks*blockedBloomBlockBytes), k: uint8(k)}
+	for _,h := range hashes{
+		f.probe(h,func(block []byte, bit uint32) bool{
+			block[bit/8] |= 1 << (bit%8)
+			return true
+		})
+	}
+	return f
+}
+
+// BlockedBloomFilter is a bloom filter split into cache line sized blocks. The
+// top half of a key's hash picks the block and the bottom half the bits in
+// it, so a lookup costs a single cache miss.
+type BlockedBloomFilter struct{
+	filter []byte
+	k uint8
+}
+
+// probe calls fn with each bit of the key hash h, stopping if it returns false.
+func (f *BlockedBloomFilter) probe(h uint64, fn func(block []byte, bit uint32) bool) bool{
+	numBlocks := uint64(len(f.filter)/blockedBloomBlockBytes)
+	// maps the top half of h onto [0, numBlocks) without a division
+	blockIdx := ((h>>32) * numBlocks) >> 32
+	block := f.filter[blockIdx*blockedBloomBlockBytes:(blockIdx+1)*blockedBloomBlockBytes]
+	h32 := uint32(h)
+	for i := 0; i < int(f.k); i++{
+		// the top 9 bits address a bit in the block
+		if !fn(block,h32>>23){
+			return false
+		}
+		h32 *= 0x9e3779b9
+	}
+	return true
+}
+
+func (f *BlockedBloomFilter) Type() FilterType{
+	return FilterTypeBlockedBloom
+}
+
+func (f *BlockedBloomFilter) MayContainKey(key []byte) bool{
+	if len(f.filter) == 0{
+		return true
+	}
+	return f.probe(xxhash.Sum64(key),func(block []byte, bit uint32) bool{
+		return block[bit/8] & (1 << (bit%8)) != 0
+	})
+}
+
+// Encode appends (filter||k||crc32(filter||k)) to dst.
+func (f *BlockedBloomFilter) Encode(dst []byte) []byte{
+	start := len(dst)
+	dst = append(dst, f.filter...)
+	dst = append(dst, f.k)
+	return binary.BigEndian.AppendUint32(dst,crc32.ChecksumIEEE(dst[start:]))
+}
+
+func DecodeBlockedBloom(buf []byte) (*BlockedBloomFilter,error){
+	if len(buf) < bloomChecksumSize+bloomKSize{
+		return nil, fmt.Errorf("buffer too small for blocked bloom")
+	}
+	crcOff := len(buf) - bloomChecksumSize
+	data := buf[:crcOff]
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(buf[crcOff:]){
+		return nil, fmt.Errorf("blocked bloom checksum mismatch")
+	}
+	filter := data[:len(data)-1]
+	if len(filter)%blockedBloomBlockBytes != 0{
+		return nil, fmt.Errorf("blocked bloom size %d is not a multiple of %d",len(filter),blockedBloomBlockBytes)
+	}
+	return &BlockedBloomFilter{filter: append([]byte{},filter...), k: data[len(data)-1]},nil
+}
+
+/*
+Filter Block Encoding
+----------------------------------
+| filter type (1B) | filter data |
+----------------------------------
+*/
+
+func encodeFilterBlock(dst []byte, f Filter) []byte{
+	dst = append(dst, byte(f.Type()))
+	return f.Encode(dst)
+}
+
+func decodeFilterBlock(buf []byte) (Filter,error){
+	if len(buf) == 0{
+		return nil, fmt.Errorf("empty filter block")
+	}
+	switch FilterType(buf[0]){
+	case FilterTypeBloom:
+		return DecodeBloom(buf[1:])
+	case FilterTypeBlockedBloom:
+		return DecodeBlockedBloom(buf[1:])
+	default:
+		return nil, fmt.Errorf("unknown filter type %d",buf[0])
+	}
+}
@@ -0,0 +1,139 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// tableMagic ends every table written with a versioned footer, "anchordb".
+const tableMagic uint64 = 0x616e63686f726462
+
+// Format versions of tables. A reader opens every version up to
+// CurrentFormatVersion and refuses newer ones instead of misreading them.
+const (
+	// footer of just the meta and filter offsets, before the magic
+	FormatVersionLegacy uint32 = iota
+	FormatVersion1
+	// block metas with sizes and a checksum
+	FormatVersion2
+	// block metas with a separator instead of their first and last keys
+	FormatVersion3
+	// partitioned indexes with a checksum
+	FormatVersion4
+	CurrentFormatVersion = FormatVersion4
+)
+
+// ChecksumType is the checksum the blocks of a table end in.
+type ChecksumType uint8
+
+const (
+	ChecksumTypeNone ChecksumType = iota
+	ChecksumTypeCRC32
+)
+
+type blockHandle struct{
+	offset uint64
+	size uint64
+}
+
+func (h blockHandle) end() uint64{
+	return h.offset+h.size
+}
+
+type footer struct{
+	index blockHandle
+	filter blockHandle
+	properties blockHandle
+	formatVersion uint32
+	checksumType ChecksumType
+}
+
+/*
+Footer Encoding
+---------------------------------------------------------------------------------------------------------------------------
+| index handle | filter handle | properties handle | format version (u32) | checksum type (u8) | checksum (u32) | magic (u64) |
+---------------------------------------------------------------------------------------------------------------------------
+| Handle: offset (u64) | size (u64) |
+--------------------------------------
+The checksum covers the footer before it. The footer has a fixed size, so it
+is found at the end of the file whatever its version, and the magic tells
+it from the legacy footer.
+*/
+
+const (
+	BLOCK_HANDLE_SIZE = 16
+	FOOTER_SIZE = 3*BLOCK_HANDLE_SIZE + 4 + 1 + 4 + 8
+	LEGACY_FOOTER_SIZE = META_OFFSET_SIZE + FILTER_OFFSET_SIZE
+)
+
+func appendBlockHandle(buf []byte, h blockHandle) []byte{
+	buf = binary.BigEndian.AppendUint64(buf,h.offset)
+	return binary.BigEndian.AppendUint64(buf,h.size)
+}
+
+func decodeBlockHandle(buf []byte) blockHandle{
+	return blockHandle{
+		offset: binary.BigEndian.Uint64(buf),
+		size: binary.BigEndian.Uint64(buf[8:]),
+	}
+}
+
+func encodeFooter(buf []byte, f footer) []byte{
+	start := len(buf)
+	buf = appendBlockHandle(buf,f.index)
+	buf = appendBlockHandle(buf,f.filter)
+	buf = appendBlockHandle(buf,f.properties)
+	buf = binary.BigEndian.AppendUint32(buf,f.formatVersion)
+	buf = append(buf, byte(f.checksumType))
+	buf = binary.BigEndian.AppendUint32(buf,crc32.ChecksumIEEE(buf[start:]))
+	return binary.BigEndian.AppendUint64(buf,tableMagic)
+}
+
+// readFooter reads the footer of a table, making one up from the offsets of
+// a legacy footer.
+func readFooter(f *FileWrapper) (footer,error){
+	var ft footer
+	if buf := f.Slice(f.size-FOOTER_SIZE,FOOTER_SIZE); buf!=nil && binary.BigEndian.Uint64(buf[FOOTER_SIZE-8:]) == tableMagic{
+		crcOff := FOOTER_SIZE-8-4
+		if crc32.ChecksumIEEE(buf[:crcOff]) != binary.BigEndian.Uint32(buf[crcOff:]){
+			return ft,fmt.Errorf("%w: footer checksum mismatched",ErrCorruption)
+		}
+		ft.index = decodeBlockHandle(buf)
+		ft.filter = decodeBlockHandle(buf[BLOCK_HANDLE_SIZE:])
+		ft.properties = decodeBlockHandle(buf[2*BLOCK_HANDLE_SIZE:])
+		ft.formatVersion = binary.BigEndian.Uint32(buf[3*BLOCK_HANDLE_SIZE:])
+		ft.checksumType = ChecksumType(buf[3*BLOCK_HANDLE_SIZE+4])
+		if ft.formatVersion > CurrentFormatVersion{
+			return ft,fmt.Errorf("table format version %d is newer than the supported %d",ft.formatVersion,CurrentFormatVersion)
+		}
+		if ft.checksumType != ChecksumTypeCRC32{
+			return ft,fmt.Errorf("%w: unknown checksum type %d",ErrCorruption,ft.checksumType)
+		}
+		for _,h := range []blockHandle{ft.index,ft.filter,ft.properties}{
+			if h.end() > uint64(f.size-FOOTER_SIZE){
+				return ft,fmt.Errorf("%w: block handle %d+%d past the end of the table",ErrCorruption,h.offset,h.size)
+			}
+		}
+		return ft,nil
+	}
+
+	buf := f.Slice(f.size-LEGACY_FOOTER_SIZE,LEGACY_FOOTER_SIZE)
+	if buf==nil{
+		return ft,fmt.Errorf("%w: table too small for a footer",ErrCorruption)
+	}
+	metaOffset := binary.BigEndian.Uint32(buf)
+	filterOffset := binary.BigEndian.Uint32(buf[META_OFFSET_SIZE:])
+	end := uint64(f.size-LEGACY_FOOTER_SIZE)
+	if metaOffset > filterOffset || uint64(filterOffset) > end{
+		return ft,fmt.Errorf("%w: invalid legacy footer",ErrCorruption)
+	}
+	ft.index = blockHandle{uint64(metaOffset),uint64(filterOffset-metaOffset)}
+	ft.filter = blockHandle{uint64(filterOffset),end-uint64(filterOffset)}
+	// the properties block ends where the meta starts
+	propertiesOffset := trailedBlockStart(f,metaOffset)
+	ft.properties = blockHandle{uint64(propertiesOffset),uint64(metaOffset-propertiesOffset)}
+	ft.formatVersion = FormatVersionLegacy
+	ft.checksumType = ChecksumTypeCRC32
+	return ft,nil
+}
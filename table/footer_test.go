@@ -0,0 +1,142 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func buildPropertiesTable(t *testing.T, path string) *SSTable{
+	builder := NewSSTBuilder(256)
+	builder.SetCompression(CompressionTypeLZ4)
+	builder.SetFilterPolicy(BlockedBloomFilterPolicy{})
+	for i := 0; i < 100; i++{
+		var value []byte
+		if i%10 != 0{
+			value = []byte(fmt.Sprintf("value%d",i))
+		}
+		entry := BuildEntryWithSeqNo([]byte(fmt.Sprintf("key%03d",i)),value,uint64(100+i))
+		builder.Add(entry.Key(),entry.InternalValue().Encode())
+	}
+	builder.AddRangeTombstone(NewRangeTombstone([]byte("key010"),[]byte("key020"),50))
+	return builder.Build(0,path)
+}
+
+func TestSSTProperties(t *testing.T){
+	path := t.TempDir() + "/0.sst"
+	before := time.Now().Unix()
+	sst := buildPropertiesTable(t,path)
+	props := sst.Properties()
+	require.Equal(t,uint64(100),props.NumEntries)
+	require.Equal(t,uint64(10),props.NumDeletions)
+	require.Equal(t,uint64(1),props.NumRangeDeletions)
+	require.Equal(t,uint64(600),props.RawKeySize)
+	require.Less(t,props.RawValueSize,uint64(100*20))
+	require.Equal(t,uint64(50),props.MinSeq)
+	require.Equal(t,uint64(199),props.MaxSeq)
+	require.GreaterOrEqual(t,props.CreationTime,before)
+	require.Equal(t,CompressionTypeLZ4,props.Compression)
+	require.Equal(t,FilterTypeBlockedBloom,props.FilterType)
+
+	fw, err := OpenFileWrapper(path)
+	require.NoError(t,err)
+	opened, err := OpenSSTable(0,fw,nil)
+	require.NoError(t,err)
+	require.Equal(t,props,opened.Properties())
+	require.Equal(t,100,countEntries(opened))
+	require.Len(t,opened.RangeTombstones(),1)
+}
+
+// rewriteFooter replaces the footer of the table at path with what replace
+// returns for it.
+func rewriteFooter(t *testing.T, path string, replace func(data []byte, ft footer) []byte){
+	data, err := os.ReadFile(path)
+	require.NoError(t,err)
+	fw, err := OpenFileWrapper(path)
+	require.NoError(t,err)
+	ft, err := readFooter(fw)
+	require.NoError(t,err)
+	fw.Close()
+	require.NoError(t,os.WriteFile(path,replace(data[:len(data)-FOOTER_SIZE],ft),0644))
+}
+
+// encodeLegacyBlockMetaData encodes block metas the way tables before
+// FormatVersion2 did, taking the separators around each block as its first
+// and last keys.
+func encodeLegacyBlockMetaData(firstKey []byte, blockMeta []BlockMeta) []byte{
+	buf := binary.BigEndian.AppendUint32(nil,uint32(len(blockMeta)))
+	for _,meta := range blockMeta{
+		buf = binary.BigEndian.AppendUint32(buf,meta.offset)
+		buf = binary.BigEndian.AppendUint16(buf,uint16(len(firstKey)))
+		buf = append(buf, firstKey...)
+		buf = binary.BigEndian.AppendUint16(buf,uint16(len(meta.separator)))
+		buf = append(buf, meta.separator...)
+		firstKey = meta.separator
+	}
+	return buf
+}
+
+func TestSSTLegacyFooter(t *testing.T){
+	path := t.TempDir() + "/0.sst"
+	sst := buildPropertiesTable(t,path)
+	r := sst.acquire()
+	blockMeta := r.blockMeta
+	sst.release(r)
+	// a table from before the versioned footer and block meta sizes
+	rewriteFooter(t,path,func(data []byte, ft footer) []byte{
+		filter := append([]byte{},data[ft.filter.offset:ft.filter.end()]...)
+		data = append(data[:ft.index.offset],indexTypeFlat)
+		data = append(data, encodeLegacyBlockMetaData(sst.GetFirstKey(),blockMeta)...)
+		filterOffset := len(data)
+		data = append(data, filter...)
+		data = binary.BigEndian.AppendUint32(data,uint32(ft.index.offset))
+		return binary.BigEndian.AppendUint32(data,uint32(filterOffset))
+	})
+	fw, err := OpenFileWrapper(path)
+	require.NoError(t,err)
+	ft, err := readFooter(fw)
+	require.NoError(t,err)
+	require.Equal(t,FormatVersionLegacy,ft.formatVersion)
+	opened, err := OpenSSTable(0,fw,nil)
+	require.NoError(t,err)
+	require.Equal(t,sst.Properties(),opened.Properties())
+	require.Equal(t,sst.Filter(),opened.Filter())
+	require.Equal(t,100,countEntries(opened))
+	iter := CreateSSTIterAndSeekToKey(opened,[]byte("key055"))
+	require.Equal(t,"key055",string(iter.Key()))
+}
+
+func TestSSTFooterRejected(t *testing.T){
+	dir := t.TempDir() + "/"
+	for name, replace := range map[string]func(data []byte, ft footer) []byte{
+		"newer version": func(data []byte, ft footer) []byte{
+			ft.formatVersion = CurrentFormatVersion+1
+			return encodeFooter(data,ft)
+		},
+		"unknown checksum type": func(data []byte, ft footer) []byte{
+			ft.checksumType = 9
+			return encodeFooter(data,ft)
+		},
+		"handle past the end": func(data []byte, ft footer) []byte{
+			ft.filter.size += 1000
+			return encodeFooter(data,ft)
+		},
+		"corrupt": func(data []byte, ft footer) []byte{
+			data = encodeFooter(data,ft)
+			data[len(data)-20] ^= 1
+			return data
+		},
+	}{
+		path := dir + name
+		buildPropertiesTable(t,path)
+		rewriteFooter(t,path,replace)
+		fw, err := OpenFileWrapper(path)
+		require.NoError(t,err)
+		_, err = OpenSSTable(0,fw,nil)
+		require.Error(t,err,name)
+	}
+}
@@ -0,0 +1,183 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"sort"
+)
+
+// The meta section starts with the kind of index that follows.
+const (
+	// every block meta, kept in memory while the table is open
+	indexTypeFlat byte = iota
+	// a top-level index of partitions, each holding the metas of a run of
+	// blocks and a filter over their keys, read through the block cache
+	indexTypePartitioned
+)
+
+/*
+Partitioned Index Encoding
+--------------------------------------------------------------------------------------------------------------------------
+| count (u32) |                                   Partition #1                                                   | ... |
+--------------------------------------------------------------------------------------------------------------------------
+|             | first block (u32) | blocks (u32) | index offset (u32) | index size (u32) | filter offset (u32) |       |
+|             | filter size (u32) | first_key_len (u16) | first_key | last_key_len (u16) | last_key              | ... |
+--------------------------------------------------------------------------------------------------------------------------
+| checksum (u32) |
+------------------
+The index of a partition is encoded as a flat block meta list, its filter as a
+filter block. Tables before FormatVersion4 have no checksum.
+*/
+
+type indexPartition struct{
+	firstBlock uint32
+	numBlocks uint32
+	indexOffset uint32
+	indexSize uint32
+	filterOffset uint32
+	filterSize uint32
+	firstKey []byte
+	lastKey []byte
+}
+
+func encodeIndexPartitions(partitions []indexPartition) []byte{
+	buf := binary.BigEndian.AppendUint32(nil,uint32(len(partitions)))
+	for _,p := range partitions{
+		for _,v := range []uint32{p.firstBlock,p.numBlocks,p.indexOffset,p.indexSize,p.filterOffset,p.filterSize}{
+			buf = binary.BigEndian.AppendUint32(buf,v)
+		}
+		buf = binary.BigEndian.AppendUint16(buf,uint16(len(p.firstKey)))
+		buf = append(buf, p.firstKey...)
+		buf = binary.BigEndian.AppendUint16(buf,uint16(len(p.lastKey)))
+		buf = append(buf, p.lastKey...)
+	}
+	return binary.BigEndian.AppendUint32(buf,crc32.ChecksumIEEE(buf))
+}
+
+func decodeIndexPartitions(data []byte, formatVersion uint32) ([]indexPartition,error){
+	errInvalid := fmt.Errorf("%w: invalid partitioned index",ErrCorruption)
+	if formatVersion >= FormatVersion4{
+		if len(data) < 4{
+			return nil,errInvalid
+		}
+		crcOff := len(data)-4
+		if crc32.ChecksumIEEE(data[:crcOff]) != binary.BigEndian.Uint32(data[crcOff:]){
+			return nil,fmt.Errorf("%w: partitioned index checksum mismatched",ErrCorruption)
+		}
+		data = data[:crcOff]
+	}
+	if len(data) < 4{
+		return nil,errInvalid
+	}
+	count := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	readKey := func() ([]byte,error){
+		if len(data) < 2{
+			return nil,errInvalid
+		}
+		l := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+l{
+			return nil,errInvalid
+		}
+		key := append([]byte{},data[2:2+l]...)
+		data = data[2+l:]
+		return key,nil
+	}
+	var partitions []indexPartition
+	for i := uint32(0); i < count; i++{
+		if len(data) < 24{
+			return nil,errInvalid
+		}
+		var fields [6]uint32
+		for j := range fields{
+			fields[j] = binary.BigEndian.Uint32(data[j*4:])
+		}
+		data = data[24:]
+		p := indexPartition{
+			firstBlock: fields[0],
+			numBlocks: fields[1],
+			indexOffset: fields[2],
+			indexSize: fields[3],
+			filterOffset: fields[4],
+			filterSize: fields[5],
+		}
+		var err error
+		if p.firstKey,err = readKey(); err!=nil{
+			return nil,err
+		}
+		if p.lastKey,err = readKey(); err!=nil{
+			return nil,err
+		}
+		partitions = append(partitions, p)
+	}
+	return partitions,nil
+}
+
+// blockMetaAt returns the meta of block idx, loading its index partition if
+// the index is partitioned.
+func (s *SSTable) blockMetaAt(r *tableReader, idx int) BlockMeta{
+	if r.partitions==nil{
+		return r.blockMeta[idx]
+	}
+	p := sort.Search(len(r.partitions),func(i int) bool{
+		return int(r.partitions[i].firstBlock+r.partitions[i].numBlocks) > idx
+	})
+	metas := s.loadIndexPartition(r,p)
+	if metas==nil{
+		return BlockMeta{}
+	}
+	return metas[idx-int(r.partitions[p].firstBlock)]
+}
+
+func (s *SSTable) loadIndexPartition(r *tableReader, p int) []BlockMeta{
+	part := r.partitions[p]
+	if cached, ok := s.cache.Get(s.Id,part.indexOffset); ok{
+		return cached.([]BlockMeta)
+	}
+	metas, _, err := decodeBlockMetaData(r.file.ReadAt(int64(part.indexOffset),int(part.indexSize)),r.formatVersion,s.comparator)
+	if err!=nil{
+		log.Printf("failed to read index partition %d of sstable %d: %v",p,s.Id,err)
+		return nil
+	}
+	if len(metas) != int(part.numBlocks){
+		log.Printf("index partition %d of sstable %d has %d blocks, expected %d",p,s.Id,len(metas),part.numBlocks)
+		return nil
+	}
+	s.cache.Insert(s.Id,part.indexOffset,metas,int(part.indexSize))
+	return metas
+}
+
+func (s *SSTable) loadFilterPartition(r *tableReader, p int) Filter{
+	part := r.partitions[p]
+	if cached, ok := s.cache.Get(s.Id,part.filterOffset); ok{
+		return cached.(Filter)
+	}
+	filter, err := decodeFilterBlock(r.file.ReadAt(int64(part.filterOffset),int(part.filterSize)))
+	if err!=nil{
+		log.Printf("failed to read filter partition %d of sstable %d: %v",p,s.Id,err)
+		return nil
+	}
+	s.cache.Insert(s.Id,part.filterOffset,filter,int(part.filterSize))
+	return filter
+}
+
+// partitionsMayContain checks key against the filters of the partitions whose
+// keys overlap [key, upper], upper being nil for key alone.
+func (s *SSTable) partitionsMayContain(r *tableReader, key []byte, upper []byte) bool{
+	if upper==nil{
+		upper = key
+	}
+	// a key's versions can span partitions, each of which has it in its filter
+	p := sort.Search(len(r.partitions),func(i int) bool{
+		return s.comparator.Compare(r.partitions[i].lastKey,key) >= 0
+	})
+	for ; p < len(r.partitions) && s.comparator.Compare(r.partitions[p].firstKey,upper) <= 0; p++{
+		filter := s.loadFilterPartition(r,p)
+		if filter==nil || filter.MayContainKey(key){
+			return true
+		}
+	}
+	return false
+}
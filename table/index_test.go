@@ -0,0 +1,146 @@
+package table
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testBlockMetas() []BlockMeta{
+	return []BlockMeta{
+		{offset: 0, size: 120, separator: []byte("c")},
+		// versions of c span the first two blocks
+		{offset: 120, size: 300, separator: []byte("c")},
+		{offset: 420, size: 70000, separator: []byte("m")},
+	}
+}
+
+func TestBlockMetaEncoding(t *testing.T){
+	metas := testBlockMetas()
+	encoded := encodeBlockMetaData([]byte("a"),metas)
+	decoded, firstKey, err := decodeBlockMetaData(encoded,CurrentFormatVersion,BytewiseComparator)
+	require.NoError(t,err)
+	require.Equal(t,metas,decoded)
+	require.Equal(t,"a",string(firstKey))
+
+	empty, _, err := decodeBlockMetaData(encodeBlockMetaData(nil,nil),CurrentFormatVersion,BytewiseComparator)
+	require.NoError(t,err)
+	require.Empty(t,empty)
+
+	// older tables have the last keys as separators
+	legacy, firstKey, err := decodeBlockMetaData(encodeLegacyBlockMetaData([]byte("a"),metas),FormatVersion1,BytewiseComparator)
+	require.NoError(t,err)
+	require.Equal(t,"a",string(firstKey))
+	for i := range metas{
+		require.Equal(t,metas[i].offset,legacy[i].offset)
+		require.Equal(t,metas[i].separator,legacy[i].separator)
+		require.Zero(t,legacy[i].size)
+	}
+
+	withChecksum := func(data []byte) []byte{
+		data = append([]byte{},data[:len(data)-4]...)
+		return binary.BigEndian.AppendUint32(data,crc32.ChecksumIEEE(data))
+	}
+	flipped := append([]byte{},encoded...)
+	flipped[5] ^= 1
+	swapped := testBlockMetas()
+	swapped[1].separator, swapped[2].separator = swapped[2].separator, swapped[1].separator
+	countTooLarge := withChecksum(append(binary.AppendUvarint(nil,1000),encoded[1:]...))
+	trailing := withChecksum(append(append([]byte{},encoded[:len(encoded)-4]...),0,0,0,0,0))
+	for name, data := range map[string][]byte{
+		"empty": nil,
+		"truncated": encoded[:len(encoded)/2],
+		"checksum": flipped,
+		"out of order": encodeBlockMetaData([]byte("a"),swapped),
+		"first key after separator": encodeBlockMetaData([]byte("d"),metas),
+		"count too large": countTooLarge,
+		"trailing bytes": trailing,
+	}{
+		_, _, err := decodeBlockMetaData(data,CurrentFormatVersion,BytewiseComparator)
+		require.ErrorIs(t,err,ErrCorruption,name)
+	}
+	legacyEncoded := encodeLegacyBlockMetaData([]byte("a"),metas)
+	for _,data := range [][]byte{nil,legacyEncoded[:3],legacyEncoded[:len(legacyEncoded)-1],encodeLegacyBlockMetaData([]byte("d"),metas)}{
+		_, _, err := decodeBlockMetaData(data,FormatVersionLegacy,BytewiseComparator)
+		require.ErrorIs(t,err,ErrCorruption)
+	}
+}
+
+func FuzzDecodeBlockMetaData(f *testing.F){
+	f.Add(encodeBlockMetaData([]byte("a"),testBlockMetas()),false)
+	f.Add(encodeBlockMetaData(nil,nil),false)
+	f.Add(encodeLegacyBlockMetaData([]byte("a"),testBlockMetas()),true)
+	f.Add([]byte{0xff,0xff,0xff,0xff},true)
+	f.Fuzz(func(t *testing.T, data []byte, legacy bool){
+		version := CurrentFormatVersion
+		if legacy{
+			version = FormatVersionLegacy
+		}
+		metas, firstKey, err := decodeBlockMetaData(data,version,BytewiseComparator)
+		if err!=nil{
+			require.ErrorIs(t,err,ErrCorruption)
+			return
+		}
+		// what decodes is valid, so it encodes back to the same metas
+		prev := firstKey
+		for i := range metas{
+			require.LessOrEqual(t,string(prev),string(metas[i].separator))
+			prev = metas[i].separator
+			if i > 0{
+				require.Greater(t,metas[i].offset,metas[i-1].offset)
+			}
+		}
+		again, againFirstKey, err := decodeBlockMetaData(encodeBlockMetaData(firstKey,metas),CurrentFormatVersion,BytewiseComparator)
+		require.NoError(t,err)
+		require.Equal(t,string(firstKey),string(againFirstKey))
+		require.Equal(t,len(metas),len(again))
+		for i := range metas{
+			require.Equal(t,metas[i].offset,again[i].offset)
+			require.Equal(t,metas[i].size,again[i].size)
+			require.Equal(t,string(metas[i].separator),string(again[i].separator))
+		}
+	})
+}
+
+func FuzzDecodeIndexPartitions(f *testing.F){
+	f.Add(encodeIndexPartitions([]indexPartition{
+		{firstBlock: 0, numBlocks: 4, indexOffset: 100, indexSize: 40, filterOffset: 140, filterSize: 20, firstKey: []byte("a"), lastKey: []byte("f")},
+		{firstBlock: 4, numBlocks: 2, indexOffset: 160, indexSize: 30, filterOffset: 190, filterSize: 20, firstKey: []byte("g"), lastKey: []byte("z")},
+	}))
+	f.Add([]byte{0,0,0,9})
+	f.Fuzz(func(t *testing.T, data []byte){
+		// older tables have no checksum, so garbage gets further
+		for _, version := range []uint32{CurrentFormatVersion,FormatVersion3}{
+			partitions, err := decodeIndexPartitions(data,version)
+			if err!=nil{
+				require.ErrorIs(t,err,ErrCorruption)
+				continue
+			}
+			again, err := decodeIndexPartitions(encodeIndexPartitions(partitions),CurrentFormatVersion)
+			require.NoError(t,err)
+			require.Equal(t,partitions,again)
+		}
+	})
+}
+
+func TestIndexPartitionsChecksum(t *testing.T){
+	partitions := []indexPartition{
+		{firstBlock: 0, numBlocks: 4, indexOffset: 100, indexSize: 40, filterOffset: 140, filterSize: 20, firstKey: []byte("a"), lastKey: []byte("f")},
+	}
+	encoded := encodeIndexPartitions(partitions)
+	decoded, err := decodeIndexPartitions(encoded,CurrentFormatVersion)
+	require.NoError(t,err)
+	require.Equal(t,partitions,decoded)
+	for i := range encoded{
+		corrupted := append([]byte{},encoded...)
+		corrupted[i] ^= 0x10
+		_, err := decodeIndexPartitions(corrupted,CurrentFormatVersion)
+		require.ErrorIs(t,err,ErrCorruption,"byte %d",i)
+	}
+	// the same partitions as written before FormatVersion4
+	decoded, err = decodeIndexPartitions(encoded[:len(encoded)-4],FormatVersion3)
+	require.NoError(t,err)
+	require.Equal(t,partitions,decoded)
+}
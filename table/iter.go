@@ -10,54 +10,128 @@ type StorageIterator interface{
 	Key() []byte
 	IsValid() bool
 	Next() error
+	// Error returns the error that stopped the iterator, a block that
+	// couldn't be read, nil if it ran out of entries.
+	Error() error
+}
+
+// BidirectionalIterator is a StorageIterator that can also walk backwards and
+// be repositioned, which lets the merge iterators switch direction.
+type BidirectionalIterator interface{
+	StorageIterator
+	Prev() error
+	SeekToFirst()
+	SeekToLast()
+	// SeekToKey moves to the first entry at or after key.
+	SeekToKey(key []byte)
+	// SeekForPrev moves to the last entry at or before key.
+	SeekForPrev(key []byte)
+}
+
+// seekPast moves iter to the first entry after every entry of key.
+func seekPast(iter BidirectionalIterator, key []byte) error{
+	iter.SeekToKey(key)
+	for iter.IsValid() && bytes.Equal(iter.Key(),key){
+		if err := iter.Next(); err!=nil{
+			return err
+		}
+	}
+	return nil
+}
+
+// seekBefore moves iter to the last entry before every entry of key.
+func seekBefore(iter BidirectionalIterator, key []byte) error{
+	iter.SeekToKey(key)
+	if !iter.IsValid(){
+		iter.SeekToLast()
+		return nil
+	}
+	return iter.Prev()
 }
 
 type HeapWrapper struct {
 	idx int
-	iterator StorageIterator
+	iterator BidirectionalIterator
 }
 
-type IteratorHeap []*HeapWrapper
+// IteratorHeap orders iterators by key and then index, as a min-heap or, for
+// backward iteration, a max-heap.
+type IteratorHeap struct{
+	wrappers []*HeapWrapper
+	reverse bool
+	cmp Comparator
+}
 
-func (h IteratorHeap) Len() int{ return len(h)}
+func (h IteratorHeap) Len() int{ return len(h.wrappers)}
 
 func (h IteratorHeap) Less(i,j int) bool { 
-	return bytes.Compare(h[i].iterator.Key(),h[j].iterator.Key()) < 0 ||
-	(bytes.Equal(h[i].iterator.Key(),h[j].iterator.Key()) && h[i].idx < h[j].idx)
+	a, b := h.wrappers[i], h.wrappers[j]
+	cmp := h.cmp.Compare(a.iterator.Key(),b.iterator.Key())
+	if h.reverse{
+		return cmp > 0 || (cmp == 0 && a.idx > b.idx)
+	}
+	return cmp < 0 || (cmp == 0 && a.idx < b.idx)
 }
 
-func (h IteratorHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
-func (h *IteratorHeap) Push(x interface{}){ *h = append(*h,x.(*HeapWrapper))}
+func (h IteratorHeap) Swap(i, j int) { h.wrappers[i], h.wrappers[j] = h.wrappers[j], h.wrappers[i] }
+func (h *IteratorHeap) Push(x interface{}){ h.wrappers = append(h.wrappers,x.(*HeapWrapper))}
 func (h *IteratorHeap) Pop() interface{}{
-	old := *h
+	old := h.wrappers
 	n:= len(old)
 	x:= old[n-1]
-	*h = old[:n-1]
+	h.wrappers = old[:n-1]
 	return x
 
 }
 
-// Iterator that merges iterators of same type (multiple memtable/sst/block iterators)
+// Iterator that merges iterators of same type (multiple memtable/sst/block iterators).
+// Going forward equal keys come in index order, going backward in reverse index order.
 type MergeIterator struct{
+	all []*HeapWrapper
 	iterators IteratorHeap
 	current *HeapWrapper 
+	cmp Comparator
+	// the error of an iterator that stopped, which stops the merge
+	err error
 }
 
-func NewMergeIterator[T StorageIterator](iters []T) *MergeIterator{
-	h := &IteratorHeap{}
-	heap.Init(h)
+func newMergeIterator[T BidirectionalIterator](iters []T, cmp Comparator, reverse bool) *MergeIterator{
+	m := &MergeIterator{cmp: comparatorOrDefault(cmp)}
 	for i, iter := range iters{
-		if iter.IsValid(){
-			heap.Push(h,&HeapWrapper{idx:i,iterator: iter})
+		m.all = append(m.all, &HeapWrapper{idx:i,iterator: iter})
+	}
+	m.rebuild(reverse)
+	return m
+}
+
+// NewMergeIterator merges iters, which must be positioned for forward
+// iteration and ordered by cmp, nil being BytewiseComparator.
+func NewMergeIterator[T BidirectionalIterator](iters []T, cmp Comparator) *MergeIterator{
+	return newMergeIterator(iters,cmp,false)
+}
+
+// NewReverseMergeIterator merges iters, which must be positioned for backward
+// iteration (at their last entry, or by SeekForPrev).
+func NewReverseMergeIterator[T BidirectionalIterator](iters []T, cmp Comparator) *MergeIterator{
+	return newMergeIterator(iters,cmp,true)
+}
+
+// rebuild heapifies the valid iterators in the given direction.
+func (m *MergeIterator) rebuild(reverse bool){
+	m.iterators = IteratorHeap{reverse: reverse, cmp: m.cmp}
+	m.current = nil
+	m.err = nil
+	for _, w := range m.all{
+		if w.iterator.IsValid(){
+			m.iterators.wrappers = append(m.iterators.wrappers, w)
+		} else if err := w.iterator.Error(); err!=nil && m.err==nil{
+			m.err = err
 		}
-	} 
-	m := &MergeIterator{
-		iterators: *h,
 	}
-	if h.Len() > 0{
-		m.current = heap.Pop(h).(*HeapWrapper)
+	heap.Init(&m.iterators)
+	if m.iterators.Len() > 0{
+		m.current = heap.Pop(&m.iterators).(*HeapWrapper)
 	}
-	return m
 }
 
 func (m *MergeIterator) Key() []byte{
@@ -69,15 +143,53 @@ func (m *MergeIterator) Value() []byte{
 }
 
 func (m *MergeIterator) IsValid() bool{
-	return m.current!=nil && m.current.iterator.IsValid()
+	return m.err==nil && m.current!=nil && m.current.iterator.IsValid()
 }
 
-func (m *MergeIterator) Next() error{
-	if !m.IsValid(){return nil}
-	if err:= m.current.iterator.Next(); err!=nil{
+func (m *MergeIterator) Error() error{
+	return m.err
+}
+
+func (m *MergeIterator) SeekToFirst(){
+	for _, w := range m.all{
+		w.iterator.SeekToFirst()
+	}
+	m.rebuild(false)
+}
+
+func (m *MergeIterator) SeekToKey(key []byte){
+	for _, w := range m.all{
+		w.iterator.SeekToKey(key)
+	}
+	m.rebuild(false)
+}
+
+func (m *MergeIterator) SeekToLast(){
+	for _, w := range m.all{
+		w.iterator.SeekToLast()
+	}
+	m.rebuild(true)
+}
+
+func (m *MergeIterator) SeekForPrev(key []byte){
+	for _, w := range m.all{
+		w.iterator.SeekForPrev(key)
+	}
+	m.rebuild(true)
+}
+
+// step moves the current iterator on and picks the next one from the heap.
+func (m *MergeIterator) step(move func() error) error{
+	if err := move(); err!=nil{
+		m.err = err
+		return err
+	}
+	if m.current.iterator.IsValid(){
+		heap.Push(&m.iterators,m.current)
+	} else if err := m.current.iterator.Error(); err!=nil{
+		m.err = err
 		return err
 	}
-	heap.Push(&m.iterators,m.current)
 	if m.iterators.Len() > 0{
 		m.current = heap.Pop(&m.iterators).(*HeapWrapper)
 	} else {
@@ -86,21 +198,91 @@ func (m *MergeIterator) Next() error{
 	return nil
 }
 
-//Iterator that merges two iterators of different types
+func (m *MergeIterator) Next() error{
+	if !m.IsValid(){return nil}
+	if !m.iterators.reverse{
+		return m.step(m.current.iterator.Next)
+	}
+	// switching direction: the entries after the current one are those past
+	// key in lower indexes and those at or after key in higher ones
+	key := append([]byte{},m.Key()...)
+	for _, w := range m.all{
+		if w == m.current{
+			continue
+		}
+		if w.idx < m.current.idx{
+			if err := seekPast(w.iterator,key); err!=nil{
+				return err
+			}
+		} else {
+			w.iterator.SeekToKey(key)
+		}
+	}
+	if err := m.current.iterator.Next(); err!=nil{
+		m.err = err
+		return err
+	}
+	m.rebuild(false)
+	return m.err
+}
+
+func (m *MergeIterator) Prev() error{
+	if !m.IsValid(){return nil}
+	if m.iterators.reverse{
+		return m.step(m.current.iterator.Prev)
+	}
+	// switching direction: the entries before the current one are those at or
+	// before key in lower indexes and those before key in higher ones
+	key := append([]byte{},m.Key()...)
+	for _, w := range m.all{
+		if w == m.current{
+			continue
+		}
+		if w.idx < m.current.idx{
+			w.iterator.SeekForPrev(key)
+		} else if err := seekBefore(w.iterator,key); err!=nil{
+			return err
+		}
+	}
+	if err := m.current.iterator.Prev(); err!=nil{
+		m.err = err
+		return err
+	}
+	m.rebuild(true)
+	return m.err
+}
+
+//Iterator that merges two iterators of different types. Every version of a
+//key is kept, with i0's (the newer source) first, or last going backwards.
 type TwoMergeIterator struct{
 	iFlag bool
-	i0 StorageIterator
-	i1 StorageIterator
+	reverse bool
+	i0 BidirectionalIterator
+	i1 BidirectionalIterator
+	cmp Comparator
 }
 
-func NewTwoMergeIterator(i0,i1 StorageIterator) (*TwoMergeIterator,error){
+// NewTwoMergeIterator merges i0 and i1, ordered by cmp, nil being
+// BytewiseComparator.
+func NewTwoMergeIterator(i0,i1 BidirectionalIterator,cmp Comparator) (*TwoMergeIterator,error){
 	t := &TwoMergeIterator{
 		iFlag: false,
 		i0: i0,
 		i1: i1,
+		cmp: comparatorOrDefault(cmp),
 	}
-	if err := t.skipI1();err!=nil{
-		return nil,err
+	t.iFlag = t.shouldSelectI0()
+	return t,nil
+}
+
+// NewReverseTwoMergeIterator is NewTwoMergeIterator for iterators positioned
+// for backward iteration.
+func NewReverseTwoMergeIterator(i0,i1 BidirectionalIterator,cmp Comparator) (*TwoMergeIterator,error){
+	t := &TwoMergeIterator{
+		reverse: true,
+		i0: i0,
+		i1: i1,
+		cmp: comparatorOrDefault(cmp),
 	}
 	t.iFlag = t.shouldSelectI0()
 	return t,nil
@@ -113,14 +295,11 @@ func (t *TwoMergeIterator) shouldSelectI0() bool{
 	if !t.i1.IsValid(){
 		return true
 	}
-	return bytes.Compare(t.i0.Key(),t.i1.Key()) < 0
-}
-
-func (t *TwoMergeIterator) skipI1() error{
-	if t.i0.IsValid() && t.i1.IsValid() && bytes.Equal(t.i0.Key(), t.i1.Key()){
-		return t.i1.Next()
+	cmp := t.cmp.Compare(t.i0.Key(),t.i1.Key())
+	if t.reverse{
+		return cmp > 0
 	}
-	return nil
+	return cmp <= 0
 }
 
 func (t *TwoMergeIterator) Key() []byte{
@@ -134,27 +313,99 @@ func (t *TwoMergeIterator) Value() []byte{
 	if t.iFlag{
 		return t.i0.Value()
 	}
-	return t.i0.Value()
+	return t.i1.Value()
 }
 
 func (t *TwoMergeIterator) IsValid() bool {
+	if t.Error()!=nil{
+		return false
+	}
 	if t.iFlag {
 		return t.i0.IsValid()
 	}
 	return t.i1.IsValid()
 }
 
+func (t *TwoMergeIterator) Error() error{
+	if err := t.i0.Error(); err!=nil{
+		return err
+	}
+	return t.i1.Error()
+}
+
+func (t *TwoMergeIterator) SeekToFirst(){
+	t.i0.SeekToFirst()
+	t.i1.SeekToFirst()
+	t.reverse = false
+	t.iFlag = t.shouldSelectI0()
+}
+
+func (t *TwoMergeIterator) SeekToKey(key []byte){
+	t.i0.SeekToKey(key)
+	t.i1.SeekToKey(key)
+	t.reverse = false
+	t.iFlag = t.shouldSelectI0()
+}
+
+func (t *TwoMergeIterator) SeekToLast(){
+	t.i0.SeekToLast()
+	t.i1.SeekToLast()
+	t.reverse = true
+	t.iFlag = t.shouldSelectI0()
+}
+
+func (t *TwoMergeIterator) SeekForPrev(key []byte){
+	t.i0.SeekForPrev(key)
+	t.i1.SeekForPrev(key)
+	t.reverse = true
+	t.iFlag = t.shouldSelectI0()
+}
+
 func (t *TwoMergeIterator) Next() error{
-	iter:= t.i0
+	if t.reverse && t.IsValid(){
+		// switching direction, i1 goes back to key and i0 past it
+		key := append([]byte{},t.Key()...)
+		if t.iFlag{
+			t.i1.SeekToKey(key)
+		} else if err := seekPast(t.i0,key); err!=nil{
+			return err
+		}
+		t.reverse = false
+	}
+	iter:= t.i1
 	if t.iFlag{
-		iter = t.i1
+		iter = t.i0
 	}
 	if err := iter.Next(); err != nil {
 		return err
 	}
-	if err := t.skipI1();err!=nil{
+	t.iFlag = t.shouldSelectI0()
+	return nil
+}
+
+func (t *TwoMergeIterator) Prev() error{
+	if !t.IsValid(){
+		return nil
+	}
+	if !t.reverse{
+		// switching direction, i0 goes back to key and i1 before it
+		key := append([]byte{},t.Key()...)
+		if t.iFlag{
+			if err := seekBefore(t.i1,key); err!=nil{
+				return err
+			}
+		} else {
+			t.i0.SeekForPrev(key)
+		}
+		t.reverse = true
+	}
+	iter:= t.i1
+	if t.iFlag{
+		iter = t.i0
+	}
+	if err := iter.Prev(); err != nil {
 		return err
 	}
 	t.iFlag = t.shouldSelectI0()
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,100 @@
+package table
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// memtableIters builds one memtable iterator per set of keys, every key
+// getting a distinct seq so versions can be told apart.
+func memtableIters(t *testing.T, keySets ...[]string) []*MemtableIterator{
+	var seq uint64
+	var iters []*MemtableIterator
+	for i, keys := range keySets{
+		mem := CreateNewMemTable(i,1<<20,nil)
+		for _, k := range keys{
+			seq++
+			require.NoError(t, mem.Put(BuildEntryWithSeqNo([]byte(k),[]byte(k),seq)))
+		}
+		iters = append(iters, mem.Iter(math.MaxUint64))
+	}
+	return iters
+}
+
+func entryID(t *testing.T, iter StorageIterator) string{
+	iv, err := DecodeInternalValue(iter.Value())
+	require.NoError(t, err)
+	return fmt.Sprintf("%s@%d", iter.Key(), iv.Seq())
+}
+
+// checkBidirectional walks iter forward, then backward from the end, and
+// switches direction at every position, expecting the same order each way.
+func checkBidirectional(t *testing.T, iter BidirectionalIterator, want []string){
+	var got []string
+	for iter.SeekToFirst(); iter.IsValid(); iter.Next(){
+		got = append(got, entryID(t, iter))
+	}
+	require.Equal(t, want, got)
+
+	got = nil
+	for iter.SeekToLast(); iter.IsValid(); iter.Prev(){
+		got = append([]string{entryID(t, iter)}, got...)
+	}
+	require.Equal(t, want, got)
+
+	for i := range want{
+		iter.SeekToFirst()
+		for j := 0; j < i; j++{
+			require.NoError(t, iter.Next())
+		}
+		require.NoError(t, iter.Prev())
+		if i == 0{
+			require.False(t, iter.IsValid())
+			continue
+		}
+		require.Equal(t, want[i-1], entryID(t, iter))
+		require.NoError(t, iter.Next())
+		require.Equal(t, want[i], entryID(t, iter))
+	}
+}
+
+func TestMergeIteratorBothDirections(t *testing.T){
+	iters := memtableIters(t,
+		[]string{"b", "d", "f"},
+		[]string{"a", "b", "f", "g"},
+		[]string{"b", "c", "g"},
+	)
+	want := []string{"a@4", "b@1", "b@5", "b@8", "c@9", "d@2", "f@3", "f@6", "g@7", "g@10"}
+	checkBidirectional(t, NewMergeIterator(iters,nil), want)
+
+	iter := NewMergeIterator(iters,nil)
+	iter.SeekForPrev([]byte("e"))
+	require.Equal(t, "d@2", entryID(t, iter))
+	iter.SeekForPrev([]byte("b"))
+	require.Equal(t, "b@8", entryID(t, iter))
+	iter.SeekToKey([]byte("e"))
+	require.Equal(t, "f@3", entryID(t, iter))
+
+	for _, it := range iters{
+		it.SeekToLast()
+	}
+	iter = NewReverseMergeIterator(iters,nil)
+	require.Equal(t, "g@10", entryID(t, iter))
+}
+
+func TestTwoMergeIteratorBothDirections(t *testing.T){
+	iters := memtableIters(t,
+		[]string{"b", "d"},
+		[]string{"a", "b", "e"},
+		[]string{"b", "c", "d"},
+	)
+	i0, err := NewTwoMergeIterator(iters[0], iters[1], nil)
+	require.NoError(t, err)
+	iter, err := NewTwoMergeIterator(i0, iters[2], nil)
+	require.NoError(t, err)
+	want := []string{"a@3", "b@1", "b@4", "b@6", "c@7", "d@2", "d@8", "e@5"}
+	checkBidirectional(t, iter, want)
+}
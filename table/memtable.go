@@ -2,117 +2,290 @@ package table
 
 import (
 	wal "anchordb/wal"
-	"bytes"
-
-	"github.com/huandu/skiplist"
+	"encoding/binary"
+	"math"
+	"sync"
+	"sync/atomic"
 )
+
+// Memtable holds the latest writes in an arena skiplist, one node for every
+// version. Puts and reads need no lock and can run from many goroutines at
+// once. Range tombstones are kept aside under a mutex, they are few.
 type Memtable struct{
-	skiplist skiplist.SkipList
-	size int64
+	list *skiplist
+	cmp Comparator
+	rangeMu sync.RWMutex
+	rangeDels []RangeTombstone
+	rangeDelSize atomic.Int64
+	// the highest timestamp of a version put
+	maxTimestamp atomic.Uint64
 	wal *wal.WAL
 	id int
 }
 
+// MemtableIterator walks the memtable as it is, yielding every version of a
+// key newest first as encoded values. Versions with a seq past the one it
+// was created with are skipped, so later writes are not seen.
 type MemtableIterator struct{
-	skiplist *skiplist.SkipList
-	curEntry *skiplist.Element
+	list *skiplist
+	node uint32
+	maxSeq uint64
 }
 
-func CreateNewMemTable(id int) *Memtable{
-	return &Memtable{
-		skiplist: *skiplist.New(skiplist.Bytes),
-		size: 0,
-		id: id,
-	}
+// most bytes an encoded internal value adds to its value or operand
+const maxInternalValueOverhead = 1+4*binary.MaxVarintLen64
+
+// MemtableEntrySize returns the most arena bytes a write of a key and value
+// of these lengths takes, a memtable needs an arena at least this big to
+// hold it.
+func MemtableEntrySize(keyLen int, valueLen int) int64{
+	// the node may be aligned up by 3 bytes
+	return int64(fullNodeSize)+3+int64(keyLen)+internalKeyTrailerLen+int64(valueLen)+maxInternalValueOverhead
 }
 
-func CreateNewMemTableWithWal(id int,path string) *Memtable{
-	
+// CreateNewMemTable creates a memtable with an arena for arenaSize bytes,
+// ordering keys by cmp, nil being BytewiseComparator.
+func CreateNewMemTable(id int, arenaSize int64, cmp Comparator) *Memtable{
+	cmp = comparatorOrDefault(cmp)
 	return &Memtable{
-		skiplist: *skiplist.New(skiplist.Bytes),
-		size: 0,
-		wal: wal.OpenWAL(path),
+		list: newSkiplist(arenaSize,cmp),
+		cmp: cmp,
 		id: id,
 	}
 }
 
+func CreateNewMemTableWithWal(id int, path string, arenaSize int64, cmp Comparator) *Memtable{
+	m := CreateNewMemTable(id,arenaSize,cmp)
+	m.wal = wal.OpenWAL(path)
+	return m
+}
+
+// GetSize returns the bytes allocated from the arena, with the range
+// tombstones.
 func (m *Memtable) GetSize() int64{
-	return m.size
+	return m.list.arena.size()+m.rangeDelSize.Load()
 }
 
 func (m *Memtable) GetID()int {
 	return m.id
 }
 
+// Put adds the version in entry, ErrArenaFull if the arena can't take it.
+// It is safe to call concurrently with other puts and with reads.
 func (m *Memtable) Put(entry *Entry) error{
-
-	valueSize := int64(len(entry.internalValue.value))
-	existing := m.skiplist.Get(entry.key)
-	if existing!=nil{
-		m.size -= int64(len(existing.Value.(*InternalValue).value))
-	} else {
-		m.size += int64(len(entry.key))
+	iv := entry.internalValue
+	key := appendInternalKey(make([]byte,0,len(entry.key)+internalKeyTrailerLen),entry.key,iv.seq)
+	if err := m.list.insert(key,iv.Encode()); err!=nil{
+		return err
+	}
+	for ts := m.maxTimestamp.Load(); iv.ts > ts; ts = m.maxTimestamp.Load(){
+		if m.maxTimestamp.CompareAndSwap(ts,iv.ts){
+			break
+		}
 	}
-	m.size+=valueSize
-	
-	m.skiplist.Set(entry.key,entry.internalValue)
-
 	return nil
 }
 
+// MaxTimestamp returns the highest timestamp of a version in the memtable.
+func (m *Memtable) MaxTimestamp() uint64{
+	return m.maxTimestamp.Load()
+}
+
+func (m *Memtable) DeleteRange(t RangeTombstone){
+	m.rangeMu.Lock()
+	defer m.rangeMu.Unlock()
+	m.rangeDels = append(m.rangeDels, t)
+	m.rangeDelSize.Add(int64(len(t.start)+len(t.end)))
+}
+
+func (m *Memtable) RangeTombstones() []RangeTombstone{
+	m.rangeMu.RLock()
+	defer m.rangeMu.RUnlock()
+	// later tombstones are appended past the end
+	return m.rangeDels[:len(m.rangeDels):len(m.rangeDels)]
+}
+
+// IsEmpty reports whether nothing was written to the memtable.
+func (m *Memtable) IsEmpty() bool{
+	return m.list.next(m.list.head,0)==0 && len(m.RangeTombstones())==0
+}
+
+// Get returns the newest version of key.
 func (m *Memtable) Get(key []byte) (*Entry,bool){
-	value,ok := m.skiplist.GetValue(key)
-	if !ok{
+	iter := m.Iter(math.MaxUint64)
+	iter.SeekToKey(key)
+	if !iter.IsValid() || m.cmp.Compare(iter.Key(),key)!=0{
 		return nil,false
 	}
-	var internalValue *InternalValue = value.(*InternalValue)
-	entry:= &Entry{key, internalValue}
-	return entry,true
-} 
+	internalValue,err := DecodeInternalValue(iter.Value())
+	if err!=nil{
+		return nil,false
+	}
+	return &Entry{iter.Key(),internalValue},true
+}
 
 func (m *Memtable) Scan(start []byte, end []byte) []*Entry{
 	var entries []*Entry
-	i := m.skiplist.Find(start)
-	for i!=nil{
-		if bytes.Compare(i.Element().Key().([]byte), end) > 0 {
-            break
-        }
-		entry := i.Value.(*Entry)
-        if !entry.internalValue.tombstone {
-            entries = append(entries, entry)
-        }
-
-        i = i.Next()
+	iter := m.Iter(math.MaxUint64)
+	for iter.SeekToKey(start); iter.IsValid() && m.cmp.Compare(iter.Key(),end) <= 0; {
+		key := iter.Key()
+		internalValue,err := DecodeInternalValue(iter.Value())
+		if err==nil && internalValue.kind != KindDelete{
+			entries = append(entries, &Entry{key,internalValue})
+		}
+		// only the newest version
+		for iter.IsValid() && m.cmp.Compare(iter.Key(),key)==0{
+			iter.Next()
+		}
 	}
 	return entries
 }
 
-func (m *Memtable) Flush(s *SSTBuilder) {
-	var k,v []byte
-	elem := m.skiplist.Front()
-	for elem!=nil{
-		k = elem.Key().([]byte)
-		v=elem.Value.(*InternalValue).Value()
-		//fmt.Printf("adding key:%s, value:%s\n",string(k),string(v))
-		s.Add(k,v)
-		elem= elem.Next()
+// Flush writes every version to the SST builder, newest first. Versions
+// shadowed by a range tombstone are dropped, the tombstones are flushed
+// after them. Consecutive merge operands of a key at the same timestamp are
+// collapsed with op, into the older value they follow if there is one.
+func (m *Memtable) Flush(s *SSTBuilder, op MergeOperator) error{
+	rangeDels := m.RangeTombstones()
+	var rangeDelSeq uint64
+	var prevKey []byte
+	// the operands being collected, nil if there are none
+	var ctx *MergeContext
+	var ctxTs uint64
+	flushMerge := func() error{
+		if ctx==nil{
+			return nil
+		}
+		iv,err := ctx.Resolve(op,false)
+		if err!=nil{
+			return err
+		}
+		s.Add(ctx.key,iv.Encode())
+		ctx = nil
+		return nil
+	}
+	for node := m.list.next(m.list.head,0); node!=0; node = m.list.next(node,0){
+		ikey := m.list.key(node)
+		k := ikey[:len(ikey)-internalKeyTrailerLen]
+		if prevKey==nil || m.cmp.Compare(k,prevKey)!=0{
+			if err := flushMerge(); err!=nil{
+				return err
+			}
+			rangeDelSeq = MaxCoveringSeq(rangeDels,k,m.cmp)
+			prevKey = k
+		}
+		if internalKeySeq(ikey) <= rangeDelSeq{
+			continue
+		}
+		if op==nil{
+			s.Add(k,m.list.value(node))
+			continue
+		}
+		iv,err := DecodeInternalValue(m.list.value(node))
+		if err!=nil{
+			return err
+		}
+		if ctx!=nil && iv.ts!=ctxTs{
+			// reads between the timestamps see the newer operands without it
+			if err := flushMerge(); err!=nil{
+				return err
+			}
+		}
+		if ctx==nil{
+			if iv.kind != KindMerge{
+				s.Add(k,m.list.value(node))
+				continue
+			}
+			ctx, ctxTs = NewMergeContext(k), iv.ts
+		}
+		if ctx.Add(iv){
+			if err := flushMerge(); err!=nil{
+				return err
+			}
+		}
 	}
+	if err := flushMerge(); err!=nil{
+		return err
+	}
+	for _,t := range rangeDels{
+		s.AddRangeTombstone(t)
+	}
+	return nil
+}
+
+// Iter returns an iterator over the versions with a seq up to maxSeq.
+func (m *Memtable) Iter(maxSeq uint64) *MemtableIterator{
+	return &MemtableIterator{list: m.list, maxSeq: maxSeq}
+}
+
+// skipForward moves past versions newer than the iterator's seq.
+func (m *MemtableIterator) skipForward(){
+	for m.node!=0 && internalKeySeq(m.list.key(m.node)) > m.maxSeq{
+		m.node = m.list.next(m.node,0)
+	}
+}
+
+// skipBackward moves back past versions newer than the iterator's seq.
+func (m *MemtableIterator) skipBackward(){
+	for m.node!=0 && internalKeySeq(m.list.key(m.node)) > m.maxSeq{
+		m.node = m.list.findLess(m.list.key(m.node),false)
+	}
+}
+
+func (m *MemtableIterator) SeekToFirst(){
+	m.node = m.list.next(m.list.head,0)
+	m.skipForward()
+}
+
+// SeekToKey moves to the newest version of the first key at or after key.
+func (m *MemtableIterator) SeekToKey(key []byte){
+	m.node = m.list.findGreaterOrEqual(appendInternalKey(nil,key,math.MaxUint64))
+	m.skipForward()
+}
+
+// SeekToLast moves to the oldest version of the last key.
+func (m *MemtableIterator) SeekToLast(){
+	m.node = m.list.findLast()
+	m.skipBackward()
+}
+
+// SeekForPrev moves to the oldest version of the last key at or before key.
+func (m *MemtableIterator) SeekForPrev(key []byte){
+	m.node = m.list.findLess(appendInternalKey(nil,key,0),true)
+	m.skipBackward()
 }
 
 func (m *MemtableIterator) Next() error{
-	element := m.skiplist.Element().Next()
-	m.curEntry = element
+	if m.IsValid(){
+		m.node = m.list.next(m.node,0)
+		m.skipForward()
+	}
+	return nil
+}
+
+func (m *MemtableIterator) Prev() error{
+	if m.IsValid(){
+		m.node = m.list.findLess(m.list.key(m.node),false)
+		m.skipBackward()
+	}
 	return nil
 }
 
+// Value returns the encoded version, read from the arena without copying.
 func (m *MemtableIterator) Value() []byte{
-	return m.curEntry.Value.(*Entry).Value()
+	return m.list.value(m.node)
 }
 
 func (m *MemtableIterator) Key() []byte{
-	return m.curEntry.Value.(*Entry).Key()
+	ikey := m.list.key(m.node)
+	return ikey[:len(ikey)-internalKeyTrailerLen]
 }
 
 func (m *MemtableIterator) IsValid() bool{
-	return m.curEntry!=nil
-}
\ No newline at end of file
+	return m.node!=0
+}
+
+// Error returns nil, the memtable is in memory.
+func (m *MemtableIterator) Error() error{
+	return nil
+}
@@ -0,0 +1,138 @@
+package table
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemtableConcurrentPut(t *testing.T){
+	mem := CreateNewMemTable(0,8<<20,nil)
+	const writers, perWriter = 8, 2000
+	var seq atomic.Uint64
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++{
+		wg.Add(1)
+		go func(w int){
+			defer wg.Done()
+			for i := 0; i < perWriter; i++{
+				// every writer also writes a version of a shared key
+				key := fmt.Sprintf("key%02d-%05d",w,i)
+				if i%10 == 0{
+					key = fmt.Sprintf("shared%05d",i)
+				}
+				require.NoError(t,mem.Put(BuildEntryWithSeqNo([]byte(key),[]byte(key),seq.Add(1))))
+			}
+		}(w)
+	}
+	// readers walk the list while it grows
+	for r := 0; r < 2; r++{
+		wg.Add(1)
+		go func(){
+			defer wg.Done()
+			for n := 0; n < 20; n++{
+				iter := mem.Iter(math.MaxUint64)
+				var prev []byte
+				for iter.SeekToFirst(); iter.IsValid(); iter.Next(){
+					require.LessOrEqual(t,string(prev),string(iter.Key()))
+					prev = append(prev[:0],iter.Key()...)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	iter := mem.Iter(math.MaxUint64)
+	count := 0
+	var prevKey []byte
+	var prevSeq uint64
+	for iter.SeekToFirst(); iter.IsValid(); iter.Next(){
+		iv, err := DecodeInternalValue(iter.Value())
+		require.NoError(t,err)
+		if string(prevKey) == string(iter.Key()){
+			require.Less(t,iv.Seq(),prevSeq,"versions newest first")
+		} else {
+			require.Less(t,string(prevKey),string(iter.Key()))
+		}
+		prevKey, prevSeq = append(prevKey[:0],iter.Key()...), iv.Seq()
+		count++
+	}
+	require.Equal(t,writers*perWriter,count)
+	entry, ok := mem.Get([]byte("shared00010"))
+	require.True(t,ok)
+	require.Equal(t,"shared00010",string(entry.InternalValue().Value()))
+}
+
+func TestMemtableIterSeq(t *testing.T){
+	mem := CreateNewMemTable(0,1<<20,nil)
+	for seq, k := range []string{"a", "b", "a", "c", "b"}{
+		require.NoError(t,mem.Put(BuildEntryWithSeqNo([]byte(k),[]byte(k),uint64(seq+1))))
+	}
+	checkBidirectional(t,mem.Iter(math.MaxUint64),[]string{"a@3", "a@1", "b@5", "b@2", "c@4"})
+	checkBidirectional(t,mem.Iter(3),[]string{"a@3", "a@1", "b@2"})
+
+	iter := mem.Iter(3)
+	iter.SeekToKey([]byte("b"))
+	require.Equal(t,"b@2",entryID(t,iter))
+	iter.SeekForPrev([]byte("b"))
+	require.Equal(t,"b@2",entryID(t,iter))
+	iter.SeekForPrev([]byte("az"))
+	require.Equal(t,"a@1",entryID(t,iter))
+	iter.SeekToLast()
+	require.Equal(t,"b@2",entryID(t,iter))
+}
+
+func TestMemtableArenaFull(t *testing.T){
+	mem := CreateNewMemTable(0,4096,nil)
+	value := make([]byte,1000)
+	var err error
+	seq := uint64(0)
+	for err == nil{
+		seq++
+		err = mem.Put(BuildEntryWithSeqNo([]byte(fmt.Sprintf("key%d",seq)),value,seq))
+	}
+	require.ErrorIs(t,err,ErrArenaFull)
+	require.LessOrEqual(t,mem.GetSize(),int64(4096)+int64(fullNodeSize)+1)
+	require.Greater(t,mem.GetSize(),int64(3000))
+
+	// an entry takes at most MemtableEntrySize
+	size := MemtableEntrySize(len("key"),len(value))
+	mem = CreateNewMemTable(0,size,nil)
+	require.NoError(t,mem.Put(BuildMergeEntryWithSeqNo([]byte("key"),value,math.MaxUint64)))
+	require.ErrorIs(t,mem.Put(BuildEntryWithSeqNo([]byte("key"),value,1)),ErrArenaFull)
+}
+
+func TestMemtableFlushCollapsesMerges(t *testing.T){
+	mem := CreateNewMemTable(0,1<<20,nil)
+	const n = 100
+	var want []byte
+	require.NoError(t,mem.Put(BuildEntryWithSeqNo([]byte("a"),[]byte("base"),1)))
+	for i := 0; i < n; i++{
+		op := []byte(fmt.Sprint(i%10))
+		want = append(want,op...)
+		require.NoError(t,mem.Put(BuildMergeEntryWithSeqNo([]byte("a"),op,uint64(i+2))))
+		require.NoError(t,mem.Put(BuildMergeEntryWithSeqNo([]byte("b"),op,uint64(n+i+2))))
+	}
+	builder := NewSSTBuilder(4096)
+	require.NoError(t,mem.Flush(builder,appendMergeOperator{}))
+	sst := builder.Build(1,filepath.Join(t.TempDir(),"1.sst"))
+	require.Equal(t,uint64(2),sst.Properties().NumEntries)
+
+	iter := CreateSSTIterAndSeekToFirst(sst)
+	require.True(t,iter.IsValid())
+	iv, err := DecodeInternalValue(iter.Value())
+	require.NoError(t,err)
+	require.Equal(t,KindValue,iv.kind)
+	require.Equal(t,uint64(n+1),iv.Seq())
+	require.Equal(t,"base"+string(want),string(iv.Value()))
+	require.NoError(t,iter.Next())
+	iv, err = DecodeInternalValue(iter.Value())
+	require.NoError(t,err)
+	require.Equal(t,KindMerge,iv.kind)
+	require.Equal(t,[][]byte{want},iv.operands)
+}
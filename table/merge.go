@@ -0,0 +1,118 @@
+package table
+
+import (
+	"errors"
+	"math"
+)
+
+var ErrNoMergeOperator = errors.New("merge operands found but no merge operator is configured")
+
+// MergeOperator folds merge operands into a value, letting callers do
+// read-modify-write updates (counters, appends, patches) without a Get.
+type MergeOperator interface{
+	Name() string
+	// FullMerge applies operands (oldest first) on top of existing, which is
+	// nil when the key has no value.
+	FullMerge(key []byte, existing []byte, operands [][]byte) ([]byte,error)
+	// PartialMerge combines operands (oldest first) into a single operand.
+	// It returns false if they can't be combined without the base value.
+	PartialMerge(key []byte, operands [][]byte) ([]byte,bool)
+}
+
+// MergeContext collects the versions of a key from the newest source to the
+// oldest until a value or tombstone settles it. Versions with a timestamp
+// after the read timestamp are skipped.
+type MergeContext struct{
+	key []byte
+	readTs uint64
+	operands [][]byte // oldest first
+	base *InternalValue
+	// seq and timestamp of the newest version
+	seq uint64
+	ts uint64
+	// reads a KindBlob base that operands are merged into
+	blobs BlobSource
+}
+
+// BlobSource reads the values of KindBlob versions from their blob files.
+type BlobSource interface{
+	GetBlob(ref BlobRef) ([]byte,error)
+}
+
+func NewMergeContext(key []byte) *MergeContext{
+	return NewMergeContextAt(key,math.MaxUint64)
+}
+
+func NewMergeContextAt(key []byte, readTs uint64) *MergeContext{
+	return &MergeContext{key: key, readTs: readTs}
+}
+
+// SetBlobSource sets where a base value in a blob file is read from when
+// operands are merged into it.
+func (m *MergeContext) SetBlobSource(b BlobSource){
+	m.blobs = b
+}
+
+// Add folds in the next older version of the key and reports whether the
+// lookup is settled, in which case older versions are shadowed.
+func (m *MergeContext) Add(iv *InternalValue) bool{
+	if m.base!=nil{
+		return true
+	}
+	if iv.ts > m.readTs{
+		return false
+	}
+	if iv.seq > m.seq{
+		m.seq = iv.seq
+		m.ts = iv.ts
+	}
+	if len(iv.operands)>0{
+		operands := make([][]byte,0,len(iv.operands)+len(m.operands))
+		operands = append(operands, iv.operands...)
+		m.operands = append(operands, m.operands...)
+	}
+	if iv.kind == KindMerge{
+		return false
+	}
+	m.base = iv
+	return true
+}
+
+// Resolve collapses what was collected into a single version. With bottom set
+// there is nothing older left, so tombstones are dropped (nil is returned) and
+// a merge without a base is fully merged. Otherwise tombstones are kept and
+// pending operands are only partially merged.
+func (m *MergeContext) Resolve(op MergeOperator, bottom bool) (*InternalValue,error){
+	if len(m.operands)==0{
+		if m.base==nil || (m.base.kind == KindDelete && bottom){
+			return nil,nil
+		}
+		return &InternalValue{value: m.base.value, seq: m.seq, ts: m.ts, kind: m.base.kind},nil
+	}
+	if op==nil{
+		return nil,ErrNoMergeOperator
+	}
+	if m.base==nil && !bottom{
+		if len(m.operands)>1{
+			if merged,ok := op.PartialMerge(m.key,m.operands); ok{
+				return &InternalValue{seq: m.seq, ts: m.ts, kind: KindMerge, operands: [][]byte{merged}},nil
+			}
+		}
+		return &InternalValue{seq: m.seq, ts: m.ts, kind: KindMerge, operands: m.operands},nil
+	}
+	var existing []byte
+	if m.base!=nil && m.base.kind == KindValue{
+		existing = m.base.value
+	}
+	if m.base!=nil && m.base.kind == KindBlob{
+		var err error
+		if existing, err = ReadBlobValue(m.blobs,m.base); err!=nil{
+			return nil,err
+		}
+	}
+	value,err := op.FullMerge(m.key,existing,m.operands)
+	if err!=nil{
+		return nil,err
+	}
+	return &InternalValue{value: value, seq: m.seq, ts: m.ts, kind: KindValue},nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux && !darwin
+
+package table
+
+import "errors"
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+func mmapFile(f *FileWrapper) ([]byte,error){
+	return nil,errMmapUnsupported
+}
+
+func munmapFile(data []byte) error{
+	return errMmapUnsupported
+}
+
+func madviseFile(data []byte, p AccessPattern) error{
+	return errMmapUnsupported
+}
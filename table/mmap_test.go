@@ -0,0 +1,55 @@
+package table
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSTMmap(t *testing.T){
+	dir := t.TempDir() + "/"
+	cache := NewTableCache(1)
+	build := func(id int) *SSTable{
+		builder := NewSSTBuilder(256)
+		builder.SetMmap(true)
+		builder.SetTableCache(cache)
+		for i := 0; i < 100; i++{
+			builder.Add([]byte(fmt.Sprintf("key%03d",i)),[]byte(fmt.Sprintf("value%d",id)))
+		}
+		return builder.Build(id,fmt.Sprintf("%s%d.sst",dir,id))
+	}
+	sst := build(0)
+	mapped := sst.handle.mapped
+	require.NotNil(t,mapped)
+	require.Nil(t,mapped.file)
+
+	// blocks are read straight from the mapping
+	blk := mapped.Slice(0,16)
+	require.Same(t,&mapped.data[0],&blk[0])
+
+	// closing the table keeps the mapping for when it is reopened
+	other := build(1)
+	require.Nil(t,sst.handle.reader)
+	require.Same(t,mapped,sst.handle.mapped)
+	require.Equal(t,100,countEntries(sst))
+	sst.Advise(AccessSequential)
+	require.Equal(t,100,countEntries(other))
+
+	fw, err := OpenFileWrapper(dir + "1.sst")
+	require.NoError(t,err)
+	require.NoError(t,fw.Map())
+	opened, err := OpenSSTable(1,fw,nil)
+	require.NoError(t,err)
+	iter := CreateSSTIterAndSeekToKey(opened,[]byte("key050"))
+	require.Equal(t,"key050",string(iter.Key()))
+
+	// unmapped once removed and released
+	sst.Ref()
+	require.NoError(t,sst.Remove())
+	require.NotNil(t,sst.handle.mapped)
+	require.Equal(t,100,countEntries(sst))
+	sst.Unref()
+	require.Nil(t,sst.handle.mapped)
+	require.Nil(t,mapped.data)
+}
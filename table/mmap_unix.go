@@ -0,0 +1,37 @@
+//go:build linux || darwin
+
+package table
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func mmapFile(f *FileWrapper) ([]byte,error){
+	if f.size == 0{
+		return []byte{},nil
+	}
+	data, err := syscall.Mmap(int(f.file.Fd()),0,int(f.size),syscall.PROT_READ,syscall.MAP_SHARED)
+	if err!=nil{
+		return nil,fmt.Errorf("failed to mmap %s: %w",f.path,err)
+	}
+	return data,nil
+}
+
+func munmapFile(data []byte) error{
+	if len(data) == 0{
+		return nil
+	}
+	return syscall.Munmap(data)
+}
+
+func madviseFile(data []byte, p AccessPattern) error{
+	if len(data) == 0{
+		return nil
+	}
+	advice := syscall.MADV_RANDOM
+	if p == AccessSequential{
+		advice = syscall.MADV_SEQUENTIAL
+	}
+	return syscall.Madvise(data,advice)
+}
@@ -0,0 +1,94 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// PrefixExtractor maps a key to the prefix that prefix bloom filters and
+// prefix iteration work with. Keys outside its domain have no prefix.
+type PrefixExtractor interface{
+	// Name is recorded with the filters built from it, so they are only
+	// used with the same extractor.
+	Name() string
+	Transform(key []byte) []byte
+	InDomain(key []byte) bool
+}
+
+type fixedPrefixExtractor struct{
+	n int
+}
+
+// NewFixedPrefixExtractor uses the first n bytes of a key as its prefix.
+// Shorter keys have no prefix.
+func NewFixedPrefixExtractor(n int) PrefixExtractor{
+	return fixedPrefixExtractor{n: n}
+}
+
+func (f fixedPrefixExtractor) Name() string{
+	return fmt.Sprintf("fixed:%d",f.n)
+}
+
+func (f fixedPrefixExtractor) Transform(key []byte) []byte{
+	return key[:f.n]
+}
+
+func (f fixedPrefixExtractor) InDomain(key []byte) bool{
+	return len(key) >= f.n
+}
+
+type separatorPrefixExtractor struct{
+	sep byte
+	n int
+}
+
+// NewSeparatorPrefixExtractor uses a key up to and including its n-th sep as
+// its prefix, so with '/' and 2 the prefix of "tenant/entity/id" is
+// "tenant/entity/". Keys with fewer separators have no prefix.
+func NewSeparatorPrefixExtractor(sep byte, n int) PrefixExtractor{
+	return separatorPrefixExtractor{sep: sep, n: n}
+}
+
+func (s separatorPrefixExtractor) Name() string{
+	return fmt.Sprintf("separator:%q:%d",s.sep,s.n)
+}
+
+// prefixLen returns the length of the prefix of key, -1 if it has none.
+func (s separatorPrefixExtractor) prefixLen(key []byte) int{
+	end := 0
+	for i := 0; i < s.n; i++{
+		idx := bytes.IndexByte(key[end:],s.sep)
+		if idx < 0{
+			return -1
+		}
+		end += idx+1
+	}
+	return end
+}
+
+func (s separatorPrefixExtractor) Transform(key []byte) []byte{
+	return key[:s.prefixLen(key)]
+}
+
+func (s separatorPrefixExtractor) InDomain(key []byte) bool{
+	return s.prefixLen(key) >= 0
+}
+
+// IsWholePrefix reports whether prefix is exactly what extractor maps the keys
+// starting with it to, in which case a prefix filter can rule it out.
+func IsWholePrefix(extractor PrefixExtractor, prefix []byte) bool{
+	return extractor!=nil && extractor.InDomain(prefix) && bytes.Equal(extractor.Transform(prefix),prefix)
+}
+
+// PrefixSuccessor returns the smallest key greater than every key starting
+// with prefix, nil if there is none.
+func PrefixSuccessor(prefix []byte) []byte{
+	for i := len(prefix)-1; i >= 0; i--{
+		if prefix[i] != 0xff{
+			succ := append([]byte{},prefix[:i+1]...)
+			succ[i]++
+			return succ
+		}
+	}
+	return nil
+}
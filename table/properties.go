@@ -0,0 +1,189 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TableProperties describe a table, recorded when it is built.
+type TableProperties struct{
+	NumEntries uint64
+	// entries deleting their key, not counting range deletions
+	NumDeletions uint64
+	NumRangeDeletions uint64
+	// bytes of the keys and values of the entries as added, before encoding
+	RawKeySize uint64
+	RawValueSize uint64
+	// range of the sequence numbers of the entries and range deletions
+	MinSeq uint64
+	MaxSeq uint64
+	// latest application timestamp of the entries, 0 if none has one
+	MaxTimestamp uint64
+	// unix time in seconds
+	CreationTime int64
+	// codec the blocks were compressed with, though blocks that didn't
+	// compress well are stored uncompressed
+	Compression CompressionType
+	FilterType FilterType
+	// bytes of the data blocks encoded, and as stored after compression
+	RawDataSize uint64
+	DataSize uint64
+	// bytes of the dictionary the blocks were compressed with, 0 without one
+	CompressionDictSize uint64
+	// bytes of the blob file records referenced by the table, by blob file
+	BlobBytes map[int]uint64
+	// name of the comparator the keys are ordered by, empty for tables
+	// written before it was recorded, which are bytewise
+	Comparator string
+}
+
+// CompressionRatio returns how many times smaller compression made the data
+// blocks, 1 if they weren't compressed.
+func (p TableProperties) CompressionRatio() float64{
+	if p.DataSize == 0{
+		return 1
+	}
+	return float64(p.RawDataSize)/float64(p.DataSize)
+}
+
+const (
+	propNumEntries = "anchordb.num.entries"
+	propNumDeletions = "anchordb.num.deletions"
+	propNumRangeDeletions = "anchordb.num.range.deletions"
+	propRawKeySize = "anchordb.raw.key.size"
+	propRawValueSize = "anchordb.raw.value.size"
+	propMinSeq = "anchordb.min.seq"
+	propMaxSeq = "anchordb.max.seq"
+	propMaxTimestamp = "anchordb.max.timestamp"
+	propCreationTime = "anchordb.creation.time"
+	propCompression = "anchordb.compression"
+	propFilterType = "anchordb.filter.type"
+	propRawDataSize = "anchordb.raw.data.size"
+	propDataSize = "anchordb.data.size"
+	propCompressionDictSize = "anchordb.compression.dict.size"
+	// followed by the id of the blob file
+	propBlobBytesPrefix = "anchordb.blob.bytes."
+	// followed by the name of the comparator, property values being numbers
+	propComparatorPrefix = "anchordb.comparator."
+)
+
+/*
+Properties Block Encoding
+-----------------------------------------------------------------
+| Property #1 | ... | Property #N | checksum (u32) | size (u32) |
+-----------------------------------------------------------------
+| Property: name len (uvarint) | name | value (uvarint) |
+-------------------------------------------------------
+Properties are named so ones added later are skipped by older readers and
+missing from older tables.
+*/
+
+const PROPERTIES_TRAILER_SIZE = 8
+
+func encodePropertiesBlock(p TableProperties) []byte{
+	var buf []byte
+	appendProperty := func(name string, value uint64){
+		buf = binary.AppendUvarint(buf,uint64(len(name)))
+		buf = append(buf, name...)
+		buf = binary.AppendUvarint(buf,value)
+	}
+	appendProperty(propNumEntries,p.NumEntries)
+	appendProperty(propNumDeletions,p.NumDeletions)
+	appendProperty(propNumRangeDeletions,p.NumRangeDeletions)
+	appendProperty(propRawKeySize,p.RawKeySize)
+	appendProperty(propRawValueSize,p.RawValueSize)
+	appendProperty(propMinSeq,p.MinSeq)
+	appendProperty(propMaxSeq,p.MaxSeq)
+	if p.MaxTimestamp > 0{
+		appendProperty(propMaxTimestamp,p.MaxTimestamp)
+	}
+	appendProperty(propCreationTime,uint64(p.CreationTime))
+	appendProperty(propCompression,uint64(p.Compression))
+	appendProperty(propFilterType,uint64(p.FilterType))
+	appendProperty(propRawDataSize,p.RawDataSize)
+	appendProperty(propDataSize,p.DataSize)
+	appendProperty(propCompressionDictSize,p.CompressionDictSize)
+	if p.Comparator!=""{
+		appendProperty(propComparatorPrefix+p.Comparator,0)
+	}
+	blobFiles := make([]int,0,len(p.BlobBytes))
+	for id := range p.BlobBytes{
+		blobFiles = append(blobFiles, id)
+	}
+	sort.Ints(blobFiles)
+	for _,id := range blobFiles{
+		appendProperty(propBlobBytesPrefix+strconv.Itoa(id),p.BlobBytes[id])
+	}
+	size := len(buf)
+	buf = binary.BigEndian.AppendUint32(buf,crc32.ChecksumIEEE(buf))
+	return binary.BigEndian.AppendUint32(buf,uint32(size))
+}
+
+func decodePropertiesBlock(data []byte) (TableProperties,error){
+	var p TableProperties
+	if len(data) < PROPERTIES_TRAILER_SIZE{
+		return p,fmt.Errorf("properties block too small")
+	}
+	checksum := binary.BigEndian.Uint32(data[len(data)-PROPERTIES_TRAILER_SIZE:])
+	data = data[:len(data)-PROPERTIES_TRAILER_SIZE]
+	if checksum != crc32.ChecksumIEEE(data){
+		return p,fmt.Errorf("properties block checksum mismatched")
+	}
+	for len(data) > 0{
+		nameLen, n := binary.Uvarint(data)
+		if n <= 0 || nameLen > uint64(len(data)-n){
+			return p,fmt.Errorf("invalid properties block")
+		}
+		name := string(data[n:n+int(nameLen)])
+		data = data[n+int(nameLen):]
+		value, n := binary.Uvarint(data)
+		if n <= 0{
+			return p,fmt.Errorf("invalid properties block")
+		}
+		data = data[n:]
+		switch name{
+		case propNumEntries:
+			p.NumEntries = value
+		case propNumDeletions:
+			p.NumDeletions = value
+		case propNumRangeDeletions:
+			p.NumRangeDeletions = value
+		case propRawKeySize:
+			p.RawKeySize = value
+		case propRawValueSize:
+			p.RawValueSize = value
+		case propMinSeq:
+			p.MinSeq = value
+		case propMaxSeq:
+			p.MaxSeq = value
+		case propMaxTimestamp:
+			p.MaxTimestamp = value
+		case propCreationTime:
+			p.CreationTime = int64(value)
+		case propCompression:
+			p.Compression = CompressionType(value)
+		case propFilterType:
+			p.FilterType = FilterType(value)
+		case propRawDataSize:
+			p.RawDataSize = value
+		case propDataSize:
+			p.DataSize = value
+		case propCompressionDictSize:
+			p.CompressionDictSize = value
+		default:
+			if strings.HasPrefix(name,propComparatorPrefix){
+				p.Comparator = strings.TrimPrefix(name,propComparatorPrefix)
+			} else if id, err := strconv.Atoi(strings.TrimPrefix(name,propBlobBytesPrefix)); err==nil && strings.HasPrefix(name,propBlobBytesPrefix){
+				if p.BlobBytes==nil{
+					p.BlobBytes = make(map[int]uint64)
+				}
+				p.BlobBytes[id] = value
+			}
+		}
+	}
+	return p,nil
+}
@@ -0,0 +1,189 @@
+package table
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// RangeTombstone deletes every key in [start, end) written before seq.
+type RangeTombstone struct{
+	start []byte
+	end []byte
+	seq uint64
+}
+
+func NewRangeTombstone(start []byte, end []byte, seq uint64) RangeTombstone{
+	return RangeTombstone{start: start, end: end, seq: seq}
+}
+
+func (t RangeTombstone) Start() []byte{ return t.start }
+func (t RangeTombstone) End() []byte{ return t.end }
+func (t RangeTombstone) Seq() uint64{ return t.seq }
+
+// Covers reports whether key is in [start, end) in the order of cmp.
+func (t RangeTombstone) Covers(key []byte, cmp Comparator) bool{
+	return cmp.Compare(t.start,key) <= 0 && cmp.Compare(key,t.end) < 0
+}
+
+// MaxCoveringSeq returns the seq of the newest tombstone covering key, 0 if none do.
+func MaxCoveringSeq(tombstones []RangeTombstone, key []byte, cmp Comparator) uint64{
+	var seq uint64
+	for _,t := range tombstones{
+		if t.seq > seq && t.Covers(key,cmp){
+			seq = t.seq
+		}
+	}
+	return seq
+}
+
+/*
+Range Deletion Block Encoding
+-------------------------------------------------------------------------------------------------
+|                 Tombstone #1                               | ... |  checksum  |   block size   |
+-------------------------------------------------------------------------------------------------
+| start_len (varint) | start | end_len (varint) | end | seq (varint) | ... | crc32 (4B) | size (u32) |
+-------------------------------------------------------------------------------------------------
+The size covers the tombstones only, so the block can be located by reading
+backwards from the byte it ends at.
+*/
+const RANGE_DEL_TRAILER_SIZE = 8
+
+func encodeRangeDelBlock(tombstones []RangeTombstone) []byte{
+	var buf []byte
+	for _,t := range tombstones{
+		buf = binary.AppendUvarint(buf,uint64(len(t.start)))
+		buf = append(buf, t.start...)
+		buf = binary.AppendUvarint(buf,uint64(len(t.end)))
+		buf = append(buf, t.end...)
+		buf = binary.AppendUvarint(buf,t.seq)
+	}
+	size := len(buf)
+	buf = binary.BigEndian.AppendUint32(buf,crc32.ChecksumIEEE(buf))
+	return binary.BigEndian.AppendUint32(buf,uint32(size))
+}
+
+func decodeRangeDelBlock(data []byte) ([]RangeTombstone,error){
+	if len(data) < RANGE_DEL_TRAILER_SIZE{
+		return nil,fmt.Errorf("range deletion block too small")
+	}
+	checksum := binary.BigEndian.Uint32(data[len(data)-RANGE_DEL_TRAILER_SIZE:])
+	data = data[:len(data)-RANGE_DEL_TRAILER_SIZE]
+	if checksum != crc32.ChecksumIEEE(data){
+		return nil,fmt.Errorf("range deletion block checksum mismatched")
+	}
+	readBytes := func() ([]byte,error){
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l{
+			return nil,fmt.Errorf("invalid range deletion block")
+		}
+		b := data[n:n+int(l)]
+		data = data[n+int(l):]
+		return b,nil
+	}
+	var tombstones []RangeTombstone
+	for len(data) > 0{
+		start,err := readBytes()
+		if err!=nil{
+			return nil,err
+		}
+		end,err := readBytes()
+		if err!=nil{
+			return nil,err
+		}
+		seq, n := binary.Uvarint(data)
+		if n <= 0{
+			return nil,fmt.Errorf("invalid range deletion block")
+		}
+		data = data[n:]
+		tombstones = append(tombstones, NewRangeTombstone(start,end,seq))
+	}
+	return tombstones,nil
+}
+
+// RangeDelIterator hides the versions yielded by iter that a newer range
+// tombstone covers. iter must yield encoded internal values.
+type RangeDelIterator struct{
+	iter BidirectionalIterator
+	tombstones []RangeTombstone
+	cmp Comparator
+	err error
+}
+
+func NewRangeDelIterator(iter BidirectionalIterator, tombstones []RangeTombstone, cmp Comparator) *RangeDelIterator{
+	r := &RangeDelIterator{iter: iter, tombstones: tombstones, cmp: comparatorOrDefault(cmp)}
+	r.err = r.skipCovered(iter.Next)
+	return r
+}
+
+// skipCovered moves iter with move until it is on a version no tombstone covers.
+func (r *RangeDelIterator) skipCovered(move func() error) error{
+	for len(r.tombstones)>0 && r.iter.IsValid(){
+		iv,err := DecodeInternalValue(r.iter.Value())
+		if err!=nil{
+			return err
+		}
+		if iv.seq >= MaxCoveringSeq(r.tombstones,r.iter.Key(),r.cmp){
+			return nil
+		}
+		if err := move();err!=nil{
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RangeDelIterator) Key() []byte{
+	return r.iter.Key()
+}
+
+func (r *RangeDelIterator) Value() []byte{
+	return r.iter.Value()
+}
+
+func (r *RangeDelIterator) IsValid() bool{
+	return r.err==nil && r.iter.IsValid()
+}
+
+func (r *RangeDelIterator) Error() error{
+	if r.err!=nil{
+		return r.err
+	}
+	return r.iter.Error()
+}
+
+func (r *RangeDelIterator) Next() error{
+	if err := r.iter.Next();err!=nil{
+		return err
+	}
+	r.err = r.skipCovered(r.iter.Next)
+	return r.err
+}
+
+func (r *RangeDelIterator) Prev() error{
+	if err := r.iter.Prev();err!=nil{
+		return err
+	}
+	r.err = r.skipCovered(r.iter.Prev)
+	return r.err
+}
+
+func (r *RangeDelIterator) SeekToFirst(){
+	r.iter.SeekToFirst()
+	r.err = r.skipCovered(r.iter.Next)
+}
+
+func (r *RangeDelIterator) SeekToKey(key []byte){
+	r.iter.SeekToKey(key)
+	r.err = r.skipCovered(r.iter.Next)
+}
+
+func (r *RangeDelIterator) SeekToLast(){
+	r.iter.SeekToLast()
+	r.err = r.skipCovered(r.iter.Prev)
+}
+
+func (r *RangeDelIterator) SeekForPrev(key []byte){
+	r.iter.SeekForPrev(key)
+	r.err = r.skipCovered(r.iter.Prev)
+}
@@ -0,0 +1,139 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// RangeFilter answers whether a table may hold any key in a range, which a
+// bloom filter can't. Like the base SuRF trie it keeps every distinct key
+// truncated to a few bytes, sorted, so a range is ruled out when no
+// truncated key can start a key in it.
+type RangeFilter struct{
+	prefixLen int
+	prefixes [][]byte
+}
+
+// rangeFilterBuilder collects the truncated keys of a table in order.
+type rangeFilterBuilder struct{
+	prefixLen int
+	prefixes [][]byte
+}
+
+func (b *rangeFilterBuilder) add(key []byte){
+	p := key[:min(len(key),b.prefixLen)]
+	if n := len(b.prefixes); n > 0 && bytes.Equal(b.prefixes[n-1],p){
+		return
+	}
+	b.prefixes = append(b.prefixes, append([]byte{},p...))
+}
+
+func (b *rangeFilterBuilder) build() *RangeFilter{
+	return &RangeFilter{prefixLen: b.prefixLen, prefixes: b.prefixes}
+}
+
+// upper returns the end of the keys truncated to prefix i, exclusive, nil if
+// they run to the last key.
+func (f *RangeFilter) upper(i int) []byte{
+	p := f.prefixes[i]
+	if len(p) < f.prefixLen{
+		// not truncated, so it is the key itself
+		return append(append([]byte{},p...),0)
+	}
+	return PrefixSuccessor(p)
+}
+
+// MayContainRange reports whether a key in [start, end) may be in the table.
+// A nil start or end leaves that side unbounded.
+func (f *RangeFilter) MayContainRange(start []byte, end []byte) bool{
+	// the ends of the truncated keys grow with them, so the first one past
+	// start is the only candidate
+	i := sort.Search(len(f.prefixes),func(i int) bool{
+		upper := f.upper(i)
+		return start==nil || upper==nil || bytes.Compare(upper,start) > 0
+	})
+	return i < len(f.prefixes) && (end==nil || bytes.Compare(f.prefixes[i],end) < 0)
+}
+
+/*
+Range Filter Block Encoding
+----------------------------------------------------------------------------------
+| prefix len (uvarint) | Entry #1 | ... | Entry #N | checksum (u32) | size (u32) |
+----------------------------------------------------------------------------------
+| Entry: shared with previous (uvarint) | rest len (uvarint) | rest |
+--------------------------------------------------------------------
+A table without a range filter has an empty block, just the trailer.
+*/
+
+const RANGE_FILTER_TRAILER_SIZE = 8
+
+func encodeRangeFilterBlock(f *RangeFilter) []byte{
+	var buf []byte
+	if f!=nil{
+		buf = binary.AppendUvarint(buf,uint64(f.prefixLen))
+		var prev []byte
+		for _,p := range f.prefixes{
+			shared := 0
+			for shared < len(prev) && shared < len(p) && prev[shared]==p[shared]{
+				shared++
+			}
+			buf = binary.AppendUvarint(buf,uint64(shared))
+			buf = binary.AppendUvarint(buf,uint64(len(p)-shared))
+			buf = append(buf, p[shared:]...)
+			prev = p
+		}
+	}
+	size := len(buf)
+	buf = binary.BigEndian.AppendUint32(buf,crc32.ChecksumIEEE(buf))
+	return binary.BigEndian.AppendUint32(buf,uint32(size))
+}
+
+func decodeRangeFilterBlock(data []byte) (*RangeFilter,error){
+	if len(data) < RANGE_FILTER_TRAILER_SIZE{
+		return nil,fmt.Errorf("range filter block too small")
+	}
+	checksum := binary.BigEndian.Uint32(data[len(data)-RANGE_FILTER_TRAILER_SIZE:])
+	data = data[:len(data)-RANGE_FILTER_TRAILER_SIZE]
+	if checksum != crc32.ChecksumIEEE(data){
+		return nil,fmt.Errorf("range filter block checksum mismatched")
+	}
+	if len(data) == 0{
+		return nil,nil
+	}
+	errInvalid := fmt.Errorf("invalid range filter block")
+	readUvarint := func() (int,error){
+		v, n := binary.Uvarint(data)
+		if n <= 0 || v > uint64(len(data)){
+			return 0,errInvalid
+		}
+		data = data[n:]
+		return int(v),nil
+	}
+	prefixLen,err := readUvarint()
+	if err!=nil{
+		return nil,err
+	}
+	f := &RangeFilter{prefixLen: prefixLen}
+	var prev []byte
+	for len(data) > 0{
+		shared,err := readUvarint()
+		if err!=nil{
+			return nil,err
+		}
+		rest,err := readUvarint()
+		if err!=nil{
+			return nil,err
+		}
+		if shared > len(prev) || rest > len(data){
+			return nil,errInvalid
+		}
+		p := append(append(make([]byte,0,shared+rest),prev[:shared]...),data[:rest]...)
+		data = data[rest:]
+		f.prefixes = append(f.prefixes, p)
+		prev = p
+	}
+	return f,nil
+}
@@ -0,0 +1,119 @@
+package table
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeFilter(t *testing.T){
+	keys := []string{"apple","apricot","b","banana","cherry","cherry\xff\xff","date"}
+	b := &rangeFilterBuilder{prefixLen: 3}
+	for _,k := range keys{
+		b.add([]byte(k))
+	}
+	f := b.build()
+	require.Len(t,f.prefixes,6)
+
+	cases := []struct{
+		start, end string
+		want bool
+	}{
+		{"a","b",true},
+		{"aq","apr",false},
+		{"apq","aps",true},
+		{"b","b\x00",true},
+		{"b\x00","ban",false},
+		{"bb","c",false},
+		{"cha","chf",true},
+		{"ci","d",false},
+		{"dat","",true},
+		{"e","",false},
+		{"","a",false},
+	}
+	for _,c := range cases{
+		var start, end []byte
+		if c.start!=""{
+			start = []byte(c.start)
+		}
+		if c.end!=""{
+			end = []byte(c.end)
+		}
+		require.Equal(t,c.want,f.MayContainRange(start,end),"[%q, %q)",c.start,c.end)
+	}
+
+	decoded, err := decodeRangeFilterBlock(encodeRangeFilterBlock(f))
+	require.NoError(t,err)
+	require.Equal(t,f,decoded)
+	none, err := decodeRangeFilterBlock(encodeRangeFilterBlock(nil))
+	require.NoError(t,err)
+	require.Nil(t,none)
+}
+
+func TestRangeFilterNoFalseNegatives(t *testing.T){
+	rng := rand.New(rand.NewSource(1))
+	randKey := func() []byte{
+		key := make([]byte,rng.Intn(6))
+		for i := range key{
+			key[i] = "abc\xff"[rng.Intn(4)]
+		}
+		return key
+	}
+	var keys [][]byte
+	for i := 0; i < 200; i++{
+		keys = append(keys, randKey())
+	}
+	sort.Slice(keys,func(i, j int) bool{ return bytes.Compare(keys[i],keys[j]) < 0 })
+	b := &rangeFilterBuilder{prefixLen: 3}
+	for _,k := range keys{
+		b.add(k)
+	}
+	f := b.build()
+	for i := 0; i < 2000; i++{
+		start, end := randKey(), randKey()
+		if bytes.Compare(start,end) > 0{
+			start, end = end, start
+		}
+		for _,k := range keys{
+			if bytes.Compare(k,start) >= 0 && bytes.Compare(k,end) < 0{
+				require.True(t,f.MayContainRange(start,end),"%q in [%q, %q)",k,start,end)
+				break
+			}
+		}
+	}
+}
+
+func TestSSTRangeFilterPersisted(t *testing.T){
+	dir := t.TempDir() + "/"
+	builder := NewSSTBuilder(4096)
+	builder.SetRangeFilterPrefixLen(6)
+	builder.AddRangeTombstone(NewRangeTombstone([]byte("a"),[]byte("z"),1))
+	for i := 0; i < 100; i++{
+		builder.Add([]byte(fmt.Sprintf("key%03d",i*10)),[]byte("v"))
+	}
+	built := builder.Build(0,dir + "0.sst")
+
+	fw, err := OpenFileWrapper(dir + "0.sst")
+	require.NoError(t,err)
+	opened, err := OpenSSTable(0,fw,nil)
+	require.NoError(t,err)
+	require.Equal(t,built.handle.reader.rangeFilter,opened.handle.reader.rangeFilter)
+	require.Equal(t,built.RangeTombstones(),opened.RangeTombstones())
+	for _,sst := range []*SSTable{built,opened}{
+		require.True(t,sst.MayContainRange([]byte("key100"),[]byte("key101")))
+		require.False(t,sst.MayContainRange([]byte("key101"),[]byte("key109")))
+		require.False(t,sst.MayContainRange([]byte("key991"),nil))
+		require.False(t,sst.MayContainRange(nil,[]byte("key000")))
+		require.True(t,sst.MayContainRange(nil,nil))
+	}
+	iter := CreateSSTIterAndSeekToFirst(opened)
+	count := 0
+	for ; iter.IsValid(); iter.Next(){
+		count++
+	}
+	require.Equal(t,100,count)
+}
@@ -0,0 +1,302 @@
+package table
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"math/rand"
+	"sync/atomic"
+	"unsafe"
+)
+
+// ErrArenaFull is returned by Memtable.Put when the entry doesn't fit in what
+// is left of the memtable's arena. The memtable has to be replaced by a new
+// one to take it.
+var ErrArenaFull = errors.New("memtable arena is full")
+
+const (
+	maxSkiplistHeight = 20
+	// a node reaches the next level with probability 1/3
+	skiplistHeightIncrease = math.MaxUint32/3
+	// bytes of the sequence number trailer of internal keys
+	internalKeyTrailerLen = 8
+)
+
+/*
+Arena Skiplist
+-----------------------------------------------------------------------------------------
+| node: keyOffset | keySize | valueOffset | valueSize | height | tower[height] | key | value |
+-----------------------------------------------------------------------------------------
+Nodes and their keys and values are bump allocated from one byte slice and link to each
+other by arena offset, offset 0 being nil. Only the levels a node reaches are allocated
+of its tower. Inserts link a node in from the bottom level up with a compare and swap on
+each level, retrying the level from where it failed when another insert got there first.
+Reads only load links, so they never wait on writers. Nothing is ever removed or updated,
+every version of a key is its own node.
+
+Keys are internal keys, the user key followed by ^seq big endian, so the versions of a key
+sort newest first.
+*/
+type arena struct{
+	n atomic.Uint32
+	// bytes that can be allocated, buf has a full node more so a node near
+	// the end can be read as a whole struct
+	limit uint64
+	buf []byte
+}
+
+func newArena(size int64) *arena{
+	size = max(min(size,math.MaxUint32-int64(fullNodeSize)),1)
+	a := &arena{limit: uint64(size), buf: make([]byte,size+int64(fullNodeSize))}
+	// offset 0 stands for nil
+	a.n.Store(1)
+	return a
+}
+
+// allocate reserves size bytes aligned to 4, ok false if they don't fit.
+func (a *arena) allocate(size uint32) (uint32,bool){
+	for{
+		n := a.n.Load()
+		offset := (n+3) &^ 3
+		end := uint64(offset)+uint64(size)
+		if end > a.limit{
+			return 0,false
+		}
+		if a.n.CompareAndSwap(n,uint32(end)){
+			return offset,true
+		}
+	}
+}
+
+// size returns the bytes allocated so far.
+func (a *arena) size() int64{
+	return int64(a.n.Load())
+}
+
+type skiplistNode struct{
+	keyOffset uint32
+	keySize uint32
+	valueOffset uint32
+	valueSize uint32
+	height uint32
+	// links to the next node on each level, only height of them allocated
+	tower [maxSkiplistHeight]uint32
+}
+
+const fullNodeSize = uint32(unsafe.Sizeof(skiplistNode{}))
+
+// nodeSize returns the arena bytes of a node reaching height levels.
+func nodeSize(height int) uint32{
+	return fullNodeSize - uint32(maxSkiplistHeight-height)*uint32(unsafe.Sizeof(uint32(0)))
+}
+
+type skiplist struct{
+	arena *arena
+	head uint32
+	height atomic.Int32
+	cmp Comparator
+}
+
+// newSkiplist creates a skiplist taking arenaSize bytes of nodes, the head
+// node being allocated on top.
+func newSkiplist(arenaSize int64, cmp Comparator) *skiplist{
+	a := newArena(max(arenaSize,0)+int64(fullNodeSize)+1)
+	head,_ := a.allocate(fullNodeSize)
+	s := &skiplist{arena: a, head: head, cmp: cmp}
+	s.node(head).height = maxSkiplistHeight
+	s.height.Store(1)
+	return s
+}
+
+func (s *skiplist) node(offset uint32) *skiplistNode{
+	return (*skiplistNode)(unsafe.Pointer(&s.arena.buf[offset]))
+}
+
+func (s *skiplist) key(offset uint32) []byte{
+	n := s.node(offset)
+	return s.arena.buf[n.keyOffset:n.keyOffset+n.keySize:n.keyOffset+n.keySize]
+}
+
+func (s *skiplist) value(offset uint32) []byte{
+	n := s.node(offset)
+	return s.arena.buf[n.valueOffset:n.valueOffset+n.valueSize:n.valueOffset+n.valueSize]
+}
+
+func (s *skiplist) next(offset uint32, level int) uint32{
+	return atomic.LoadUint32(&s.node(offset).tower[level])
+}
+
+// compare orders internal keys by user key with s.cmp, then newest first.
+func (s *skiplist) compare(a []byte, b []byte) int{
+	ua, ub := a[:len(a)-internalKeyTrailerLen], b[:len(b)-internalKeyTrailerLen]
+	if c := s.cmp.Compare(ua,ub); c!=0{
+		return c
+	}
+	return bytes.Compare(a[len(ua):],b[len(ub):])
+}
+
+func randomHeight() int{
+	h := 1
+	for h < maxSkiplistHeight && rand.Uint32() <= skiplistHeightIncrease{
+		h++
+	}
+	return h
+}
+
+// findSplice returns the nodes key goes between on level, starting the
+// search from before. Both are the same node if it holds key.
+func (s *skiplist) findSplice(key []byte, before uint32, level int) (uint32,uint32){
+	for{
+		next := s.next(before,level)
+		if next==0{
+			return before,0
+		}
+		c := s.compare(key,s.key(next))
+		if c==0{
+			return next,next
+		}
+		if c < 0{
+			return before,next
+		}
+		before = next
+	}
+}
+
+// insert adds a node for the internal key with value, ErrArenaFull if they
+// don't fit. It is safe to call from many goroutines, and with readers. A key
+// already there is left as it is, the same key being the same version.
+func (s *skiplist) insert(key []byte, value []byte) error{
+	listHeight := int(s.height.Load())
+	var prev, next [maxSkiplistHeight+1]uint32
+	prev[listHeight] = s.head
+	for i := listHeight-1; i >= 0; i--{
+		prev[i],next[i] = s.findSplice(key,prev[i+1],i)
+		if prev[i]==next[i]{
+			return nil
+		}
+	}
+	height := randomHeight()
+	x,ok := s.newNode(key,value,height)
+	if !ok{
+		return ErrArenaFull
+	}
+	for h := s.height.Load(); int(h) < height; h = s.height.Load(){
+		if s.height.CompareAndSwap(h,int32(height)){
+			break
+		}
+	}
+	for i := 0; i < height; i++{
+		for{
+			if prev[i]==0{
+				// the list was lower than this level when the search started
+				prev[i],next[i] = s.findSplice(key,s.head,i)
+			}
+			atomic.StoreUint32(&s.node(x).tower[i],next[i])
+			if atomic.CompareAndSwapUint32(&s.node(prev[i]).tower[i],next[i],x){
+				break
+			}
+			// another insert linked a node in between, search on from prev
+			prev[i],next[i] = s.findSplice(key,prev[i],i)
+			if prev[i]==next[i] && i==0{
+				// inserted meanwhile, x is left unlinked
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+func (s *skiplist) newNode(key []byte, value []byte, height int) (uint32,bool){
+	size := nodeSize(height)
+	offset,ok := s.arena.allocate(size+uint32(len(key)+len(value)))
+	if !ok{
+		return 0,false
+	}
+	n := s.node(offset)
+	n.keyOffset = offset+size
+	n.keySize = uint32(len(key))
+	n.valueOffset = n.keyOffset+n.keySize
+	n.valueSize = uint32(len(value))
+	n.height = uint32(height)
+	copy(s.arena.buf[n.keyOffset:],key)
+	copy(s.arena.buf[n.valueOffset:],value)
+	return offset,true
+}
+
+// findGreaterOrEqual returns the first node at or after key, 0 if there is
+// none.
+func (s *skiplist) findGreaterOrEqual(key []byte) uint32{
+	x := s.head
+	for level := int(s.height.Load())-1; ; {
+		next := s.next(x,level)
+		if next!=0{
+			c := s.compare(key,s.key(next))
+			if c > 0{
+				x = next
+				continue
+			}
+			if c==0{
+				return next
+			}
+		}
+		if level==0{
+			return next
+		}
+		level--
+	}
+}
+
+// findLess returns the last node before key, or at it with orEqual. 0 if
+// there is none.
+func (s *skiplist) findLess(key []byte, orEqual bool) uint32{
+	x := s.head
+	for level := int(s.height.Load())-1; ; {
+		next := s.next(x,level)
+		if next!=0{
+			c := s.compare(s.key(next),key)
+			if c < 0 || (orEqual && c==0){
+				x = next
+				continue
+			}
+		}
+		if level==0{
+			break
+		}
+		level--
+	}
+	if x==s.head{
+		return 0
+	}
+	return x
+}
+
+// findLast returns the last node, 0 if the list is empty.
+func (s *skiplist) findLast() uint32{
+	x := s.head
+	for level := int(s.height.Load())-1; ; {
+		if next := s.next(x,level); next!=0{
+			x = next
+			continue
+		}
+		if level==0{
+			break
+		}
+		level--
+	}
+	if x==s.head{
+		return 0
+	}
+	return x
+}
+
+// appendInternalKey appends the internal key of key at seq to dst.
+func appendInternalKey(dst []byte, key []byte, seq uint64) []byte{
+	dst = append(dst,key...)
+	return binary.BigEndian.AppendUint64(dst,^seq)
+}
+
+// internalKeySeq returns the sequence number of an internal key.
+func internalKeySeq(ikey []byte) uint64{
+	return ^binary.BigEndian.Uint64(ikey[len(ikey)-internalKeyTrailerLen:])
+}
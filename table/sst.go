@@ -4,8 +4,11 @@ import (
 	"anchordb/block"
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"hash/crc32"
+	"log"
+	"math"
 	"sort"
 )
 
@@ -13,40 +16,68 @@ const(
 	BLOCK_OFFSET_SIZE = block.OFFSET_SIZE
 	META_BLOCK_COUNT_SIZE = 4
 	META_OFFSET_SIZE = 4
+	FILTER_OFFSET_SIZE = 4
 	KEY_LENGTH_SIZE = 2
 )
 
 type Key []byte
 
+// ErrCorruption is wrapped by the errors of table data that can't be decoded.
+var ErrCorruption = errors.New("corruption")
+
+// ErrComparatorMismatch is returned opening a table with a comparator other
+// than the one it was written with.
+var ErrComparatorMismatch = errors.New("comparator mismatch")
+
 /*
 Sorted String Table Encoding
---------------------------------------------------------------------------------------------
-|           Blocks          |              Meta                   |      Extra             |
--------------------------------------------------------------------------------------------
-| Block #1 | ... | Block #N | Meta block #1 | ... | Meta block #N | meta block offset(u32) |
---------------------------------------------------------------------------------------------
+-----------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------
+| Block #1 | ... | Block #N | Range deletion block | Range filter block | Compression dictionary block | Properties block | Meta block #1 | ... | Meta block #N | Filter block | Footer |
+-----------------------------------------------------------------------------------------------------------------------------------------------------------------------------------------
+The meta starts with an index type byte. With a partitioned index the index and
+filter partitions sit between the blocks and the range deletion block, and
+there is no table-wide filter block. The footer holds the handles of the meta,
+filter and properties blocks. The blocks between the range deletions and the
+properties end in their size, so each is found from the one after it.
 */
 
 type BlockMeta struct{
 	offset uint32
-	firstKey []byte
-	lastKey []byte
+	// bytes of the block as stored, 0 if the table didn't record it
+	size uint32
+	// a key at or after the last key of the block and at or before the first
+	// key of the next one, as short as the comparator finds. The last block's
+	// is its last key.
+	separator []byte
 }
 
+// SSTable keeps what is needed to pick the tables to read in memory. Its
+// file, index and filters are in a tableReader, which the table cache may
+// close while the table isn't read.
 type SSTable struct{
 	Id int
-	blockMeta []BlockMeta
+	handle *tableHandle
+	cache *BlockCache
+	// blocks read through this table are not added to the cache
+	noFillCache bool
 	blockMetaOffset uint32
-	fileWrap *FileWrapper
+	// end of the data blocks, where the range deletion block starts
+	dataEndOffset uint32
+	rangeDels []RangeTombstone
 	firstKey []byte
 	lastKey []byte
-	BloomFilter BloomFilter
+	// name of the extractor whose prefixes are in the filter
+	prefixExtractor string
+	properties TableProperties
+	comparator Comparator
 }
 
 type SSTIterator struct{
 	sst *SSTable
 	blockIdx int
 	blockIter *block.BlockIterator
+	// the block that couldn't be read, which stopped the iterator
+	err error
 }
 
 type LevelIterator struct{
@@ -69,166 +100,589 @@ func (s *SSTable) GetLastKey()[]byte{
 	return s.lastKey
 }
 
-func calculateEstimatedBlockMetaSize(blockMeta []BlockMeta) int{
-	estSize := META_BLOCK_COUNT_SIZE
-	for _,meta := range blockMeta{
-		estSize += META_OFFSET_SIZE
-		estSize += KEY_LENGTH_SIZE + len(meta.firstKey)
-		//estSize += 2 + len(meta.lastKey)
+func (s *SSTable) RangeTombstones() []RangeTombstone{
+	return s.rangeDels
+}
+
+// MayContainPrefix reports whether the table may hold keys starting with
+// prefix, which must be a whole prefix of extractor.
+func (s *SSTable) MayContainPrefix(extractor PrefixExtractor, prefix []byte) bool{
+	// the keys of a prefix are a range of the table in bytewise order only
+	bytewise := IsBytewise(s.comparator)
+	if bytewise && bytes.Compare(s.lastKey,prefix) < 0{
+		return false
+	}
+	if succ := PrefixSuccessor(prefix); bytewise && succ!=nil && bytes.Compare(s.firstKey,succ) >= 0{
+		return false
+	}
+	if s.prefixExtractor=="" || s.prefixExtractor != prefixExtractorName(extractor){
+		return true
+	}
+	r := s.acquire()
+	defer s.release(r)
+	if r!=nil && r.partitions!=nil && !bytewise{
+		// the partitions with keys of the prefix can't be found
+		return true
+	}
+	if r!=nil && r.partitions!=nil{
+		return s.partitionsMayContain(r,prefix,PrefixSuccessor(prefix))
+	}
+	return r==nil || r.filter==nil || r.filter.MayContainKey(prefix)
+}
+
+// MayContainRange reports whether a key in [start, end) may be in the table,
+// going by its key range and range filter. A nil start or end leaves that
+// side unbounded.
+func (s *SSTable) MayContainRange(start []byte, end []byte) bool{
+	if s.firstKey==nil{
+		return false
+	}
+	if start!=nil && s.comparator.Compare(s.lastKey,start) < 0{
+		return false
+	}
+	if end!=nil && s.comparator.Compare(s.firstKey,end) >= 0{
+		return false
+	}
+	r := s.acquire()
+	defer s.release(r)
+	return r==nil || r.rangeFilter==nil || r.rangeFilter.MayContainRange(start,end)
+}
+
+// MayContain reports whether the filter of the table lets key through.
+func (s *SSTable) MayContain(key []byte) bool{
+	r := s.acquire()
+	defer s.release(r)
+	if r!=nil && r.partitions!=nil{
+		return s.partitionsMayContain(r,key,nil)
+	}
+	return r==nil || r.filter==nil || r.filter.MayContainKey(key)
+}
+
+// Filter returns the table-wide filter, nil if the table has none or its
+// index is partitioned.
+func (s *SSTable) Filter() Filter{
+	r := s.acquire()
+	defer s.release(r)
+	if r==nil{
+		return nil
+	}
+	return r.filter
+}
+
+// Advise tells the kernel how the table will be read if it is mapped.
+func (s *SSTable) Advise(p AccessPattern){
+	r := s.acquire()
+	defer s.release(r)
+	if r==nil{
+		return
+	}
+	if err := r.file.Advise(p); err!=nil{
+		log.Printf("failed to advise sstable %d: %v",s.Id,err)
+	}
+}
+
+// SetTableCache makes c count the table as open, so it is closed when too
+// many are.
+func (s *SSTable) SetTableCache(c *TableCache){
+	s.handle.cache = c
+	if s.handle.reader!=nil{
+		c.touch(s.handle)
 	}
-	return estSize
 }
-func encodeBlockMetaData(blockMeta []BlockMeta)([]byte){
-	estimatedSize := calculateEstimatedBlockMetaSize(blockMeta)
-	buf := bytes.NewBuffer(make([]byte, estimatedSize))
 
-	//TODO: handle errors
-	binary.Write(buf,binary.BigEndian,uint32(len(blockMeta)))
+func prefixExtractorName(p PrefixExtractor) string{
+	if p==nil{
+		return ""
+	}
+	return p.Name()
+}
+
+// SetBlockCache makes the table read its blocks and its index and filter
+// partitions through c.
+func (s *SSTable) SetBlockCache(c *BlockCache){
+	s.cache = c
+}
+
+// WithoutCacheFill returns a view of the table whose block reads use the
+// cache but don't add to it, so a large scan doesn't evict hot blocks.
+func (s *SSTable) WithoutCacheFill() *SSTable{
+	view := *s
+	view.noFillCache = true
+	return &view
+}
+
+/*
+Block Meta Encoding
+---------------------------------------------------------------------------------------------------------
+| count (uvarint) | first_key_len (uvarint) | first_key |          Meta #1           | ... | checksum (u32) |
+---------------------------------------------------------------------------------------------------------
+| Meta: offset (uvarint) | size (uvarint) | separator_len (uvarint) | separator |
+---------------------------------------------------------------------------------
+The first key is that of the first block, the size spans the block with its
+compression type and checksum. Tables before FormatVersion3 have the first
+and last key of every block instead of the first key and separators:
+| count (uvarint) | offset (uvarint) | size (uvarint) | first_key_len (uvarint) | first_key | last_key_len (uvarint) | last_key | ... | checksum (u32) |
+and before FormatVersion2 without sizes or a checksum:
+| count (u32) | offset (u32) | first_key_len (u16) | first_key | last_key_len (u16) | last_key | ... |
+*/
+
+func encodeBlockMetaData(firstKey []byte, blockMeta []BlockMeta) []byte{
+	buf := binary.AppendUvarint(nil,uint64(len(blockMeta)))
+	buf = binary.AppendUvarint(buf,uint64(len(firstKey)))
+	buf = append(buf, firstKey...)
 	for _,meta := range blockMeta{
-		binary.Write(buf,binary.BigEndian,meta.offset)
-		binary.Write(buf,binary.BigEndian,uint16(len(meta.firstKey)))
-		binary.Write(buf,binary.BigEndian,meta.firstKey)
-		binary.Write(buf,binary.BigEndian,uint16(len(meta.lastKey)))
-		binary.Write(buf,binary.BigEndian,meta.lastKey)
-	}
-	return buf.Bytes()
-}
-
-func decodeBlockMetaData(data []byte) []BlockMeta{
-	buf := bytes.NewReader(data)
-	var numEntries uint32
-	_ = binary.Read(buf,binary.BigEndian,&numEntries)
-	blockMeta := make([]BlockMeta,0,numEntries)
-	//TODO: handle errors
-	for i:=uint32(0);i<numEntries;i++ {
+		buf = binary.AppendUvarint(buf,uint64(meta.offset))
+		buf = binary.AppendUvarint(buf,uint64(meta.size))
+		buf = binary.AppendUvarint(buf,uint64(len(meta.separator)))
+		buf = append(buf, meta.separator...)
+	}
+	return binary.BigEndian.AppendUint32(buf,crc32.ChecksumIEEE(buf))
+}
+
+// metaDecoder reads the fields of block metas, the first failure sticking in
+// err.
+type metaDecoder struct{
+	data []byte
+	legacy bool
+	// meta being read
+	idx uint64
+	err error
+}
+
+func (d *metaDecoder) fail(format string, args ...interface{}){
+	if d.err==nil{
+		d.err = fmt.Errorf("%w: block meta %d: %s",ErrCorruption,d.idx,fmt.Sprintf(format,args...))
+	}
+}
+
+// number reads a field of size bytes in the legacy encoding, a uvarint
+// otherwise.
+func (d *metaDecoder) number(field string, size int) uint64{
+	if d.err!=nil{
+		return 0
+	}
+	if d.legacy{
+		if len(d.data) < size{
+			d.fail("%s truncated",field)
+			return 0
+		}
+		var v uint64
+		for _,b := range d.data[:size]{
+			v = v<<8 | uint64(b)
+		}
+		d.data = d.data[size:]
+		return v
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0{
+		d.fail("invalid %s",field)
+		return 0
+	}
+	if v > math.MaxUint32{
+		d.fail("%s %d out of range",field,v)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *metaDecoder) key(field string) []byte{
+	l := d.number(field+" length",KEY_LENGTH_SIZE)
+	if d.err!=nil{
+		return nil
+	}
+	if l > uint64(len(d.data)){
+		d.fail("%s of %d bytes past the end",field,l)
+		return nil
+	}
+	key := append([]byte{},d.data[:l]...)
+	d.data = d.data[l:]
+	return key
+}
+
+// decodeBlockMetaData returns the block metas and the first key of the first
+// block. The metas of older tables get their last keys as separators.
+func decodeBlockMetaData(data []byte, formatVersion uint32, cmp Comparator) ([]BlockMeta,[]byte,error){
+	d := metaDecoder{data: data, legacy: formatVersion < FormatVersion2}
+	separators := formatVersion >= FormatVersion3
+	if !d.legacy{
+		if len(data) < 4{
+			return nil,nil,fmt.Errorf("%w: block meta of %d bytes has no checksum",ErrCorruption,len(data))
+		}
+		crcOff := len(data)-4
+		if crc32.ChecksumIEEE(data[:crcOff]) != binary.BigEndian.Uint32(data[crcOff:]){
+			return nil,nil,fmt.Errorf("%w: block meta checksum mismatched",ErrCorruption)
+		}
+		d.data = data[:crcOff]
+	}
+	count := d.number("count",META_BLOCK_COUNT_SIZE)
+	var firstKey []byte
+	if separators{
+		firstKey = d.key("first key")
+	}
+	// a meta takes at least 3 bytes
+	if d.err==nil && count > uint64(len(d.data))/3{
+		return nil,nil,fmt.Errorf("%w: %d block metas can't fit in %d bytes",ErrCorruption,count,len(d.data))
+	}
+	blockMeta := make([]BlockMeta,0,count)
+	// keys of the blocks up to here are at or before it
+	prev := firstKey
+	for ; d.idx < count && d.err==nil; d.idx++{
 		var meta BlockMeta
-		var firstKeyLen uint16
-		binary.Read(buf,binary.BigEndian,&meta.offset)
-		binary.Read(buf,binary.BigEndian,&firstKeyLen)
-		meta.firstKey = make([]byte, firstKeyLen)
-		//binary.Read(buf,binary.BigEndian,&lastKeyLen)
-		//meta.lastKey = make([]byte, lastKeyLen)
+		meta.offset = uint32(d.number("offset",META_OFFSET_SIZE))
+		if !d.legacy{
+			meta.size = uint32(d.number("size",0))
+		}
+		var blockFirstKey []byte
+		if !separators{
+			blockFirstKey = d.key("first key")
+		}
+		meta.separator = d.key("separator")
+		if d.err!=nil{
+			break
+		}
+		if d.idx == 0 && !separators{
+			firstKey, prev = blockFirstKey, blockFirstKey
+		}
+		if n := len(blockMeta); n > 0 && meta.offset <= blockMeta[n-1].offset{
+			d.fail("offset %d is not after the previous block at %d",meta.offset,blockMeta[n-1].offset)
+		} else if !separators && cmp.Compare(blockFirstKey,prev) < 0{
+			d.fail("first key %q is before the last key of the previous block",blockFirstKey)
+		} else if !separators && cmp.Compare(blockFirstKey,meta.separator) > 0{
+			d.fail("first key %q is after last key %q",blockFirstKey,meta.separator)
+		} else if cmp.Compare(meta.separator,prev) < 0{
+			d.fail("separator %q is before the keys of the blocks before it",meta.separator)
+		}
+		prev = meta.separator
 		blockMeta = append(blockMeta, meta)
 	}
-	return blockMeta
+	if d.err==nil && len(d.data) > 0{
+		d.fail("%d bytes left after the last block meta",len(d.data))
+	}
+	if d.err!=nil{
+		return nil,nil,d.err
+	}
+	return blockMeta,firstKey,nil
 }
 
-func OpenSSTable(id int,f *FileWrapper) *SSTable{
-	
-	blockMetaOffsetBytes := f.ReadAt(f.size-META_OFFSET_SIZE,META_OFFSET_SIZE)
-	blockMetaOffsetValue := binary.BigEndian.Uint32(blockMetaOffsetBytes)
-	metaSize := int(f.size - META_OFFSET_SIZE - int64(blockMetaOffsetValue))
-	blockMetaOffsets := f.ReadAt(int64(blockMetaOffsetValue),metaSize)
-	blockMeta := decodeBlockMetaData(blockMetaOffsets)
-	firstKey := blockMeta[0].firstKey
-	lastKey := blockMeta[len(blockMeta)-1].lastKey
-
-	return &SSTable{
+// OpenSSTable opens the table in f, whose keys must be ordered by cmp, nil
+// being BytewiseComparator.
+func OpenSSTable(id int,f *FileWrapper,cmp Comparator) (*SSTable,error){
+	r, sst, err := readTable(id,f,comparatorOrDefault(cmp))
+	if err!=nil{
+		return nil,err
+	}
+	sst.handle = &tableHandle{path: f.path, reader: r}
+	if f.data!=nil{
+		sst.handle.mmap = true
+		sst.handle.mapped = f
+	}
+	return sst,nil
+}
+
+// readTable parses the file of a table into its reader and what the table
+// keeps in memory. Only a footer it can't read fails it, other unreadable
+// blocks leave the table without what they hold.
+func readTable(id int,f *FileWrapper,cmp Comparator) (*tableReader,*SSTable,error){
+	ft, err := readFooter(f)
+	if err!=nil{
+		return nil,nil,err
+	}
+	blockMetaOffsetValue := uint32(ft.index.offset)
+	meta := f.ReadAt(int64(ft.index.offset),int(ft.index.size))
+	sst := &SSTable{
 		Id: id,
-		blockMeta: blockMeta,
-		fileWrap: f,
-		firstKey: firstKey,
-		lastKey: lastKey,
+		blockMetaOffset: blockMetaOffsetValue,
+		comparator: cmp,
+	}
+	if len(meta) == 0{
+		return nil,nil,fmt.Errorf("%w: empty meta block",ErrCorruption)
+	}
+	r := &tableReader{file: f, formatVersion: ft.formatVersion}
+	propertiesOffset := uint32(ft.properties.offset)
+	sst.properties,err = decodePropertiesBlock(f.ReadAt(int64(ft.properties.offset),int(ft.properties.size)))
+	if err!=nil{
+		log.Printf("failed to read properties: %v",err)
+	}
+	// the index is checked in the order of the comparator, so it must match.
+	// Tables written before it was recorded are bytewise.
+	written := sst.properties.Comparator
+	if written==""{
+		written = BytewiseComparator.Name()
+	}
+	if written != cmp.Name(){
+		return nil,nil,fmt.Errorf("%w: table was written with comparator %s, not %s",ErrComparatorMismatch,written,cmp.Name())
+	}
+
+	switch meta[0]{
+	case indexTypePartitioned:
+		r.partitions, err = decodeIndexPartitions(meta[1:],ft.formatVersion)
+		if err!=nil{
+			return nil,nil,err
+		}
+		if n := len(r.partitions); n > 0{
+			r.blockCount = int(r.partitions[n-1].firstBlock+r.partitions[n-1].numBlocks)
+			sst.firstKey = r.partitions[0].firstKey
+			sst.lastKey = r.partitions[n-1].lastKey
+		}
+	case indexTypeFlat:
+		var firstKey []byte
+		r.blockMeta, firstKey, err = decodeBlockMetaData(meta[1:],ft.formatVersion,cmp)
+		if err!=nil{
+			return nil,nil,err
+		}
+		if len(r.blockMeta) > 0{
+			sst.firstKey = firstKey
+			sst.lastKey = r.blockMeta[len(r.blockMeta)-1].separator
+		}
+		r.filter, err = decodeFilterBlock(f.ReadAt(int64(ft.filter.offset),int(ft.filter.size)))
+		if err!=nil{
+			log.Printf("failed to read filter: %v",err)
+			r.filter = nil
+		}
+	default:
+		return nil,nil,fmt.Errorf("%w: unknown index type %d",ErrCorruption,meta[0])
+	}
+
+	dictOffset := trailedBlockStart(f,propertiesOffset)
+	r.dictCompression,r.dict,err = decodeCompressionDictBlock(f.ReadAt(int64(dictOffset),int(propertiesOffset-dictOffset)))
+	if err!=nil{
+		log.Printf("failed to read compression dictionary: %v",err)
+	}
+
+	rangeFilterOffset := trailedBlockStart(f,dictOffset)
+	r.rangeFilter,err = decodeRangeFilterBlock(f.ReadAt(int64(rangeFilterOffset),int(dictOffset-rangeFilterOffset)))
+	if err!=nil{
+		log.Printf("failed to read range filter: %v",err)
+	}
+
+	dataEndOffset := trailedBlockStart(f,rangeFilterOffset)
+	sst.rangeDels,err = decodeRangeDelBlock(f.ReadAt(int64(dataEndOffset),int(rangeFilterOffset-dataEndOffset)))
+	if err!=nil{
+		log.Printf("failed to read range deletions: %v",err)
+	}
+	sst.dataEndOffset = dataEndOffset
+	if len(r.partitions) > 0{
+		sst.dataEndOffset = r.partitions[0].indexOffset
+	}
+	return r,sst,nil
+}
+
+// trailedBlockStart returns where the block ending at end starts, from the
+// size in its trailer. The range deletion, range filter, compression
+// dictionary and properties blocks all end in a checksum and their size.
+func trailedBlockStart(f *FileWrapper, end uint32) uint32{
+	const trailerSize = 8
+	trailer := f.ReadAt(int64(end)-trailerSize,trailerSize)
+	if len(trailer) < trailerSize{
+		return end
+	}
+	size := binary.BigEndian.Uint32(trailer[4:])
+	if uint64(size)+trailerSize > uint64(end){
+		return end
 	}
+	return end-trailerSize-size
+}
+
+// Properties returns what was recorded about the table when it was built.
+func (s *SSTable) Properties() TableProperties{
+	return s.properties
 }
 
 func (s *SSTable) getBlockCount() int{
-	return len(s.blockMeta)
+	r := s.acquire()
+	defer s.release(r)
+	return r.getBlockCount()
 }
 
-func (s *SSTable) readBlock(blockIdx int)*block.Block{
-	blockMeta := s.blockMeta[blockIdx]
-	var blockEndOffset uint32 = 0
-	if blockIdx+1 < len(s.blockMeta) {
-		blockEndOffset = s.blockMeta[blockIdx+1].offset
-	} else {
-		blockEndOffset = s.blockMetaOffset // Last block ends at block meta offset
+// readBlock returns the block at blockIdx, nil past the last block. A block
+// that can't be read, fails its checksum or can't be decoded is an
+// ErrCorruption.
+func (s *SSTable) readBlock(blockIdx int) (*block.Block,error){
+	r := s.acquire()
+	defer s.release(r)
+	if r==nil{
+		return nil,fmt.Errorf("sstable %d can't be read",s.Id)
+	}
+	if blockIdx >= r.getBlockCount(){
+		return nil,nil
+	}
+	blockMeta := s.blockMetaAt(r,blockIdx)
+	if cached, ok := s.cache.Get(s.Id,blockMeta.offset); ok{
+		return cached.(*block.Block),nil
+	}
+	blockEndOffset := blockMeta.offset+blockMeta.size
+	// older tables don't record sizes, a block ends where the next starts
+	if blockMeta.size == 0 && blockIdx+1 < r.getBlockCount() {
+		blockEndOffset = s.blockMetaAt(r,blockIdx+1).offset
+	} else if blockMeta.size == 0 {
+		blockEndOffset = s.dataEndOffset // Last block ends at the range deletion block
 	}
 	//fmt.Printf("BLCK ENDOFF IS %d, METAOFF IS %d,\n",blockEndOffset,blockMeta.offset)
 	
-	blockLen := int(blockEndOffset - blockMeta.offset - META_OFFSET_SIZE)
+	blockLen := int(blockEndOffset) - int(blockMeta.offset) - META_OFFSET_SIZE
 
 	if blockLen <= 0 {
-		fmt.Printf("invalid block length")
-		return nil
+		return nil,fmt.Errorf("%w: block %d of sstable %d has length %d",ErrCorruption,blockIdx,s.Id,blockLen)
 	}
-	blockDataWithChecksum := make([]byte, blockEndOffset-blockMeta.offset)
-	_, err := s.fileWrap.file.ReadAt(blockDataWithChecksum, int64(blockMeta.offset))
-	if err != nil {
-		fmt.Printf(err.Error())
-		return nil
+	// straight from the mapping if the file is mapped
+	blockDataWithChecksum := r.file.Slice(int64(blockMeta.offset),int(blockEndOffset-blockMeta.offset))
+	if blockDataWithChecksum == nil {
+		return nil,fmt.Errorf("%w: failed to read block %d of sstable %d",ErrCorruption,blockIdx,s.Id)
 	}
 	blockData := blockDataWithChecksum[:blockLen]
 	checksum := binary.BigEndian.Uint32(blockDataWithChecksum[blockLen:])
 	if checksum != crc32.ChecksumIEEE(blockData) {
-		fmt.Printf("block checksum mismatched")
-		return nil
+		return nil,fmt.Errorf("%w: checksum mismatch in block %d of sstable %d",ErrCorruption,blockIdx,s.Id)
+	}
+	// the compression type is the last byte before the checksum
+	compression := CompressionType(blockData[blockLen-1])
+	var dict []byte
+	if compression == r.dictCompression{
+		dict = r.dict
+	}
+	blockData, err := decompressBlock(compression,blockData[:blockLen-1],dict)
+	if err!=nil{
+		return nil,fmt.Errorf("%w: failed to decompress block %d of sstable %d: %v",ErrCorruption,blockIdx,s.Id,err)
 	}
 
-	block, _ := block.Decode(blockData)
-	return block
+	block, err := block.Decode(blockData)
+	if err!=nil{
+		return nil,fmt.Errorf("%w: failed to decode block %d of sstable %d: %v",ErrCorruption,blockIdx,s.Id,err)
+	}
+	if !IsBytewise(s.comparator){
+		block.SetCompare(s.comparator.Compare)
+	}
+	if !s.noFillCache{
+		// charged what it takes decoded
+		s.cache.Insert(s.Id,blockMeta.offset,block,len(blockData))
+	}
+	return block,nil
 }
 
+// getBlockIdx returns the first block that may hold key, the first whose
+// separator is at or after it. The blocks before only have keys before key,
+// and versions of key spanning blocks start in this one. Past the last
+// separator it is the last block.
 func (s *SSTable) getBlockIdx(key []byte) int{
-	idx:= sort.Search(len(s.blockMeta),func (i int) bool{
-		return bytes.Compare(s.blockMeta[i].firstKey,key) > 0
+	r := s.acquire()
+	defer s.release(r)
+	count := r.getBlockCount()
+	idx:= sort.Search(count,func (i int) bool{
+		return s.comparator.Compare(s.blockMetaAt(r,i).separator,key) >= 0
 	})
-	if idx == 0 {
-		return 0
-	}
-	return idx - 1
+	return max(min(idx,count-1),0)
 }
 
-func SeekToKeyBlock(sst *SSTable,key []byte) (*block.BlockIterator,int){
+func SeekToKeyBlock(sst *SSTable,key []byte) (*block.BlockIterator,int,error){
 	blockIdx := sst.getBlockIdx(key)
-	blk := sst.readBlock(blockIdx)
+	blk,err := sst.readBlock(blockIdx)
+	if err!=nil{
+		return block.NewBlockIterator(nil),blockIdx,err
+	}
 	blockIter := block.CreateBlockIterAndSeekToKey(blk,key)
 	if !blockIter.IsValid(){
 		blockIdx+=1
-		if blockIdx<= sst.getBlockCount(){
-			blk = sst.readBlock(blockIdx)
+		if blockIdx < sst.getBlockCount(){
+			if blk,err = sst.readBlock(blockIdx); err!=nil{
+				return block.NewBlockIterator(nil),blockIdx,err
+			}
 			blockIter = block.CreateBlockIterAndSeekToFirst(blk)
 		}
 	}
-	return blockIter,blockIdx
+	return blockIter,blockIdx,nil
 }
 
-func SeekToFirstBlock(sst *SSTable) *block.BlockIterator{
-	blk := sst.readBlock(0)
-	return block.CreateBlockIterAndSeekToFirst(blk)
+func SeekToFirstBlock(sst *SSTable) (*block.BlockIterator,error){
+	blk,err := sst.readBlock(0)
+	if err!=nil{
+		return block.NewBlockIterator(nil),err
+	}
+	return block.CreateBlockIterAndSeekToFirst(blk),nil
+}
+
+// SeekForPrevBlock positions an iterator at the last entry at or before key.
+// The blocks after the first whose separator is past key only have keys
+// past it, so the entry is in that block or ends the one before.
+func SeekForPrevBlock(sst *SSTable,key []byte) (*block.BlockIterator,int,error){
+	r := sst.acquire()
+	count := r.getBlockCount()
+	blockIdx := sort.Search(count,func (i int) bool{
+		return sst.comparator.Compare(sst.blockMetaAt(r,i).separator,key) > 0
+	})
+	sst.release(r)
+	if count == 0{
+		return block.NewBlockIterator(nil),0,nil
+	}
+	blockIdx = min(blockIdx,count-1)
+	blk,err := sst.readBlock(blockIdx)
+	if err!=nil{
+		return block.NewBlockIterator(nil),blockIdx,err
+	}
+	blockIter := block.NewBlockIterator(blk)
+	blockIter.SeekForPrev(key)
+	if !blockIter.IsValid() && blockIdx > 0{
+		blockIdx--
+		if blk,err = sst.readBlock(blockIdx); err!=nil{
+			return block.NewBlockIterator(nil),blockIdx,err
+		}
+		blockIter = block.CreateBlockIterAndSeekToLast(blk)
+	}
+	return blockIter,blockIdx,nil
+}
+
+func SeekToLastBlock(sst *SSTable) (*block.BlockIterator,int,error){
+	blockIdx := sst.getBlockCount()-1
+	if blockIdx < 0{
+		return block.NewBlockIterator(nil),0,nil
+	}
+	blk,err := sst.readBlock(blockIdx)
+	if err!=nil{
+		return block.NewBlockIterator(nil),blockIdx,err
+	}
+	return block.CreateBlockIterAndSeekToLast(blk),blockIdx,nil
 }
 
 func (si *SSTIterator) SeekToFirst(){
-	iter := SeekToFirstBlock(si.sst)
+	si.blockIter,si.err = SeekToFirstBlock(si.sst)
 	si.blockIdx = 0
-	si.blockIter = iter
 }
 
 func (si *SSTIterator) SeekToKey(key []byte){
-	iter, idx := SeekToKeyBlock(si.sst,key)
-	si.blockIdx = idx
-	si.blockIter = iter
+	si.blockIter,si.blockIdx,si.err = SeekToKeyBlock(si.sst,key)
+}
+
+func (si *SSTIterator) SeekToLast(){
+	si.blockIter,si.blockIdx,si.err = SeekToLastBlock(si.sst)
+}
+
+func (si *SSTIterator) SeekForPrev(key []byte){
+	si.blockIter,si.blockIdx,si.err = SeekForPrevBlock(si.sst,key)
 }
 
 func CreateSSTIterAndSeekToKey(sst *SSTable, key []byte) *SSTIterator{
-	blockIter, blockIdx := SeekToKeyBlock(sst,key)
-	return &SSTIterator{
-		sst,
-		blockIdx,
-		blockIter,
-	}
+	si := &SSTIterator{sst: sst}
+	si.SeekToKey(key)
+	return si
 }
 
 func CreateSSTIterAndSeekToFirst(sst *SSTable)*SSTIterator{
-	iter := SeekToFirstBlock(sst)
-	return &SSTIterator{
-		sst:sst,
-		blockIdx:0,
-		blockIter: iter,
-	}
+	si := &SSTIterator{sst: sst}
+	si.SeekToFirst()
+	return si
+}
 
+func CreateSSTIterAndSeekToLast(sst *SSTable) *SSTIterator{
+	si := &SSTIterator{sst: sst}
+	si.SeekToLast()
+	return si
 }
 
+func CreateSSTIterAndSeekForPrev(sst *SSTable, key []byte) *SSTIterator{
+	si := &SSTIterator{sst: sst}
+	si.SeekForPrev(key)
+	return si
+}
 
 func CreateSSTConcatIterAndSeekToFirst(sstables []*SSTable) *SSTConcatIter{
 	if len(sstables)==0{
@@ -251,8 +705,8 @@ func (s *SSTConcatIter) moveUntilValid() error{
 		if s.sstIter == nil{
 			return nil
 		}
-		if s.sstIter.IsValid(){
-			return nil
+		if s.sstIter.IsValid() || s.sstIter.err!=nil{
+			return s.sstIter.err
 		}
 		if s.nextId >= len(s.sstables){
 			s.sstIter = nil
@@ -263,6 +717,69 @@ func (s *SSTConcatIter) moveUntilValid() error{
 	}
 }
 
+// moveBackUntilValid is moveUntilValid for backward iteration, stepping to
+// the end of the previous table.
+func (s *SSTConcatIter) moveBackUntilValid() error{
+	for {
+		if s.sstIter == nil || s.sstIter.IsValid() || s.sstIter.err!=nil{
+			return s.Error()
+		}
+		// nextId is one past the table sstIter reads
+		if s.nextId-1 <= 0{
+			s.sstIter = nil
+			return nil
+		}
+		s.nextId-=1
+		s.sstIter = CreateSSTIterAndSeekToLast(s.sstables[s.nextId-1])
+	}
+}
+
+func (s *SSTConcatIter) SeekToFirst(){
+	s.sstIter = nil
+	s.nextId = len(s.sstables)
+	if len(s.sstables) > 0{
+		s.sstIter = CreateSSTIterAndSeekToFirst(s.sstables[0])
+		s.nextId = 1
+	}
+	s.moveUntilValid()
+}
+
+func (s *SSTConcatIter) SeekToLast(){
+	s.sstIter = nil
+	s.nextId = 0
+	if len(s.sstables) > 0{
+		s.sstIter = CreateSSTIterAndSeekToLast(s.sstables[len(s.sstables)-1])
+		s.nextId = len(s.sstables)
+	}
+	s.moveBackUntilValid()
+}
+
+func (s *SSTConcatIter) SeekToKey(key []byte){
+	idx := sort.Search(len(s.sstables),func (i int) bool{
+		return s.sstables[i].comparator.Compare(s.sstables[i].lastKey,key) >= 0
+	})
+	s.sstIter = nil
+	s.nextId = len(s.sstables)
+	if idx < len(s.sstables){
+		s.sstIter = CreateSSTIterAndSeekToKey(s.sstables[idx],key)
+		s.nextId = idx+1
+	}
+	s.moveUntilValid()
+}
+
+func (s *SSTConcatIter) SeekForPrev(key []byte){
+	idx := sort.Search(len(s.sstables),func (i int) bool{
+		return s.sstables[i].comparator.Compare(s.sstables[i].firstKey,key) > 0
+	}) - 1
+	s.sstIter = nil
+	s.nextId = 0
+	if idx >= 0{
+		s.sstIter = CreateSSTIterAndSeekForPrev(s.sstables[idx],key)
+		s.nextId = idx+1
+	}
+	s.moveBackUntilValid()
+}
+
 func (s *SSTConcatIter) IsValid() bool {
     if s.sstIter == nil {
         return false
@@ -270,6 +787,15 @@ func (s *SSTConcatIter) IsValid() bool {
     return s.sstIter.IsValid()
 }
 
+// Error returns the error that stopped the iterator, nil if it ran out of
+// entries.
+func (s *SSTConcatIter) Error() error {
+    if s.sstIter == nil {
+        return nil
+    }
+    return s.sstIter.err
+}
+
 func (s *SSTConcatIter) Key() []byte {
     if !s.IsValid() {
         return nil
@@ -294,19 +820,62 @@ func (s *SSTConcatIter) Next() error {
     return s.moveUntilValid()
 }
 
+func (s *SSTConcatIter) Prev() error {
+    if !s.IsValid() {
+        return nil
+    }
+    if err := s.sstIter.Prev(); err != nil {
+        return err
+    }
+    return s.moveBackUntilValid()
+}
+
 // StorageIterator interface implementation for SSTIterator
 func (si *SSTIterator) Next() error{
+	if si.err!=nil{
+		return si.err
+	}
 	si.blockIter.Next()
 	if !si.blockIter.IsValid(){
 		si.blockIdx += 1
 		if si.blockIdx < si.sst.getBlockCount(){
-			blk := si.sst.readBlock(si.blockIdx)
+			blk,err := si.sst.readBlock(si.blockIdx)
+			if err!=nil{
+				si.blockIter,si.err = block.NewBlockIterator(nil),err
+				return err
+			}
 			si.blockIter = block.CreateBlockIterAndSeekToFirst(blk)
 		}
 	}
 	return nil
 }
 
+func (si *SSTIterator) Prev() error{
+	if si.err!=nil{
+		return si.err
+	}
+	if !si.blockIter.IsValid(){
+		return nil
+	}
+	si.blockIter.Prev()
+	if !si.blockIter.IsValid() && si.blockIdx > 0{
+		si.blockIdx -= 1
+		blk,err := si.sst.readBlock(si.blockIdx)
+		if err!=nil{
+			si.blockIter,si.err = block.NewBlockIterator(nil),err
+			return err
+		}
+		si.blockIter = block.CreateBlockIterAndSeekToLast(blk)
+	}
+	return nil
+}
+
+// Error returns the error of the block that stopped the iterator, nil if it
+// ran out of entries.
+func (si *SSTIterator) Error() error{
+	return si.err
+}
+
 func (si *SSTIterator) IsValid() bool {
 	return si.blockIter.IsValid()
 }
@@ -321,14 +890,14 @@ func (si *SSTIterator) Value() []byte{
 
 func checkLevelValidity(level []*SSTable){
 	for i,sst := range level{
-		if(bytes.Compare(sst.firstKey,sst.lastKey) <= 0){ 
+		if(sst.comparator.Compare(sst.firstKey,sst.lastKey) > 0){ 
 			panic(fmt.Sprintf("invalid SST ordering in SSTable at index %d: firstKey (%v) should not be greater than lastKey (%v)", 
                 i, sst.firstKey, sst.lastKey))
 		}
 	}
 	
 	for i:=0;i<len(level)-1;i++{
-		if(bytes.Compare(level[i].lastKey,level[i+1].firstKey) <= 0){ 
+		if(level[i].comparator.Compare(level[i].lastKey,level[i+1].firstKey) >= 0){ 
 			panic(fmt.Sprintf("invalid SST ordering between SSTable at index %d and SSTable at index %d: lastKey (%v) of first SSTable is greater than firstKey (%v) of second SSTable", 
                 i, i+1, level[i].lastKey, level[i+1].firstKey))
 		}
@@ -337,49 +906,93 @@ func checkLevelValidity(level []*SSTable){
 
 func CreateLevelIterAndSeekToKey(level []*SSTable,key []byte) *LevelIterator{
 	checkLevelValidity(level)
-	
-	idx := sort.Search(len(level),func (i int) bool{
-		return bytes.Compare(level[i].firstKey,key) <= 0
-	})
-	if(idx>=len(level)){
-		return &LevelIterator{
-			levelSSTs: level,
-			sstIter: nil,
-			curIdx: len(level)-1,
-		}
-	}
-
-	l:= &LevelIterator{
-		levelSSTs: level,
-		sstIter: CreateSSTIterAndSeekToKey(level[idx],key),
-		curIdx: idx,
-	}
-	l.Next()
+	l := &LevelIterator{levelSSTs: level}
+	l.SeekToKey(key)
 	return l
 }
 
 func CreateLevelIterAndSeekToFirst(level []*SSTable) *LevelIterator{
 	checkLevelValidity(level)
-	if len(level)==0{
-		return &LevelIterator{
-			curIdx: -1,
-			sstIter: nil,
-		}
+	l := &LevelIterator{levelSSTs: level}
+	l.SeekToFirst()
+	return l
+}
+
+func CreateLevelIterAndSeekToLast(level []*SSTable) *LevelIterator{
+	checkLevelValidity(level)
+	l := &LevelIterator{levelSSTs: level}
+	l.SeekToLast()
+	return l
+}
+
+func CreateLevelIterAndSeekForPrev(level []*SSTable,key []byte) *LevelIterator{
+	checkLevelValidity(level)
+	l := &LevelIterator{levelSSTs: level}
+	l.SeekForPrev(key)
+	return l
+}
+
+func (l *LevelIterator) SeekToFirst(){
+	l.sstIter = nil
+	l.curIdx = -1
+	if len(l.levelSSTs) > 0{
+		l.curIdx = 0
+		l.sstIter = CreateSSTIterAndSeekToFirst(l.levelSSTs[0])
 	}
-	
-	l:= &LevelIterator{
-		levelSSTs: level,
-		sstIter: CreateSSTIterAndSeekToFirst(level[0]),
-		curIdx: 0,
+	l.moveUntilValid()
+}
+
+func (l *LevelIterator) SeekToLast(){
+	l.sstIter = nil
+	l.curIdx = len(l.levelSSTs)-1
+	if len(l.levelSSTs) > 0{
+		l.sstIter = CreateSSTIterAndSeekToLast(l.levelSSTs[l.curIdx])
 	}
-	l.Next()
-	return l
+	l.moveBackUntilValid()
+}
+
+func (l *LevelIterator) SeekToKey(key []byte){
+	idx := sort.Search(len(l.levelSSTs),func (i int) bool{
+		return l.levelSSTs[i].comparator.Compare(l.levelSSTs[i].lastKey,key) >= 0
+	})
+	l.sstIter = nil
+	l.curIdx = len(l.levelSSTs)-1
+	if idx < len(l.levelSSTs){
+		l.curIdx = idx
+		l.sstIter = CreateSSTIterAndSeekToKey(l.levelSSTs[idx],key)
+	}
+	l.moveUntilValid()
+}
+
+// SeekForPrev moves to the last key at or before key.
+func (l *LevelIterator) SeekForPrev(key []byte){
+	idx := sort.Search(len(l.levelSSTs),func (i int) bool{
+		return l.levelSSTs[i].comparator.Compare(l.levelSSTs[i].firstKey,key) > 0
+	}) - 1
+	l.sstIter = nil
+	l.curIdx = idx
+	if idx >= 0{
+		l.sstIter = CreateSSTIterAndSeekForPrev(l.levelSSTs[idx],key)
+	}
+	l.moveBackUntilValid()
 }
 
 // StorageIterator interface implementation for SSTLevelIterator
 func (l *LevelIterator) Next() error{
+	if l.sstIter==nil{
+		return nil
+	}
+	if err := l.sstIter.Next(); err!=nil{
+		return err
+	}
+	return l.moveUntilValid()
+}
+
+func (l *LevelIterator) moveUntilValid() error{
 	for l.sstIter!=nil {
-		if l.IsValid(){ break }
+		if l.IsValid() || l.sstIter.err!=nil{
+			return l.sstIter.err
+		}
 		if l.curIdx+1 >= len(l.levelSSTs){
 			l.sstIter = nil
 		} else {
@@ -390,10 +1003,44 @@ func (l *LevelIterator) Next() error{
 	return nil
 }
 
+func (l *LevelIterator) Prev() error{
+	if !l.IsValid(){
+		return nil
+	}
+	if err := l.sstIter.Prev(); err!=nil{
+		return err
+	}
+	return l.moveBackUntilValid()
+}
+
+func (l *LevelIterator) moveBackUntilValid() error{
+	for l.sstIter!=nil {
+		if l.IsValid() || l.sstIter.err!=nil{
+			return l.sstIter.err
+		}
+		if l.curIdx <= 0{
+			l.sstIter = nil
+		} else {
+			l.curIdx-=1
+			l.sstIter = CreateSSTIterAndSeekToLast(l.levelSSTs[l.curIdx])
+		}
+	}
+	return nil
+}
+
 func (l *LevelIterator) IsValid() bool{
 	return l.sstIter!=nil && l.sstIter.IsValid()
 }
 
+// Error returns the error that stopped the iterator, nil if it ran out of
+// entries.
+func (l *LevelIterator) Error() error{
+	if l.sstIter==nil{
+		return nil
+	}
+	return l.sstIter.err
+}
+
 func (l *LevelIterator) Key() []byte{
 	return l.sstIter.Key()
 }
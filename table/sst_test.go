@@ -1,6 +1,7 @@
 package table
 
 import (
+	"fmt"
 	"os"
 	"testing"
 
@@ -23,4 +24,232 @@ func TestSSTSingleKey(t *testing.T){
 	sst := builder.Build(0,filePath)
 	require.Equal(t,"key1",string(sst.firstKey))
 	//require.Equal(t,"keys2",string(sst.lastKey))
-}
\ No newline at end of file
+}
+func TestSSTPrefixBloom(t *testing.T){
+	dir, _ := os.MkdirTemp("", tempDir)
+	defer os.RemoveAll(dir)
+
+	extractor := NewSeparatorPrefixExtractor('/',2)
+	builder := NewSSTBuilder(4096)
+	builder.SetPrefixExtractor(extractor)
+	for _,k := range []string{"t1/orders/1","t1/orders/2","t1/users/1","t3/users/9"}{
+		builder.Add([]byte(k),[]byte("v"))
+	}
+	sst := builder.Build(0,dir + "0.sst")
+
+	require.True(t,sst.MayContainPrefix(extractor,[]byte("t1/orders/")))
+	require.True(t,sst.MayContainPrefix(extractor,[]byte("t3/users/")))
+	// outside the key range
+	require.False(t,sst.MayContainPrefix(extractor,[]byte("t0/users/")))
+	require.False(t,sst.MayContainPrefix(extractor,[]byte("t4/users/")))
+	// a different extractor can't use the filter
+	require.True(t,sst.MayContainPrefix(NewFixedPrefixExtractor(3),[]byte("t2/")))
+
+	ruledOut := 0
+	for i := 0; i < 100; i++{
+		if !sst.MayContainPrefix(extractor,[]byte(fmt.Sprintf("t2/p%d/",i))){
+			ruledOut++
+		}
+	}
+	require.Greater(t,ruledOut,90)
+}
+
+func TestPrefixExtractors(t *testing.T){
+	sep := NewSeparatorPrefixExtractor('/',2)
+	require.True(t,sep.InDomain([]byte("tenant/entity/id")))
+	require.Equal(t,"tenant/entity/",string(sep.Transform([]byte("tenant/entity/id"))))
+	require.False(t,sep.InDomain([]byte("tenant/entity")))
+	require.True(t,IsWholePrefix(sep,[]byte("tenant/entity/")))
+	require.False(t,IsWholePrefix(sep,[]byte("tenant/ent")))
+
+	fixed := NewFixedPrefixExtractor(2)
+	require.Equal(t,"ab",string(fixed.Transform([]byte("abc"))))
+	require.False(t,fixed.InDomain([]byte("a")))
+
+	require.Equal(t,"ab",string(PrefixSuccessor([]byte("aa"))))
+	require.Equal(t,"b",string(PrefixSuccessor([]byte{'a',0xff})))
+	require.Nil(t,PrefixSuccessor([]byte{0xff}))
+}
+
+func TestSSTBloomPersisted(t *testing.T){
+	dir := t.TempDir() + "/"
+
+	build := func(path string, bitsPerKey int) *SSTable{
+		builder := NewSSTBuilder(4096)
+		builder.SetBloomBitsPerKey(bitsPerKey)
+		for i := 0; i < 1000; i++{
+			builder.Add([]byte(fmt.Sprintf("key%04d",i)),[]byte("v"))
+		}
+		return builder.Build(0,path)
+	}
+	sst := build(dir + "0.sst",10)
+	small := build(dir + "1.sst",4)
+	require.Less(t,len(small.Filter().(*BloomFilter).filter),len(sst.Filter().(*BloomFilter).filter))
+
+	fw, err := OpenFileWrapper(dir + "0.sst")
+	require.NoError(t,err)
+	opened, err := OpenSSTable(0,fw,nil)
+	require.NoError(t,err)
+	require.Equal(t,sst.Filter(),opened.Filter())
+	for i := 0; i < 1000; i++{
+		require.True(t,opened.MayContain([]byte(fmt.Sprintf("key%04d",i))))
+	}
+}
+
+func TestSSTPartitionedIndex(t *testing.T){
+	dir := t.TempDir() + "/"
+	cache := NewBlockCache(1 << 20)
+	builder := NewSSTBuilder(128)
+	builder.SetIndexPartitionSize(4)
+	builder.SetPrefixExtractor(NewFixedPrefixExtractor(4))
+	builder.SetBlockCache(cache)
+	for i := 0; i < 1000; i++{
+		builder.Add([]byte(fmt.Sprintf("k%03d%04d",i/10,i)),[]byte("value"))
+	}
+	built := builder.Build(0,dir + "0.sst")
+	require.Greater(t,len(built.handle.reader.partitions),10)
+	require.Nil(t,built.handle.reader.blockMeta)
+
+	fw, err := OpenFileWrapper(dir + "0.sst")
+	require.NoError(t,err)
+	opened, err := OpenSSTable(0,fw,nil)
+	require.NoError(t,err)
+	opened.SetBlockCache(cache)
+	require.Equal(t,built.handle.reader.partitions,opened.handle.reader.partitions)
+	require.Equal(t,built.getBlockCount(),opened.getBlockCount())
+
+	for _, sst := range []*SSTable{built,opened}{
+		iter := CreateSSTIterAndSeekToFirst(sst)
+		for i := 0; i < 1000; i++{
+			require.True(t,iter.IsValid())
+			require.Equal(t,fmt.Sprintf("k%03d%04d",i/10,i),string(iter.Key()))
+			require.NoError(t,iter.Next())
+		}
+		require.False(t,iter.IsValid())
+
+		iter = CreateSSTIterAndSeekToLast(sst)
+		for i := 999; i >= 0; i--{
+			require.True(t,iter.IsValid())
+			require.Equal(t,fmt.Sprintf("k%03d%04d",i/10,i),string(iter.Key()))
+			require.NoError(t,iter.Prev())
+		}
+		require.False(t,iter.IsValid())
+
+		for i := 0; i < 1000; i++{
+			require.True(t,sst.MayContain([]byte(fmt.Sprintf("k%03d%04d",i/10,i))))
+		}
+		for i := 0; i < 100; i++{
+			require.True(t,sst.MayContainPrefix(NewFixedPrefixExtractor(4),[]byte(fmt.Sprintf("k%03d",i))))
+		}
+		falsePositives := 0
+		for i := 1000; i < 2000; i++{
+			if sst.MayContain([]byte(fmt.Sprintf("k%03d%04d",i/10,i))){
+				falsePositives++
+			}
+		}
+		require.Zero(t,falsePositives,"keys past the table are ruled out by the index")
+		for i := 0; i < 1000; i++{
+			if sst.MayContain([]byte(fmt.Sprintf("k%03d%04dx",i/10,i))){
+				falsePositives++
+			}
+		}
+		require.Less(t,falsePositives,50)
+	}
+	require.Greater(t,cache.Size(),int64(0))
+}
+
+func TestSSTIndexSeparators(t *testing.T){
+	dir := t.TempDir() + "/"
+	key := func(i int) string{
+		return fmt.Sprintf("%03d%0197d",i,0)
+	}
+	for _, partitionSize := range []int{0,3}{
+		builder := NewSSTBuilder(1024)
+		builder.SetIndexPartitionSize(partitionSize)
+		// three versions of every key, which span blocks
+		for i := 0; i < 100; i++{
+			for v := 0; v < 3; v++{
+				builder.Add([]byte(key(i)),[]byte(fmt.Sprint(v)))
+			}
+		}
+		path := fmt.Sprintf("%s%d.sst",dir,partitionSize)
+		built := builder.Build(0,path)
+		opened, err := OpenSSTable(0,mustOpenFile(t,path),nil)
+		require.NoError(t,err)
+		for _, sst := range []*SSTable{built,opened}{
+			require.Equal(t,key(0),string(sst.GetFirstKey()))
+			require.Equal(t,key(99),string(sst.GetLastKey()))
+			r := sst.acquire()
+			short := 0
+			for i := 0; i < r.getBlockCount(); i++{
+				if len(sst.blockMetaAt(r,i).separator) < 10{
+					short++
+				}
+			}
+			sst.release(r)
+			require.Greater(t,short,sst.getBlockCount()/2)
+
+			for i := 0; i < 100; i++{
+				iter := CreateSSTIterAndSeekToKey(sst,[]byte(key(i)))
+				require.Equal(t,key(i),string(iter.Key()))
+				require.Equal(t,"0",string(iter.Value()))
+				iter = CreateSSTIterAndSeekToKey(sst,[]byte(key(i)[:3]))
+				require.Equal(t,key(i),string(iter.Key()))
+				require.Equal(t,"0",string(iter.Value()))
+				iter = CreateSSTIterAndSeekForPrev(sst,[]byte(key(i)))
+				require.Equal(t,key(i),string(iter.Key()))
+				require.Equal(t,"2",string(iter.Value()))
+				iter = CreateSSTIterAndSeekForPrev(sst,[]byte(key(i)+"x"))
+				require.Equal(t,key(i),string(iter.Key()))
+				require.Equal(t,"2",string(iter.Value()))
+			}
+			require.False(t,CreateSSTIterAndSeekToKey(sst,[]byte("999")).IsValid())
+			require.False(t,CreateSSTIterAndSeekForPrev(sst,[]byte("0")).IsValid())
+		}
+	}
+}
+
+func TestSSTCorruptBlock(t *testing.T){
+	dir := t.TempDir() + "/"
+	builder := NewSSTBuilder(256)
+	for i := 0; i < 1000; i++{
+		builder.Add([]byte(fmt.Sprintf("key%04d",i)),[]byte("value"))
+	}
+	built := builder.Build(0,dir + "0.sst")
+	require.Greater(t,built.getBlockCount(),3)
+	var inBlock2 []byte
+	for iter := CreateSSTIterAndSeekToFirst(built); iter.IsValid() && inBlock2==nil; iter.Next(){
+		if iter.blockIdx==2{
+			inBlock2 = append([]byte{},iter.Key()...)
+		}
+	}
+	data, err := os.ReadFile(dir + "0.sst")
+	require.NoError(t,err)
+	data[built.handle.reader.blockMeta[2].offset+1] ^= 0xff
+	require.NoError(t,os.WriteFile(dir + "1.sst",data,0644))
+	fw, err := OpenFileWrapper(dir + "1.sst")
+	require.NoError(t,err)
+	sst, err := OpenSSTable(1,fw,nil)
+	require.NoError(t,err)
+
+	// a scan stops at the block with an error instead of running out
+	iter := CreateSSTIterAndSeekToFirst(sst)
+	for iter.IsValid(){
+		if err = iter.Next(); err!=nil{
+			break
+		}
+	}
+	require.ErrorIs(t,err,ErrCorruption)
+	require.False(t,iter.IsValid())
+	require.ErrorIs(t,iter.Error(),ErrCorruption)
+
+	iter = CreateSSTIterAndSeekToKey(sst,inBlock2)
+	require.False(t,iter.IsValid())
+	require.ErrorIs(t,iter.Error(),ErrCorruption)
+	merged := NewMergeIterator([]*SSTIterator{CreateSSTIterAndSeekToKey(sst,inBlock2),CreateSSTIterAndSeekToFirst(built)},nil)
+	require.False(t,merged.IsValid())
+	require.ErrorIs(t,merged.Error(),ErrCorruption)
+	level := CreateLevelIterAndSeekToKey([]*SSTable{sst},inBlock2)
+	require.False(t,level.IsValid())
+	require.ErrorIs(t,level.Error(),ErrCorruption)
+}
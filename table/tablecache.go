@@ -0,0 +1,304 @@
+package table
+
+import (
+	"container/list"
+	"log"
+	"os"
+	"sync"
+)
+
+// TableCache bounds how many SSTs are open at once. An open table holds a
+// file descriptor and its parsed index and filters, so once more than
+// maxOpen are open the least recently used are closed, to be reopened on
+// their next use. Tables being read are never closed. A nil cache keeps
+// every table open.
+type TableCache struct{
+	mu sync.Mutex
+	maxOpen int
+	// of *tableHandle, the open tables, most recently used first
+	lru *list.List
+}
+
+// NewTableCache keeps at most maxOpen tables open, 0 meaning no limit.
+func NewTableCache(maxOpen int) *TableCache{
+	return &TableCache{maxOpen: maxOpen, lru: list.New()}
+}
+
+// OpenTables returns how many tables the cache holds open.
+func (c *TableCache) OpenTables() int{
+	if c==nil{
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// tableReader is what is read from the file of an open table.
+type tableReader struct{
+	file *FileWrapper
+	formatVersion uint32
+	// nil if the index is partitioned
+	blockMeta []BlockMeta
+	partitions []indexPartition
+	blockCount int
+	// nil if the table has no readable filter
+	filter Filter
+	// nil if the table has no readable range filter
+	rangeFilter *RangeFilter
+	// blocks compressed with dictCompression use dict, nil if the table has
+	// no dictionary
+	dict []byte
+	dictCompression CompressionType
+}
+
+func (r *tableReader) getBlockCount() int{
+	if r==nil{
+		return 0
+	}
+	if r.partitions!=nil{
+		return r.blockCount
+	}
+	return len(r.blockMeta)
+}
+
+// tableHandle tracks whether a table is open, shared by the table and its
+// views.
+type tableHandle struct{
+	mu sync.Mutex
+	path string
+	// nil while the table is closed
+	reader *tableReader
+	// reads of the table in progress
+	inUse int
+	// iterators that may still read the table
+	refs int
+	// the table was compacted away, its file goes with the last reference
+	obsolete bool
+	removed bool
+	// called once the file is deleted
+	onRemove func()
+	// the file is memory-mapped when opened
+	mmap bool
+	// kept while the table is closed, so it isn't mapped again on reopening.
+	// It is only unmapped once the table is removed and no longer read.
+	mapped *FileWrapper
+	cache *TableCache
+	// position in cache.lru, guarded by cache.mu
+	elem *list.Element
+}
+
+// acquire returns the reader of the table, reopening it if the table cache
+// closed it, nil if it can't be read. It stays open until released.
+func (s *SSTable) acquire() *tableReader{
+	h := s.handle
+	h.mu.Lock()
+	if h.reader==nil{
+		if h.removed{
+			h.mu.Unlock()
+			return nil
+		}
+		f, err := h.open()
+		if err!=nil{
+			h.mu.Unlock()
+			log.Printf("failed to reopen sstable %d: %v",s.Id,err)
+			return nil
+		}
+		h.reader,_,err = readTable(s.Id,f,s.comparator)
+		if err!=nil{
+			if f!=h.mapped{
+				f.Close()
+			}
+			h.mu.Unlock()
+			log.Printf("failed to reopen sstable %d: %v",s.Id,err)
+			return nil
+		}
+	}
+	h.inUse++
+	r := h.reader
+	h.mu.Unlock()
+	h.cache.touch(h)
+	return r
+}
+
+func (s *SSTable) release(r *tableReader){
+	if r==nil{
+		return
+	}
+	h := s.handle
+	h.mu.Lock()
+	h.inUse--
+	h.closeIfDone()
+	h.mu.Unlock()
+}
+
+// Ref keeps the file of the table until Unref, even if it is compacted away
+// in the meantime. Iterators hold a reference to every table they read.
+func (s *SSTable) Ref(){
+	h := s.handle
+	h.mu.Lock()
+	h.refs++
+	h.mu.Unlock()
+}
+
+func (s *SSTable) Unref(){
+	h := s.handle
+	h.mu.Lock()
+	h.refs--
+	var err error
+	remove := h.refs == 0 && h.obsolete && !h.removed
+	if remove{
+		err = h.removeFile()
+	}
+	h.mu.Unlock()
+	if remove{
+		h.cache.forget(h)
+	}
+	if err!=nil{
+		log.Printf("failed to remove sstable %d: %v",s.Id,err)
+	}
+}
+
+// Remove deletes the file of a table that was compacted away, once no
+// iterator references it.
+func (s *SSTable) Remove() error{
+	h := s.handle
+	h.mu.Lock()
+	h.obsolete = true
+	if h.refs > 0{
+		h.mu.Unlock()
+		return nil
+	}
+	err := h.removeFile()
+	h.mu.Unlock()
+	h.cache.forget(h)
+	return err
+}
+
+// Close closes the file of the table and unmaps it, when the store is
+// closed. The table must no longer be read.
+func (s *SSTable) Close(){
+	h := s.handle
+	h.mu.Lock()
+	if h.reader!=nil && h.reader.file!=h.mapped{
+		h.reader.file.Close()
+	}
+	h.reader = nil
+	if h.mapped!=nil{
+		h.mapped.Close()
+		h.mapped = nil
+	}
+	h.mu.Unlock()
+	h.cache.forget(h)
+}
+
+// OnRemove has f called once the file of the table is deleted, after the
+// last iterator reading it is closed. The table keeps the blob files it
+// refers to until then.
+func (s *SSTable) OnRemove(f func()){
+	h := s.handle
+	h.mu.Lock()
+	h.onRemove = f
+	h.mu.Unlock()
+}
+
+// open opens the file of the table, reusing its mapping. h.mu must be held.
+func (h *tableHandle) open() (*FileWrapper,error){
+	if h.mapped!=nil{
+		return h.mapped,nil
+	}
+	f, err := OpenFileWrapper(h.path)
+	if err!=nil || !h.mmap{
+		return f,err
+	}
+	if err := f.Map(); err!=nil{
+		// the file is still open, so it is read without the mapping
+		log.Printf("failed to map sstable: %v",err)
+		return f,nil
+	}
+	h.mapped = f
+	return f,nil
+}
+
+// removeFile deletes the file, which is closed once no read is in progress.
+// h.mu must be held.
+func (h *tableHandle) removeFile() error{
+	h.removed = true
+	h.closeIfDone()
+	err := os.Remove(h.path)
+	if h.onRemove!=nil{
+		h.onRemove()
+	}
+	return err
+}
+
+// closeIfDone closes a removed table once it isn't read, unmapping it.
+// h.mu must be held.
+func (h *tableHandle) closeIfDone(){
+	if !h.removed || h.inUse > 0{
+		return
+	}
+	if h.reader!=nil && h.reader.file!=h.mapped{
+		h.reader.file.Close()
+	}
+	h.reader = nil
+	if h.mapped!=nil{
+		h.mapped.Close()
+		h.mapped = nil
+	}
+}
+
+// tryClose closes the table unless it is being read, reporting whether it
+// is closed.
+func (h *tableHandle) tryClose() bool{
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.inUse > 0{
+		return false
+	}
+	if h.reader!=nil && h.reader.file!=h.mapped{
+		h.reader.file.Close()
+	}
+	h.reader = nil
+	return true
+}
+
+// forget drops a removed table from the cache.
+func (c *TableCache) forget(h *tableHandle){
+	if c==nil{
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h.elem!=nil{
+		c.lru.Remove(h.elem)
+		h.elem = nil
+	}
+}
+
+// touch marks h as just used, closing the least recently used tables past
+// the limit.
+func (c *TableCache) touch(h *tableHandle){
+	if c==nil{
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if h.elem!=nil{
+		c.lru.MoveToFront(h.elem)
+	} else {
+		h.elem = c.lru.PushFront(h)
+	}
+	if c.maxOpen <= 0{
+		return
+	}
+	for e := c.lru.Back(); e!=nil && c.lru.Len() > c.maxOpen;{
+		prev := e.Prev()
+		victim := e.Value.(*tableHandle)
+		if victim.tryClose(){
+			c.lru.Remove(e)
+			victim.elem = nil
+		}
+		e = prev
+	}
+}
@@ -0,0 +1,53 @@
+package table
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTableCache(t *testing.T){
+	dir := t.TempDir() + "/"
+	cache := NewTableCache(2)
+	var tables []*SSTable
+	for id := 0; id < 5; id++{
+		builder := NewSSTBuilder(4096)
+		builder.SetTableCache(cache)
+		for i := 0; i < 10; i++{
+			builder.Add([]byte(fmt.Sprintf("key%d%d",id,i)),[]byte("v"))
+		}
+		tables = append(tables, builder.Build(id,fmt.Sprintf("%s%d.sst",dir,id)))
+		require.LessOrEqual(t,cache.OpenTables(),2)
+	}
+	require.Nil(t,tables[0].handle.reader)
+
+	// closed tables are reopened when read
+	for round := 0; round < 2; round++{
+		for id, sst := range tables{
+			require.True(t,sst.MayContain([]byte(fmt.Sprintf("key%d5",id))))
+			require.Equal(t,10,countEntries(sst))
+			require.LessOrEqual(t,cache.OpenTables(),2)
+		}
+	}
+
+	// a referenced table keeps its file until released
+	tables[1].Ref()
+	require.NoError(t,tables[1].Remove())
+	require.FileExists(t,dir + "1.sst")
+	require.Equal(t,10,countEntries(tables[1]))
+	tables[1].Unref()
+	require.NoFileExists(t,dir + "1.sst")
+	require.Zero(t,countEntries(tables[1]))
+
+	require.NoError(t,tables[2].Remove())
+	require.NoFileExists(t,dir + "2.sst")
+}
+
+func countEntries(sst *SSTable) int{
+	count := 0
+	for iter := CreateSSTIterAndSeekToFirst(sst); iter.IsValid(); iter.Next(){
+		count++
+	}
+	return count
+}